@@ -13,15 +13,32 @@ type Configuration struct {
 }
 
 type Recorder struct {
-	Port           int
-	TeslaAuth      TeslaAuth
-	Cars           []Car
-	InfluxDbConfig InfluxDbConfig
-	Pushover       PushoverConfig
+	Port            int
+	TeslaAuth       TeslaAuth
+	Cars            []Car
+	Database        string // Storage backend: "influxdb" (default), "influxdb2", "sqlite" or "postgres".
+	InfluxDbConfig  InfluxDbConfig
+	InfluxDb2Config InfluxDb2Config
+	SqliteConfig    SqliteConfig
+	PostgresConfig  PostgresConfig
+	// Sinks, if set, replaces the single database above. Every snapshot is written to all sinks.
+	Sinks       []DatabaseSink
+	WriteBuffer WriteBufferConfig
+	Pushover    PushoverConfig
+	TireAlerts  TireAlertsConfig
+	Geofences   []GeofenceConfig
+	Tariff      TariffConfig
+	Polling     PollingConfig
+
+	// WatchVehicleDetails also reports changes to the display name, service status and option codes of a car, not
+	// only to its state.
+	WatchVehicleDetails bool
 }
 type Car struct {
 	Monitor bool
 	Vin     string
+	// RatedWhPerMile is the energy per mile of rated range, used to estimate the energy used by trips. Defaults to 250.
+	RatedWhPerMile float64
 }
 
 type TeslaAuth struct {
@@ -31,11 +48,131 @@ type TeslaAuth struct {
 	Password     string
 }
 
+type DatabaseSink struct {
+	Name            string // Used in logs and metrics. Defaults to the database type.
+	Database        string // Same values as Recorder.Database.
+	ErrorPolicy     string // "fail_fast" (default) fails the write and skips later sinks. "best_effort" only logs.
+	InfluxDbConfig  InfluxDbConfig
+	InfluxDb2Config InfluxDb2Config
+	SqliteConfig    SqliteConfig
+	PostgresConfig  PostgresConfig
+}
+
+// WriteBufferConfig enables a local queue that keeps snapshots, trips, charging sessions, efficiency samples and drain
+// summaries while the database is unreachable. With several sinks, each gets its own queue next to Path, named after
+// the sink (e.g. "buffer-influxdb.db" for "buffer.db").
+type WriteBufferConfig struct {
+	Path                 string // SQLite file holding the queue. Buffering is disabled if empty.
+	MaxSnapshots         int    // Oldest writes are dropped beyond this, per queue. 0 means no limit.
+	RetryIntervalSeconds int    // How often to retry writing buffered writes. Defaults to 30.
+}
+
 type InfluxDbConfig struct {
 	Address  string
 	Username string
 	Password string
 	Database string
+	// BatchSize is the number of snapshots buffered before writing. 0 or 1 writes every snapshot immediately. Ignored
+	// when the write buffer is enabled, since it can't recover batches that fail in the background.
+	BatchSize int
+	// FlushIntervalSeconds bounds how long batched snapshots wait before being written. Defaults to 10.
+	FlushIntervalSeconds int
+}
+
+type InfluxDb2Config struct {
+	Address string
+	Org     string
+	Bucket  string
+	Token   string
+}
+
+type SqliteConfig struct {
+	// Path to the database file. It is created if it doesn't exist.
+	Path string
+}
+
+type PostgresConfig struct {
+	Address   string // host:port
+	Username  string
+	Password  string
+	Database  string
+	SslMode   string // Defaults to "disable".
+	Timescale bool   // Store snapshots in TimescaleDB hypertables.
+}
+
+// TireAlertsConfig sets when to notify about tire pressure. A zero threshold disables its alert.
+type TireAlertsConfig struct {
+	MinPressureBar    float64 // Notify when a tire drops below this pressure.
+	MaxLossBarPerHour float64 // Notify when a tire loses pressure faster than this.
+}
+
+// GeofenceConfig defines a named place, either as a circle (center and radius) or as a polygon. Places are matched in
+// the order they're configured, so smaller places should come before the larger places that contain them.
+type GeofenceConfig struct {
+	Name         string
+	Latitude     float64 // Center of a circular geofence.
+	Longitude    float64
+	RadiusMeters float64
+	Polygon      []LatLng // Vertices of a polygon geofence, in order. Used instead of the circle if set.
+}
+
+type LatLng struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// TariffConfig sets electricity prices to compute the cost of charging sessions. Prices are per kWh added.
+type TariffConfig struct {
+	Currency string // E.g. "USD". Only used for display.
+	Timezone string // IANA name used for time-of-use schedules and monthly costs. Defaults to the local timezone.
+	// PricePerKwh and TimeOfUse price charging anywhere that isn't listed in Places.
+	PricePerKwh float64
+	TimeOfUse   []TimeOfUseRate
+	Places      []PlaceTariff
+	// SuperchargerPricePerKwh prices all DC fast charging.
+	SuperchargerPricePerKwh float64
+}
+
+// TimeOfUseRate overrides the price within a daily time window. Windows ending before they start wrap past midnight.
+type TimeOfUseRate struct {
+	Start       string   // "HH:MM"
+	End         string   // "HH:MM"
+	Days        []string // E.g. ["Sat", "Sun"]. Defaults to every day.
+	PricePerKwh float64
+}
+
+// PlaceTariff prices charging within a geofence, by name.
+type PlaceTariff struct {
+	Place       string
+	PricePerKwh float64
+	TimeOfUse   []TimeOfUseRate
+}
+
+type PollingConfig struct {
+	// LetItSleepMinutes is how long to stop fetching vehicle data once a car goes idle, so that it can fall asleep.
+	// Only the cheap vehicle list is polled meanwhile. If the car is still awake after that, it isn't recorded again
+	// until the vehicle list shows it waking up. Defaults to 15.
+	LetItSleepMinutes int
+	// Rules decide how often to poll a car that's in use. The first rule whose conditions all hold applies. If none
+	// does, the car is idle. Defaults to the built-in rules (see car.DefaultPollingRules).
+	Rules []PollingRuleConfig
+}
+
+type PollingRuleConfig struct {
+	Description string // Recorded as the snapshot's active description.
+	When        []PollingCondition
+	// PollIntervalSeconds is how long to wait before the next snapshot. Ignored if Sleep is set.
+	PollIntervalSeconds float64
+	// Sleep marks the car as idle: data polling stops so that it can fall asleep.
+	Sleep bool
+}
+
+// PollingCondition compares a snapshot field with a value, e.g. {"Field": "speed", "Op": ">", "Value": 0}. Ops are
+// "==", "!=", "<", "<=", ">", ">=" and "in", which takes a list of values.
+type PollingCondition struct {
+	Field string
+	Op    string
+	Value interface{}
 }
 
 type PushoverConfig struct {
@@ -9,5 +9,7 @@ require (
 	github.com/gregdel/pushover v1.1.0
 	github.com/influxdata/influxdb1-client v0.0.0-20220302092344-a9ab5670611c
 	github.com/kodek/tesla v0.0.0-20200502203920-f09615ca407b
+	github.com/lib/pq v1.10.9
 	github.com/pkg/errors v0.9.1
+	modernc.org/sqlite v1.20.3
 )
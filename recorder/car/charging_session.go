@@ -0,0 +1,202 @@
+package car
+
+import (
+	"sync"
+	"time"
+)
+
+// maxChargingGap is the longest time without snapshots before an ongoing charging session is considered over.
+const maxChargingGap = 30 * time.Minute
+
+// ChargingSession summarizes a charge, from the car starting to charge until it stops. Power is in kW and energy in
+// kWh.
+type ChargingSession struct {
+	Vin               string
+	CarName           string
+	StartTime         time.Time
+	EndTime           time.Time
+	Location          Location
+	Place             string // Geofence name, if any.
+	StartBatteryLevel int
+	EndBatteryLevel   int
+	// EndRange is the rated range when the session ended, in miles.
+	EndRange       float64
+	Odometer       float64
+	ChargeLimitSoc int
+	EnergyAdded    float64
+	PeakPower      float64
+	AveragePower   float64
+	// DC is true for fast charging (e.g. Superchargers) and false for AC charging.
+	DC               bool
+	FastChargerType  string
+	FastChargerBrand string
+	// ReachedLimit is true if the session ended because the charge limit was reached.
+	ReachedLimit bool
+	// Cost of the energy added, set from the tariff when the session is recorded. Currency is empty if no tariff
+	// was configured then.
+	Cost     float64
+	Currency string
+}
+
+func (c *ChargingSession) Duration() time.Duration {
+	return c.EndTime.Sub(c.StartTime)
+}
+
+// IsCharging returns whether the given charging state means energy is flowing into the battery.
+// ChargeComplete is the charging state of a car that finished charging and is still plugged in.
+const ChargeComplete = "Complete"
+
+func IsCharging(chargingState string) bool {
+	return chargingState == "Charging" || chargingState == "Starting"
+}
+
+// ChargingSessionDetector turns a stream of snapshots into charging sessions. It's safe for concurrent use by
+// several cars.
+type ChargingSessionDetector struct {
+	mu    sync.Mutex
+	state map[string]*chargingState
+}
+
+// chargingState tracks the ongoing charging session of a single car.
+type chargingState struct {
+	session *ChargingSession
+	last    *Snapshot
+	// startEnergy is the car's energy added counter when the session started. The counter keeps going when charging
+	// resumes without unplugging.
+	startEnergy float64
+	// integratedEnergy is the energy integrated from the charger power, used if the counter isn't reported.
+	integratedEnergy float64
+}
+
+func NewChargingSessionDetector() *ChargingSessionDetector {
+	return &ChargingSessionDetector{
+		state: make(map[string]*chargingState),
+	}
+}
+
+// Observe processes the next snapshot of a car, in chronological order. It returns the charging session that the
+// snapshot completed, if any.
+func (d *ChargingSessionDetector) Observe(s *Snapshot) *ChargingSession {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.state[s.Vin]
+	if !ok {
+		state = &chargingState{}
+		d.state[s.Vin] = state
+	}
+	defer func() {
+		state.last = s
+	}()
+
+	var completed *ChargingSession
+	if state.session != nil && s.Timestamp.Sub(state.last.Timestamp) > maxChargingGap {
+		// We lost track of the car. End the session where we last saw it.
+		completed = state.finish(state.last)
+	}
+
+	if !IsCharging(s.ChargingState) || s.ChargeSession == nil {
+		if state.session != nil {
+			completed = state.finish(s)
+		}
+		return completed
+	}
+
+	if state.session == nil {
+		state.start(s)
+	} else {
+		state.update(s)
+	}
+	return completed
+}
+
+// Flush ends the ongoing charging sessions of all cars at their last snapshot, and returns them. It's meant to be
+// called on shutdown, since ongoing sessions aren't resumed after a restart.
+func (d *ChargingSessionDetector) Flush() []ChargingSession {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var sessions []ChargingSession
+	for _, state := range d.state {
+		if state.session == nil {
+			continue
+		}
+		if session := state.finish(state.last); session != nil {
+			sessions = append(sessions, *session)
+		}
+	}
+	return sessions
+}
+
+func (state *chargingState) start(s *Snapshot) {
+	state.session = &ChargingSession{
+		Vin:               s.Vin,
+		CarName:           s.Name,
+		StartTime:         s.Timestamp,
+		Location:          Location{s.Bearings.Latitude, s.Bearings.Longitude},
+		Place:             s.Place,
+		StartBatteryLevel: s.BatteryLevel,
+	}
+	state.startEnergy = s.ChargeSession.ChargeEnergyAdded
+	state.integratedEnergy = 0
+	state.last = nil
+	state.update(s)
+}
+
+// update accumulates a snapshot taken while charging.
+func (state *chargingState) update(s *Snapshot) {
+	session := state.session
+	charge := s.ChargeSession
+	if state.last != nil && state.last.ChargeSession != nil {
+		// Trapezoidal integration of power (kW) over time.
+		hours := s.Timestamp.Sub(state.last.Timestamp).Hours()
+		state.integratedEnergy += (state.last.ChargeSession.ChargerPower + charge.ChargerPower) / 2 * hours
+	}
+	if charge.ChargerPower > session.PeakPower {
+		session.PeakPower = charge.ChargerPower
+	}
+	if charge.FastChargerPresent {
+		session.DC = true
+		session.FastChargerType = charge.FastChargerType
+		session.FastChargerBrand = charge.FastChargerBrand
+	}
+	state.countEnergy(charge)
+}
+
+// countEnergy updates the energy added from the car's counter.
+func (state *chargingState) countEnergy(charge *ChargeSession) {
+	if counted := charge.ChargeEnergyAdded - state.startEnergy; counted > 0 {
+		state.session.EnergyAdded = counted
+	} else if charge.ChargeEnergyAdded > 0 && charge.ChargeEnergyAdded < state.startEnergy {
+		// The counter was reset, so the car was replugged without us noticing.
+		state.session.EnergyAdded = charge.ChargeEnergyAdded
+	}
+}
+
+// finish completes the ongoing session at the given snapshot. Sessions that added no energy are discarded.
+func (state *chargingState) finish(s *Snapshot) *ChargingSession {
+	if s.ChargeSession != nil {
+		// The counter includes the energy added since the previous snapshot.
+		state.countEnergy(s.ChargeSession)
+	}
+	session := state.session
+	state.session = nil
+
+	session.EndTime = s.Timestamp
+	session.EndBatteryLevel = s.BatteryLevel
+	session.EndRange = s.RangeLeft
+	session.Odometer = s.Odometer
+	session.ChargeLimitSoc = s.ChargeLimitSoc
+	session.ReachedLimit = s.ChargingState == ChargeComplete ||
+		(s.ChargeLimitSoc > 0 && s.BatteryLevel >= s.ChargeLimitSoc)
+	if session.EnergyAdded <= 0 {
+		session.EnergyAdded = state.integratedEnergy
+	}
+	if session.EnergyAdded <= 0 {
+		return nil
+	}
+	if hours := session.Duration().Hours(); hours > 0 {
+		session.AveragePower = session.EnergyAdded / hours
+	}
+	return session
+}
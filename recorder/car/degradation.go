@@ -0,0 +1,150 @@
+package car
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// minDegradationSoc is the lowest state of charge (%) a session must end at to estimate the full-pack range.
+	// The API reports whole percents, so extrapolating from lower levels amplifies rounding too much.
+	minDegradationSoc = 50
+	// degradationBucketMiles is the odometer distance covered by each point of a degradation curve.
+	degradationBucketMiles = 1000
+	// maxDegradationDeviations is how many (scaled) median absolute deviations an estimate may be off the median of
+	// its bucket before it's discarded as noise.
+	maxDegradationDeviations = 3
+)
+
+// DegradationPoint is the estimated full-pack rated range (range at 100%) over a stretch of odometer.
+type DegradationPoint struct {
+	Odometer  float64   // Average odometer of the samples, in miles.
+	Time      time.Time // Time of the latest sample.
+	FullRange float64   // Median full-pack rated range, in miles.
+	Samples   int
+}
+
+// DegradationCurve is the estimated full-pack rated range of a car as its odometer grows.
+type DegradationCurve struct {
+	Vin    string
+	Points []DegradationPoint
+	// InitialFullRange and LatestFullRange are the full-pack ranges of the first and last points.
+	InitialFullRange float64
+	LatestFullRange  float64
+	// DegradationPercent is the range lost between the first and last points.
+	DegradationPercent float64
+}
+
+// fullRangeSample is a single full-pack range estimate.
+type fullRangeSample struct {
+	time      time.Time
+	odometer  float64
+	fullRange float64
+}
+
+// NewDegradationCurve estimates the degradation curve of a car by extrapolating to 100% the range at the end of its
+// charging sessions and in snapshots taken once charging was complete (see ChargeComplete). Sessions recorded before
+// their range and odometer were stored have no estimate, so the snapshots cover older history. Estimates below
+// minDegradationSoc are ignored. Since a car is sampled many times while parked, only the latest estimate at each
+// odometer reading is kept. Estimates that stray too far from the others in their odometer bucket are discarded as
+// noise.
+func NewDegradationCurve(vin string, sessions []ChargingSession, snapshots []Snapshot) DegradationCurve {
+	byOdometer := make(map[float64]fullRangeSample)
+	addSample := func(t time.Time, odometer float64, batteryLevel int, rangeLeft float64) {
+		if batteryLevel < minDegradationSoc || rangeLeft <= 0 || odometer <= 0 {
+			return
+		}
+		if prev, ok := byOdometer[odometer]; ok && prev.time.After(t) {
+			return
+		}
+		byOdometer[odometer] = fullRangeSample{
+			time:      t,
+			odometer:  odometer,
+			fullRange: rangeLeft * 100 / float64(batteryLevel),
+		}
+	}
+	for _, session := range sessions {
+		addSample(session.EndTime, session.Odometer, session.EndBatteryLevel, session.EndRange)
+	}
+	for _, s := range snapshots {
+		if s.ChargingState == ChargeComplete && IsParked(s.DrivingState) {
+			addSample(s.Timestamp, s.Odometer, s.BatteryLevel, s.RangeLeft)
+		}
+	}
+
+	buckets := make(map[int][]fullRangeSample)
+	for _, sample := range byOdometer {
+		bucket := int(sample.odometer / degradationBucketMiles)
+		buckets[bucket] = append(buckets[bucket], sample)
+	}
+
+	keys := make([]int, 0, len(buckets))
+	for bucket := range buckets {
+		keys = append(keys, bucket)
+	}
+	sort.Ints(keys)
+
+	curve := DegradationCurve{
+		Vin:    vin,
+		Points: []DegradationPoint{},
+	}
+	for _, bucket := range keys {
+		if point, ok := degradationPoint(buckets[bucket]); ok {
+			curve.Points = append(curve.Points, point)
+		}
+	}
+	if len(curve.Points) > 0 {
+		curve.InitialFullRange = curve.Points[0].FullRange
+		curve.LatestFullRange = curve.Points[len(curve.Points)-1].FullRange
+		curve.DegradationPercent = (1 - curve.LatestFullRange/curve.InitialFullRange) * 100
+	}
+	return curve
+}
+
+// degradationPoint summarizes the estimates of a bucket, after discarding outliers.
+func degradationPoint(samples []fullRangeSample) (DegradationPoint, bool) {
+	ranges := make([]float64, len(samples))
+	for i, s := range samples {
+		ranges[i] = s.fullRange
+	}
+	m := median(ranges)
+	deviations := make([]float64, len(samples))
+	for i, r := range ranges {
+		deviations[i] = math.Abs(r - m)
+	}
+	// Scale the median absolute deviation to estimate the standard deviation of normally distributed noise.
+	mad := 1.4826 * median(deviations)
+
+	var point DegradationPoint
+	var kept []float64
+	var odometerTotal float64
+	for i, s := range samples {
+		if mad > 0 && deviations[i] > maxDegradationDeviations*mad {
+			continue
+		}
+		kept = append(kept, s.fullRange)
+		odometerTotal += s.odometer
+		if s.time.After(point.Time) {
+			point.Time = s.time
+		}
+	}
+	if len(kept) == 0 {
+		return point, false
+	}
+	point.Odometer = odometerTotal / float64(len(kept))
+	point.FullRange = median(kept)
+	point.Samples = len(kept)
+	return point, true
+}
+
+// median returns the median of the given values.
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,289 @@
+package car
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	kmPerMile = 1.609344
+
+	// efficiencySampleInterval is how much driving each efficiency sample covers.
+	efficiencySampleInterval = time.Minute
+	// maxEfficiencyGap is the longest time between two snapshots for the driving in between to be sampled.
+	maxEfficiencyGap = 2 * time.Minute
+)
+
+// WhPerMile returns the energy used per mile driven, or 0 if the car didn't move.
+func (t *Trip) WhPerMile() float64 {
+	return WhPerMile(t.EnergyUsed, t.Distance())
+}
+
+// WhPerKm returns the energy used per kilometer driven, or 0 if the car didn't move.
+func (t *Trip) WhPerKm() float64 {
+	return t.WhPerMile() / kmPerMile
+}
+
+// WhPerMile converts the energy used over a distance, in kWh and miles, to Wh/mi. It returns 0 if the distance is not
+// positive.
+func WhPerMile(energyKwh float64, miles float64) float64 {
+	if miles <= 0 {
+		return 0
+	}
+	return energyKwh * 1000 / miles
+}
+
+// EfficiencySample is the energy used over a short stretch of driving. Samples are small enough to have a single
+// speed and outside temperature, so they can be grouped by either.
+type EfficiencySample struct {
+	Vin       string
+	CarName   string
+	Timestamp time.Time // End of the stretch.
+	Duration  time.Duration
+	Distance  float64 // Miles.
+	// EnergyUsed is the net energy drawn from the battery, in kWh.
+	EnergyUsed float64
+	// OutsideTemp is the average outside temperature in Celsius, or nil if it wasn't reported.
+	OutsideTemp *float64
+}
+
+// AverageSpeed returns the average speed over the sample in miles per hour.
+func (s *EfficiencySample) AverageSpeed() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return s.Distance / s.Duration.Hours()
+}
+
+// EfficiencySampler turns the snapshots of a moving car into efficiency samples. It's safe for concurrent use by
+// several cars.
+type EfficiencySampler struct {
+	mu    sync.Mutex
+	state map[string]*efficiencyState
+}
+
+// efficiencyState accumulates the ongoing sample of a single car.
+type efficiencyState struct {
+	last     *Snapshot
+	sample   *EfficiencySample
+	tempSum  float64
+	tempTime time.Duration
+}
+
+func NewEfficiencySampler() *EfficiencySampler {
+	return &EfficiencySampler{
+		state: make(map[string]*efficiencyState),
+	}
+}
+
+// Observe processes the next snapshot of a car, in chronological order. It returns the sample that the snapshot
+// completed, if any. Samples are cut short when the car parks or snapshots stop.
+func (es *EfficiencySampler) Observe(s *Snapshot) *EfficiencySample {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	state, ok := es.state[s.Vin]
+	if !ok {
+		state = &efficiencyState{}
+		es.state[s.Vin] = state
+	}
+	last := state.last
+	state.last = s
+
+	if last == nil || IsParked(last.DrivingState) || s.Timestamp.Sub(last.Timestamp) > maxEfficiencyGap ||
+		s.Odometer < last.Odometer {
+		return state.finish()
+	}
+
+	if state.sample == nil {
+		state.sample = &EfficiencySample{
+			Vin:     s.Vin,
+			CarName: s.Name,
+		}
+		state.tempSum = 0
+		state.tempTime = 0
+	}
+	elapsed := s.Timestamp.Sub(last.Timestamp)
+	sample := state.sample
+	sample.Timestamp = s.Timestamp
+	sample.Duration += elapsed
+	sample.Distance += s.Odometer - last.Odometer
+	// Trapezoidal integration of power (kW) over time.
+	sample.EnergyUsed += (last.Power + s.Power) / 2 * elapsed.Hours()
+	if s.Climate != nil {
+		state.tempSum += s.Climate.OutsideTemp * elapsed.Seconds()
+		state.tempTime += elapsed
+	}
+
+	if IsParked(s.DrivingState) || sample.Duration >= efficiencySampleInterval {
+		return state.finish()
+	}
+	return nil
+}
+
+// finish completes the ongoing sample, if any. Samples where the car didn't move are discarded.
+func (state *efficiencyState) finish() *EfficiencySample {
+	sample := state.sample
+	state.sample = nil
+	if sample == nil || sample.Distance <= 0 {
+		return nil
+	}
+	if state.tempTime > 0 {
+		temp := state.tempSum / state.tempTime.Seconds()
+		sample.OutsideTemp = &temp
+	}
+	return sample
+}
+
+// EfficiencyBucket sums up the driving that falls in one group of an efficiency breakdown.
+type EfficiencyBucket struct {
+	Label      string
+	Distance   float64 // Miles.
+	EnergyUsed float64 // kWh.
+	WhPerMile  float64
+	WhPerKm    float64
+}
+
+func (b *EfficiencyBucket) add(distance float64, energyUsed float64) {
+	b.Distance += distance
+	b.EnergyUsed += energyUsed
+	b.WhPerMile = WhPerMile(b.EnergyUsed, b.Distance)
+	b.WhPerKm = b.WhPerMile / kmPerMile
+}
+
+// TripEfficiency is the efficiency of a single trip.
+type TripEfficiency struct {
+	StartTime time.Time
+	EndTime   time.Time
+	Distance  float64 // Miles.
+	// EnergyUsed is estimated from the rated range lost, and IntegratedEnergy from the reported power, in kWh. See
+	// Trip.
+	EnergyUsed       float64
+	IntegratedEnergy float64
+	WhPerMile        float64
+	WhPerKm          float64
+	// RangeUsed is the rated range lost during the trip, in miles. Comparing it with Distance shows how the car
+	// fared against its rated consumption.
+	RangeUsed float64
+}
+
+// EfficiencyReport summarizes the efficiency of a car over a period.
+type EfficiencyReport struct {
+	Vin   string
+	From  time.Time
+	To    time.Time
+	Trips []TripEfficiency
+	// Overall is the efficiency over all trips in the period.
+	Overall EfficiencyBucket
+	// Daily, BySpeedBand and ByOutsideTemp break down the efficiency samples of the period.
+	Daily         []EfficiencyBucket
+	BySpeedBand   []EfficiencyBucket
+	ByOutsideTemp []EfficiencyBucket
+}
+
+// speedBands are the upper bounds (exclusive) of the speed bands, in miles per hour. The last band is unbounded.
+var speedBands = []float64{25, 45, 65, 75}
+
+// outsideTempBucketSize is the width of the outside temperature buckets, in Celsius.
+const outsideTempBucketSize = 10
+
+// NewEfficiencyReport builds the efficiency report of a car from its trips and efficiency samples over a period.
+// Days are bucketed in the given location.
+func NewEfficiencyReport(vin string, from time.Time, to time.Time, trips []Trip, samples []EfficiencySample,
+	loc *time.Location) EfficiencyReport {
+	report := EfficiencyReport{
+		Vin:     vin,
+		From:    from,
+		To:      to,
+		Trips:   []TripEfficiency{},
+		Overall: EfficiencyBucket{Label: "Overall"},
+	}
+	for _, t := range trips {
+		report.Trips = append(report.Trips, TripEfficiency{
+			StartTime:        t.StartTime,
+			EndTime:          t.EndTime,
+			Distance:         t.Distance(),
+			EnergyUsed:       t.EnergyUsed,
+			IntegratedEnergy: t.IntegratedEnergy,
+			WhPerMile:        t.WhPerMile(),
+			WhPerKm:          t.WhPerKm(),
+			RangeUsed:        t.RangeUsed(),
+		})
+		report.Overall.add(t.Distance(), t.EnergyUsed)
+	}
+
+	daily := newBucketGroup()
+	speed := newBucketGroup()
+	temp := newBucketGroup()
+	for _, s := range samples {
+		daily.add(s.Timestamp.In(loc).Format("2006-01-02"), s.Timestamp.Unix(), s)
+		band, order := speedBand(s.AverageSpeed())
+		speed.add(band, order, s)
+		bucket, order := outsideTempBucket(s.OutsideTemp)
+		temp.add(bucket, order, s)
+	}
+	report.Daily = daily.sorted()
+	report.BySpeedBand = speed.sorted()
+	report.ByOutsideTemp = temp.sorted()
+	return report
+}
+
+// speedBand returns the label of the speed band of the given speed, and its position among the bands.
+func speedBand(mph float64) (string, int64) {
+	lower := 0.0
+	for i, upper := range speedBands {
+		if mph < upper {
+			return fmt.Sprintf("%.0f-%.0f mph", lower, upper), int64(i)
+		}
+		lower = upper
+	}
+	return fmt.Sprintf("%.0f+ mph", lower), int64(len(speedBands))
+}
+
+// outsideTempBucket returns the label of the temperature bucket of the given temperature, and its position among the
+// buckets.
+func outsideTempBucket(celsius *float64) (string, int64) {
+	if celsius == nil {
+		return "Unknown", math.MaxInt64
+	}
+	lower := int64(math.Floor(*celsius/outsideTempBucketSize)) * outsideTempBucketSize
+	return fmt.Sprintf("%d to %d°C", lower, lower+outsideTempBucketSize), lower
+}
+
+// bucketGroup accumulates efficiency samples into labeled buckets.
+type bucketGroup struct {
+	buckets map[string]*EfficiencyBucket
+	order   map[string]int64
+}
+
+func newBucketGroup() *bucketGroup {
+	return &bucketGroup{
+		buckets: make(map[string]*EfficiencyBucket),
+		order:   make(map[string]int64),
+	}
+}
+
+func (g *bucketGroup) add(label string, order int64, s EfficiencySample) {
+	b, ok := g.buckets[label]
+	if !ok {
+		b = &EfficiencyBucket{Label: label}
+		g.buckets[label] = b
+		g.order[label] = order
+	}
+	b.add(s.Distance, s.EnergyUsed)
+}
+
+// sorted returns the buckets in ascending order.
+func (g *bucketGroup) sorted() []EfficiencyBucket {
+	buckets := make([]EfficiencyBucket, 0, len(g.buckets))
+	for _, b := range g.buckets {
+		buckets = append(buckets, *b)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return g.order[buckets[i].Label] < g.order[buckets[j].Label]
+	})
+	return buckets
+}
@@ -0,0 +1,60 @@
+package car
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OnSnapshotFunc is called with every snapshot after it's recorded.
+type OnSnapshotFunc func(s *Snapshot)
+
+// Event is a notable change detected in the snapshots of a car.
+type Event struct {
+	Timestamp time.Time
+	Vin       string
+	CarName   string
+	Kind      string
+	Message   string
+}
+
+// OnEventFunc is called with every detected Event.
+type OnEventFunc func(e Event)
+
+const SoftwareVersionChangedEvent = "software_version_changed"
+
+// PreviousSnapshotFunc returns the last known snapshot of a car, or nil if there is none. It's used to seed trackers
+// after a restart.
+type PreviousSnapshotFunc func(vin string) *Snapshot
+
+// NewSoftwareVersionTracker returns a snapshot listener that emits a SoftwareVersionChangedEvent whenever a car
+// reports a different software version than in its previous snapshot. It's safe for concurrent use.
+func NewSoftwareVersionTracker(previous PreviousSnapshotFunc, onEvent OnEventFunc) OnSnapshotFunc {
+	var mu sync.Mutex
+	vinToVersion := make(map[string]string)
+	return func(s *Snapshot) {
+		if s.Software == nil || s.Software.Version == "" {
+			return
+		}
+		mu.Lock()
+		prevVersion, ok := vinToVersion[s.Vin]
+		if !ok {
+			if prev := previous(s.Vin); prev != nil && prev.Software != nil {
+				prevVersion = prev.Software.Version
+			}
+		}
+		vinToVersion[s.Vin] = s.Software.Version
+		mu.Unlock()
+
+		if prevVersion == "" || prevVersion == s.Software.Version {
+			return
+		}
+		onEvent(Event{
+			Timestamp: s.Timestamp,
+			Vin:       s.Vin,
+			CarName:   s.Name,
+			Kind:      SoftwareVersionChangedEvent,
+			Message:   fmt.Sprintf("Software updated from %s to %s.", prevVersion, s.Software.Version),
+		})
+	}
+}
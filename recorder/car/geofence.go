@@ -0,0 +1,158 @@
+package car
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/kodek/tesler/common"
+	"github.com/pkg/errors"
+)
+
+const (
+	GeofenceEnteredEvent = "geofence_entered"
+	GeofenceExitedEvent  = "geofence_exited"
+)
+
+const earthRadiusMeters = 6371000
+
+// Geofence is a named place, either a circle or a polygon.
+type Geofence struct {
+	Name         string
+	Center       Location
+	RadiusMeters float64
+	Polygon      []Location
+}
+
+// Contains returns whether the given location falls inside the geofence.
+func (g *Geofence) Contains(loc Location) bool {
+	if len(g.Polygon) > 0 {
+		return polygonContains(g.Polygon, loc)
+	}
+	return distanceMeters(g.Center, loc) <= g.RadiusMeters
+}
+
+// Geofences is a list of places, matched in order.
+type Geofences []Geofence
+
+// Place returns the name of the first geofence containing the given location, or "" if there is none. The API
+// reports (0, 0) when the location is unknown, which never matches.
+func (gs Geofences) Place(loc Location) string {
+	if loc.Latitude == 0 && loc.Longitude == 0 {
+		return ""
+	}
+	for i := range gs {
+		if gs[i].Contains(loc) {
+			return gs[i].Name
+		}
+	}
+	return ""
+}
+
+// NewGeofencesFromConfig validates the configured geofences.
+func NewGeofencesFromConfig(conf common.Configuration) (Geofences, error) {
+	var geofences Geofences
+	names := make(map[string]bool)
+	for i, gc := range conf.Recorder.Geofences {
+		if gc.Name == "" {
+			return nil, errors.Errorf("geofence %d has no name", i)
+		}
+		if names[gc.Name] {
+			return nil, errors.Errorf("duplicate geofence name %q", gc.Name)
+		}
+		names[gc.Name] = true
+
+		g := Geofence{
+			Name:         gc.Name,
+			Center:       Location{gc.Latitude, gc.Longitude},
+			RadiusMeters: gc.RadiusMeters,
+		}
+		for _, vertex := range gc.Polygon {
+			g.Polygon = append(g.Polygon, Location{vertex.Latitude, vertex.Longitude})
+		}
+		if len(g.Polygon) == 0 && g.RadiusMeters <= 0 {
+			return nil, errors.Errorf("geofence %q needs either a positive RadiusMeters or a Polygon", gc.Name)
+		}
+		if len(g.Polygon) > 0 && len(g.Polygon) < 3 {
+			return nil, errors.Errorf("polygon of geofence %q needs at least 3 vertices", gc.Name)
+		}
+		geofences = append(geofences, g)
+	}
+	return geofences, nil
+}
+
+// distanceMeters returns the great-circle distance between two locations.
+func distanceMeters(a Location, b Location) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLong := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
+
+// polygonContains tests whether a location is inside a polygon by casting a ray east from it and counting the edges
+// it crosses. Latitude and longitude are treated as planar coordinates, which is accurate enough for places that
+// don't span the antimeridian.
+func polygonContains(polygon []Location, loc Location) bool {
+	inside := false
+	j := len(polygon) - 1
+	for i := range polygon {
+		a, b := polygon[i], polygon[j]
+		if (a.Latitude > loc.Latitude) != (b.Latitude > loc.Latitude) {
+			crossing := a.Longitude + (loc.Latitude-a.Latitude)/(b.Latitude-a.Latitude)*(b.Longitude-a.Longitude)
+			if loc.Longitude < crossing {
+				inside = !inside
+			}
+		}
+		j = i
+	}
+	return inside
+}
+
+// NewGeofenceTracker returns a snapshot listener that emits a GeofenceExitedEvent and a GeofenceEnteredEvent whenever
+// the place of a car changes between snapshots. Snapshots without a location are ignored. It's safe for concurrent
+// use.
+func NewGeofenceTracker(previous PreviousSnapshotFunc, onEvent OnEventFunc) OnSnapshotFunc {
+	var mu sync.Mutex
+	vinToPlace := make(map[string]string)
+	return func(s *Snapshot) {
+		if s.Bearings.Latitude == 0 && s.Bearings.Longitude == 0 {
+			return
+		}
+		mu.Lock()
+		prevPlace, known := vinToPlace[s.Vin]
+		if !known {
+			// A snapshot without a location has no place, but that doesn't mean the car was away.
+			if prev := previous(s.Vin); prev != nil && (prev.Bearings.Latitude != 0 || prev.Bearings.Longitude != 0) {
+				prevPlace = prev.Place
+				known = true
+			}
+		}
+		vinToPlace[s.Vin] = s.Place
+		mu.Unlock()
+
+		// Without history, we can't tell whether the car just arrived.
+		if !known || prevPlace == s.Place {
+			return
+		}
+		if prevPlace != "" {
+			onEvent(Event{
+				Timestamp: s.Timestamp,
+				Vin:       s.Vin,
+				CarName:   s.Name,
+				Kind:      GeofenceExitedEvent,
+				Message:   fmt.Sprintf("Left %s.", prevPlace),
+			})
+		}
+		if s.Place != "" {
+			onEvent(Event{
+				Timestamp: s.Timestamp,
+				Vin:       s.Vin,
+				CarName:   s.Name,
+				Kind:      GeofenceEnteredEvent,
+				Message:   fmt.Sprintf("Arrived at %s.", s.Place),
+			})
+		}
+	}
+}
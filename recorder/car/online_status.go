@@ -1,7 +1,10 @@
 package car
 
 import (
+	"context"
 	"flag"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -10,70 +13,231 @@ import (
 
 var pollInterval = flag.Duration("polling_interval", 10*time.Second, "How often to check for car changes.")
 
-type OnVehicleChangeFunc func(v *tesla.Vehicle)
+// eventQueueSize is how many events of a car can wait for slow listeners before polling blocks.
+const eventQueueSize = 16
+
+// Reasons for a VehicleEvent.
+const (
+	// VehicleFirstSeen is reported the first time the StateMonitor sees a car.
+	VehicleFirstSeen = "first_seen"
+	// VehicleStateChanged is reported when a car goes online, asleep, offline, etc.
+	VehicleStateChanged = "state_changed"
+	// VehicleDetailsChanged is reported when the state is unchanged, but other fields in the vehicle list are not. Only
+	// reported if the StateMonitor watches details.
+	VehicleDetailsChanged = "details_changed"
+)
+
+// VehicleEvent is a change in the vehicle list reported by the StateMonitor.
+type VehicleEvent struct {
+	Timestamp time.Time
+	Vin       string
+	// Vehicle is the car as of this event.
+	Vehicle *tesla.Vehicle
+	// InService is true while the car is at a service center.
+	InService bool
+	// PreviousState is the state before this event, or "" if the car wasn't seen before.
+	PreviousState string
+	NewState      string
+	// Reason is one of VehicleFirstSeen, VehicleStateChanged or VehicleDetailsChanged.
+	Reason string
+	// Changes describes what changed besides the state, e.g. "display name changed from X to Y". Only filled in if
+	// the StateMonitor watches details.
+	Changes []string
+}
+
+// StateChanged returns true if the car's state is different than before, including when it's seen for the first time.
+func (e VehicleEvent) StateChanged() bool {
+	return e.Reason != VehicleDetailsChanged
+}
+
+// Transition describes the change of state, e.g. "asleep → online".
+func (e VehicleEvent) Transition() string {
+	if e.PreviousState == "" {
+		return e.NewState
+	}
+	return fmt.Sprintf("%s → %s", e.PreviousState, e.NewState)
+}
+
+type OnVehicleChangeFunc func(e VehicleEvent)
+
+// VehicleStateFunc returns the last known state of a car ("online", "asleep", ...), or "" if it's unknown.
+type VehicleStateFunc func(vin string) string
 
 type StateMonitor struct {
 	tc              *tesla.Client
+	watchDetails    bool
 	changeStatusFns []OnVehicleChangeFunc
-	vinToStatus     map[string]*tesla.Vehicle
+	// queues holds the events of each car until the listeners get them. Only used by the polling goroutine.
+	queues map[string]chan VehicleEvent
+	// listeners tracks the goroutines that deliver the queued events.
+	listeners sync.WaitGroup
+
+	mu          sync.Mutex
+	vinToStatus map[string]Vehicle
 }
 
+// AddVehicleChangeListener registers a function called with every VehicleEvent. Listeners must be added before
+// polling starts. The events of a car are delivered in order, one at a time.
 func (p *StateMonitor) AddVehicleChangeListener(listenerFn OnVehicleChangeFunc) {
 	p.changeStatusFns = append(p.changeStatusFns, listenerFn)
 }
 
-func NewPollingStateMonitor(tc *tesla.Client) (*StateMonitor, error) {
+// NewPollingStateMonitor returns a StateMonitor that lists the vehicles of tc. If watchDetails is set, it also
+// reports changes to the display name, service status and option codes of a car, not only to its state.
+func NewPollingStateMonitor(tc *tesla.Client, watchDetails bool) (*StateMonitor, error) {
 	p := &StateMonitor{
 		tc:              tc,
-		vinToStatus:     make(map[string]*tesla.Vehicle),
+		watchDetails:    watchDetails,
+		queues:          make(map[string]chan VehicleEvent),
+		vinToStatus:     make(map[string]Vehicle),
 		changeStatusFns: make([]OnVehicleChangeFunc, 0),
 	}
 	return p, nil
 }
 
-func (p *StateMonitor) Poll() {
-	p.pollOnce()
+// State returns the state of a car as of the last poll, without calling the API. It can be used as a
+// VehicleStateFunc.
+func (p *StateMonitor) State(vin string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	v, ok := p.vinToStatus[vin]
+	if !ok {
+		return ""
+	}
+	return vehicleState(v.Vehicle)
+}
+
+// Poll checks the vehicle list for changes until ctx is done. Before returning, it waits for the listeners to get
+// the queued events.
+func (p *StateMonitor) Poll(ctx context.Context) {
+	defer p.stopListeners()
+	p.pollOnce(ctx)
 
 	ticker := time.NewTicker(*pollInterval)
-	for range ticker.C {
-		p.pollOnce()
+	defer ticker.Stop()
+	for {
 		glog.Info("Waiting for next state monitor polling cycle.")
+		select {
+		case <-ctx.Done():
+			glog.Info("Stopped polling the vehicle list.")
+			return
+		case <-ticker.C:
+			p.pollOnce(ctx)
+		}
 	}
 }
 
-func (p *StateMonitor) pollOnce() {
+func (p *StateMonitor) pollOnce(ctx context.Context) {
 	glog.Info("Fetching wake status of all vehicles...")
-	vehicles, err := p.tc.Vehicles()
+	vehicles, err := FetchVehicles(ctx, p.tc)
+	if ctx.Err() != nil {
+		return
+	}
 	if err != nil {
 		glog.Error("Error while fetching vehicles status.", err)
 		return
 	}
 
+	now := time.Now()
 	for _, v := range vehicles {
 		glog.Info("Found vehicle status for vin ", v.Vin)
-		prev, _ := p.vinToStatus[v.Vin]
+		p.mu.Lock()
+		prev, seen := p.vinToStatus[v.Vin]
 		// update cache
-		p.vinToStatus[v.Vin] = v.Vehicle
+		p.vinToStatus[v.Vin] = v
+		p.mu.Unlock()
 
-		if !statusHasChanged(prev, v.Vehicle) {
-			glog.Infof("Nothing to report for vehicle VIN %s. State is still %s", v.Vin, *v.State)
-			continue
+		var prevPtr *Vehicle
+		if seen {
+			prevPtr = &prev
 		}
-		for _, listenerFn := range p.changeStatusFns {
-			go listenerFn(v.Vehicle)
+		event, changed := p.compare(now, prevPtr, v)
+		if !changed {
+			glog.Infof("Nothing to report for vehicle VIN %s. State is still %s", v.Vin, event.NewState)
+			continue
 		}
+		p.dispatch(event)
+	}
+}
+
+// dispatch queues an event for the listeners. The first event of a car starts the goroutine that delivers them.
+func (p *StateMonitor) dispatch(e VehicleEvent) {
+	queue, ok := p.queues[e.Vin]
+	if !ok {
+		queue = make(chan VehicleEvent, eventQueueSize)
+		p.queues[e.Vin] = queue
+		p.listeners.Add(1)
+		go func() {
+			defer p.listeners.Done()
+			for e := range queue {
+				for _, listenerFn := range p.changeStatusFns {
+					listenerFn(e)
+				}
+			}
+		}()
+	}
+	queue <- e
+}
+
+// stopListeners waits for the listeners to get the queued events. No events may be dispatched afterwards.
+func (p *StateMonitor) stopListeners() {
+	for _, queue := range p.queues {
+		close(queue)
 	}
+	p.listeners.Wait()
 }
 
-func statusHasChanged(prev *tesla.Vehicle, new *tesla.Vehicle) bool {
+// compare returns the event describing the change from prev (nil if the car wasn't seen before) to v, and whether
+// it should be reported.
+func (p *StateMonitor) compare(now time.Time, prev *Vehicle, v Vehicle) (VehicleEvent, bool) {
+	event := VehicleEvent{
+		Timestamp: now,
+		Vin:       v.Vin,
+		Vehicle:   v.Vehicle,
+		InService: v.InService,
+		NewState:  vehicleState(v.Vehicle),
+	}
 	if prev == nil {
-		// Report the first fetch as a change.
-		return true
+		event.Reason = VehicleFirstSeen
+		return event, true
+	}
+	event.PreviousState = vehicleState(prev.Vehicle)
+	if p.watchDetails {
+		event.Changes = detailChanges(*prev, v)
+	}
+	if event.PreviousState != event.NewState {
+		event.Reason = VehicleStateChanged
+		return event, true
 	}
-	if new == nil {
-		panic("new update should not be nil!")
+	if len(event.Changes) > 0 {
+		event.Reason = VehicleDetailsChanged
+		return event, true
+	}
+	return event, false
+}
+
+// detailChanges describes the changes to the fields of the vehicle list other than the state.
+func detailChanges(prev Vehicle, v Vehicle) []string {
+	var changes []string
+	if prev.DisplayName != v.DisplayName {
+		changes = append(changes, fmt.Sprintf("display name changed from %q to %q", prev.DisplayName, v.DisplayName))
+	}
+	if prev.InService != v.InService {
+		if v.InService {
+			changes = append(changes, "car is in service")
+		} else {
+			changes = append(changes, "car is back from service")
+		}
+	}
+	if prev.OptionCodes != v.OptionCodes {
+		changes = append(changes, fmt.Sprintf("option codes changed from %s to %s", prev.OptionCodes, v.OptionCodes))
+	}
+	return changes
+}
+
+func vehicleState(v *tesla.Vehicle) string {
+	if v == nil || v.State == nil {
+		return ""
 	}
-	prevState := *prev.State
-	newState := *new.State
-	return prevState != newState
+	return *v.State
 }
@@ -0,0 +1,73 @@
+package car
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatchDeliversEventsOfEachCarInOrder(t *testing.T) {
+	p, err := NewPollingStateMonitor(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	received := make(map[string][]int)
+	inFlight := make(map[string]bool)
+	concurrentVins := 0
+	for i := 0; i < 2; i++ {
+		listener := i
+		p.AddVehicleChangeListener(func(e VehicleEvent) {
+			mu.Lock()
+			if listener == 0 {
+				if inFlight[e.Vin] {
+					t.Errorf("events of VIN %s delivered concurrently", e.Vin)
+				}
+				inFlight[e.Vin] = true
+				if len(inFlight) > 1 {
+					concurrentVins++
+				}
+			}
+			mu.Unlock()
+
+			// Slow listeners make out of order delivery likely, if it can happen.
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if listener == 0 {
+				delete(inFlight, e.Vin)
+				return
+			}
+			var seq int
+			fmt.Sscanf(e.NewState, "state%d", &seq)
+			received[e.Vin] = append(received[e.Vin], seq)
+		})
+	}
+
+	const events = 50
+	vins := []string{"VIN1", "VIN2", "VIN3"}
+	for seq := 0; seq < events; seq++ {
+		for _, vin := range vins {
+			p.dispatch(VehicleEvent{Vin: vin, NewState: fmt.Sprintf("state%d", seq)})
+		}
+	}
+	p.stopListeners()
+
+	for _, vin := range vins {
+		got := received[vin]
+		if len(got) != events {
+			t.Fatalf("VIN %s got %d events, want %d", vin, len(got), events)
+		}
+		for i, seq := range got {
+			if seq != i {
+				t.Fatalf("VIN %s got events out of order: %v", vin, got)
+			}
+		}
+	}
+	if concurrentVins == 0 {
+		t.Error("events of different cars were never delivered concurrently")
+	}
+}
@@ -0,0 +1,302 @@
+package car
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kodek/tesler/common"
+	"github.com/pkg/errors"
+)
+
+// PollingDecision is what the polling policy decided for a snapshot.
+type PollingDecision struct {
+	Description  string
+	PollInterval time.Duration
+	// Sleep is true if the car is idle and should be left alone so that it can fall asleep.
+	Sleep bool
+}
+
+// idleDecision applies when no rule matches.
+var idleDecision = PollingDecision{
+	Description: "Idle",
+	Sleep:       true,
+}
+
+// DefaultPollingRules are used when the config has no polling rules.
+var DefaultPollingRules = []common.PollingRuleConfig{
+	{
+		Description:         "Moving",
+		When:                []common.PollingCondition{{Field: "speed", Op: ">", Value: 0.0}},
+		PollIntervalSeconds: 1,
+	},
+	{
+		Description: "In gear",
+		When: []common.PollingCondition{
+			{Field: "shift_state", Op: "in", Value: []interface{}{"R", "D", "N"}},
+		},
+		PollIntervalSeconds: 2,
+	},
+	{
+		Description: "Charging",
+		When: []common.PollingCondition{
+			{Field: "charging_state", Op: "in", Value: []interface{}{"Charging", "Starting"}},
+		},
+		PollIntervalSeconds: 3,
+	},
+	{
+		Description:         "Sentry mode",
+		When:                []common.PollingCondition{{Field: "sentry_mode", Op: "==", Value: true}},
+		PollIntervalSeconds: 30,
+	},
+	{
+		Description:         "Display on",
+		When:                []common.PollingCondition{{Field: "center_display_state", Op: "!=", Value: 0.0}},
+		PollIntervalSeconds: 10,
+	},
+	{
+		Description:         "Climate on",
+		When:                []common.PollingCondition{{Field: "is_climate_on", Op: "==", Value: true}},
+		PollIntervalSeconds: 30,
+	},
+}
+
+type fieldKind int
+
+const (
+	numberField fieldKind = iota
+	boolField
+	stringField
+)
+
+func (k fieldKind) String() string {
+	switch k {
+	case numberField:
+		return "number"
+	case boolField:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+// pollingField is a snapshot field that polling conditions can refer to.
+type pollingField struct {
+	kind fieldKind
+	get  func(s *Snapshot) interface{}
+}
+
+var pollingFields = map[string]pollingField{
+	"speed":          {numberField, func(s *Snapshot) interface{} { return s.Bearings.Speed }},
+	"power":          {numberField, func(s *Snapshot) interface{} { return s.Power }},
+	"shift_state":    {stringField, func(s *Snapshot) interface{} { return s.DrivingState }},
+	"charging_state": {stringField, func(s *Snapshot) interface{} { return s.ChargingState }},
+	"battery_level":  {numberField, func(s *Snapshot) interface{} { return float64(s.BatteryLevel) }},
+	"plugged_in":     {boolField, func(s *Snapshot) interface{} { return s.ChargeSession != nil }},
+	"charger_power": {numberField, func(s *Snapshot) interface{} {
+		if s.ChargeSession == nil {
+			return 0.0
+		}
+		return s.ChargeSession.ChargerPower
+	}},
+	"center_display_state": {numberField, func(s *Snapshot) interface{} { return float64(s.CenterDisplayState) }},
+	"place":                {stringField, func(s *Snapshot) interface{} { return s.Place }},
+	"sentry_mode": {boolField, func(s *Snapshot) interface{} {
+		return s.Security != nil && s.Security.SentryMode
+	}},
+	"locked": {boolField, func(s *Snapshot) interface{} {
+		return s.Security != nil && s.Security.Locked
+	}},
+	"is_user_present": {boolField, func(s *Snapshot) interface{} {
+		return s.Security != nil && s.Security.IsUserPresent
+	}},
+	"is_climate_on": {boolField, func(s *Snapshot) interface{} {
+		return s.Climate != nil && s.Climate.IsClimateOn
+	}},
+	"is_preconditioning": {boolField, func(s *Snapshot) interface{} {
+		return s.Climate != nil && s.Climate.IsPreconditioning
+	}},
+}
+
+// condition is a validated PollingCondition.
+type condition struct {
+	field  pollingField
+	op     string
+	values []interface{} // A single value unless op is "in".
+}
+
+func (c *condition) matches(s *Snapshot) bool {
+	v := c.field.get(s)
+	switch c.op {
+	case "==", "in":
+		for _, want := range c.values {
+			if v == want {
+				return true
+			}
+		}
+		return false
+	case "!=":
+		return v != c.values[0]
+	}
+	a, b := v.(float64), c.values[0].(float64)
+	switch c.op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	default:
+		return a >= b
+	}
+}
+
+type pollingRule struct {
+	decision   PollingDecision
+	conditions []condition
+}
+
+// PollingPolicy decides how often to poll a car from its latest snapshot.
+type PollingPolicy struct {
+	rules []pollingRule
+}
+
+// NewPollingPolicyFromConfig validates the configured polling rules, or uses DefaultPollingRules if there are none.
+func NewPollingPolicyFromConfig(conf common.Configuration) (*PollingPolicy, error) {
+	ruleConfs := conf.Recorder.Polling.Rules
+	if len(ruleConfs) == 0 {
+		ruleConfs = DefaultPollingRules
+	}
+	return NewPollingPolicy(ruleConfs)
+}
+
+// NewPollingPolicy validates the given polling rules.
+func NewPollingPolicy(ruleConfs []common.PollingRuleConfig) (*PollingPolicy, error) {
+	p := &PollingPolicy{}
+	for i, rc := range ruleConfs {
+		rule, err := newPollingRule(rc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid polling rule %d (%q)", i, rc.Description)
+		}
+		p.rules = append(p.rules, rule)
+	}
+	return p, nil
+}
+
+func newPollingRule(rc common.PollingRuleConfig) (pollingRule, error) {
+	rule := pollingRule{
+		decision: PollingDecision{
+			Description:  rc.Description,
+			PollInterval: time.Duration(rc.PollIntervalSeconds * float64(time.Second)),
+			Sleep:        rc.Sleep,
+		},
+	}
+	if rc.Description == "" {
+		return rule, errors.New("missing description")
+	}
+	if !rc.Sleep && rule.decision.PollInterval <= 0 {
+		return rule, errors.New("PollIntervalSeconds must be positive unless Sleep is set")
+	}
+	for _, cc := range rc.When {
+		c, err := newCondition(cc)
+		if err != nil {
+			return rule, err
+		}
+		rule.conditions = append(rule.conditions, c)
+	}
+	return rule, nil
+}
+
+func newCondition(cc common.PollingCondition) (condition, error) {
+	field, ok := pollingFields[cc.Field]
+	if !ok {
+		return condition{}, errors.Errorf("unknown field %q, expected one of %s", cc.Field, pollingFieldNames())
+	}
+	c := condition{
+		field: field,
+		op:    cc.Op,
+	}
+	switch cc.Op {
+	case "==", "!=":
+		c.values = []interface{}{cc.Value}
+	case "<", "<=", ">", ">=":
+		if field.kind != numberField {
+			return c, errors.Errorf("operator %s needs a number field, but %s is a %s", cc.Op, cc.Field, field.kind)
+		}
+		c.values = []interface{}{cc.Value}
+	case "in":
+		values, ok := cc.Value.([]interface{})
+		if !ok || len(values) == 0 {
+			return c, errors.Errorf("operator in needs a non-empty list of values for field %s", cc.Field)
+		}
+		c.values = append([]interface{}(nil), values...)
+	default:
+		return c, errors.Errorf("unknown operator %q for field %s", cc.Op, cc.Field)
+	}
+	for i, v := range c.values {
+		normalized, err := normalizeValue(field.kind, v)
+		if err != nil {
+			return c, errors.Wrapf(err, "field %s", cc.Field)
+		}
+		c.values[i] = normalized
+	}
+	return c, nil
+}
+
+// normalizeValue checks that a value decoded from JSON has the type of the field, and converts numbers to float64.
+func normalizeValue(kind fieldKind, v interface{}) (interface{}, error) {
+	switch kind {
+	case numberField:
+		switch n := v.(type) {
+		case float64:
+			return n, nil
+		case int:
+			return float64(n), nil
+		}
+	case boolField:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case stringField:
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	}
+	return nil, errors.Errorf("value %v is not a %s", v, kind)
+}
+
+func pollingFieldNames() string {
+	names := make([]string, 0, len(pollingFields))
+	for name := range pollingFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Evaluate returns the decision of the first rule matching the snapshot. If none matches, the car is idle.
+func (p *PollingPolicy) Evaluate(s *Snapshot) PollingDecision {
+	for _, rule := range p.rules {
+		if rule.matchesAll(s) {
+			return rule.decision
+		}
+	}
+	return idleDecision
+}
+
+func (r *pollingRule) matchesAll(s *Snapshot) bool {
+	for i := range r.conditions {
+		if !r.conditions[i].matches(s) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d PollingDecision) String() string {
+	if d.Sleep {
+		return fmt.Sprintf("%s (let it sleep)", d.Description)
+	}
+	return fmt.Sprintf("%s (poll every %s)", d.Description, d.PollInterval)
+}
@@ -0,0 +1,138 @@
+package car
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kodek/tesler/common"
+)
+
+func TestNewPollingPolicyValidatesRules(t *testing.T) {
+	rule := func(conditions ...common.PollingCondition) common.PollingRuleConfig {
+		return common.PollingRuleConfig{Description: "Rule", When: conditions, PollIntervalSeconds: 1}
+	}
+	tests := []struct {
+		name    string
+		rule    common.PollingRuleConfig
+		wantErr string // Empty if the rule is valid.
+	}{
+		{"number", rule(common.PollingCondition{Field: "speed", Op: ">=", Value: 10.0}), ""},
+		{"int number", rule(common.PollingCondition{Field: "battery_level", Op: "<", Value: 20}), ""},
+		{"bool", rule(common.PollingCondition{Field: "sentry_mode", Op: "!=", Value: false}), ""},
+		{"string list", rule(common.PollingCondition{Field: "shift_state", Op: "in",
+			Value: []interface{}{"D", "R"}}), ""},
+		{"sleep without interval", common.PollingRuleConfig{Description: "Rule", Sleep: true}, ""},
+		{"unknown field", rule(common.PollingCondition{Field: "altitude", Op: ">", Value: 0.0}), "unknown field"},
+		{"unknown operator", rule(common.PollingCondition{Field: "speed", Op: "=~", Value: 0.0}),
+			"unknown operator"},
+		{"ordering a string", rule(common.PollingCondition{Field: "place", Op: ">", Value: "Home"}),
+			"needs a number field"},
+		{"ordering a bool", rule(common.PollingCondition{Field: "locked", Op: "<=", Value: true}),
+			"needs a number field"},
+		{"string for a number", rule(common.PollingCondition{Field: "speed", Op: "==", Value: "fast"}),
+			"is not a number"},
+		{"number for a bool", rule(common.PollingCondition{Field: "plugged_in", Op: "==", Value: 1.0}),
+			"is not a boolean"},
+		{"in without a list", rule(common.PollingCondition{Field: "shift_state", Op: "in", Value: "D"}),
+			"non-empty list"},
+		{"in with an empty list", rule(common.PollingCondition{Field: "shift_state", Op: "in",
+			Value: []interface{}{}}), "non-empty list"},
+		{"in with a wrong type", rule(common.PollingCondition{Field: "shift_state", Op: "in",
+			Value: []interface{}{"D", 1.0}}), "is not a string"},
+		{"missing description", common.PollingRuleConfig{PollIntervalSeconds: 1}, "missing description"},
+		{"missing interval", common.PollingRuleConfig{Description: "Rule"}, "must be positive"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewPollingPolicy([]common.PollingRuleConfig{test.rule})
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("NewPollingPolicy() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("NewPollingPolicy() = %v, want an error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestPollingPolicyEvaluate(t *testing.T) {
+	policy, err := NewPollingPolicy([]common.PollingRuleConfig{
+		{
+			Description:         "Fast",
+			When:                []common.PollingCondition{{Field: "speed", Op: ">", Value: 65.0}},
+			PollIntervalSeconds: 0.5,
+		},
+		{
+			Description:         "Moving",
+			When:                []common.PollingCondition{{Field: "speed", Op: ">", Value: 0.0}},
+			PollIntervalSeconds: 1,
+		},
+		{
+			Description: "Charging at home",
+			When: []common.PollingCondition{
+				{Field: "charging_state", Op: "in", Value: []interface{}{"Charging", "Starting"}},
+				{Field: "place", Op: "==", Value: "Home"},
+			},
+			PollIntervalSeconds: 60,
+		},
+		{
+			Description:         "Charging",
+			When:                []common.PollingCondition{{Field: "charging_state", Op: "==", Value: "Charging"}},
+			PollIntervalSeconds: 5,
+		},
+		{
+			Description: "Low battery",
+			When: []common.PollingCondition{
+				{Field: "battery_level", Op: "<=", Value: 10},
+				{Field: "plugged_in", Op: "!=", Value: true},
+			},
+			Sleep: true,
+		},
+		{
+			Description:         "Sentry mode",
+			When:                []common.PollingCondition{{Field: "sentry_mode", Op: "==", Value: true}},
+			PollIntervalSeconds: 30,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		snapshot Snapshot
+		want     PollingDecision
+	}{
+		{"first match wins", Snapshot{Bearings: Bearings{Speed: 70}},
+			PollingDecision{Description: "Fast", PollInterval: 500 * time.Millisecond}},
+		{"later rule", Snapshot{Bearings: Bearings{Speed: 30}},
+			PollingDecision{Description: "Moving", PollInterval: time.Second}},
+		{"all conditions hold", Snapshot{ChargingState: "Starting", Place: "Home"},
+			PollingDecision{Description: "Charging at home", PollInterval: time.Minute}},
+		{"one condition fails", Snapshot{ChargingState: "Charging", Place: "Work"},
+			PollingDecision{Description: "Charging", PollInterval: 5 * time.Second}},
+		{"sleep rule", Snapshot{BatteryLevel: 10, Security: &Security{SentryMode: true}},
+			PollingDecision{Description: "Low battery", Sleep: true}},
+		{"not equal", Snapshot{BatteryLevel: 10, ChargeSession: &ChargeSession{}, Security: &Security{SentryMode: true}},
+			PollingDecision{Description: "Sentry mode", PollInterval: 30 * time.Second}},
+		{"missing struct", Snapshot{BatteryLevel: 50}, idleDecision},
+		{"idle", Snapshot{BatteryLevel: 50, ChargingState: "Disconnected", Security: &Security{}}, idleDecision},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := policy.Evaluate(&test.snapshot); got != test.want {
+				t.Errorf("Evaluate() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDefaultPollingRulesAreValid(t *testing.T) {
+	if _, err := NewPollingPolicy(DefaultPollingRules); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -16,13 +16,27 @@ type Snapshot struct {
 	ActiveDescription string
 	DrivingState      string
 	Bearings          Bearings
+	Place             string // Name of the geofence the car is in, if any.
 	ChargingState     string
 	Power             float64
 	BatteryLevel      int
 	RangeLeft         float64
 	ChargeLimitSoc    int
-	ChargeSession     *ChargeSession
-	Odometer          float64
+	// Battery and charge port details, reported even while unplugged.
+	UsableBatteryLevel         int
+	IdealRange                 float64
+	EstimatedRange             float64
+	BatteryHeaterOn            bool
+	ChargePortDoorOpen         bool
+	ChargePortLatch            string
+	ScheduledChargingStartTime time.Time // Zero if no charge is scheduled.
+	ChargeSession              *ChargeSession
+	Odometer                   float64
+	CenterDisplayState         int // 0 when the center display is off.
+	Climate                    *Climate
+	Security                   *Security
+	Software                   *Software
+	Tires                      *Tires
 }
 
 type ChargeSession struct {
@@ -32,18 +46,116 @@ type ChargeSession struct {
 	TimeToFullCharge float64
 	ChargeMilesAdded float64
 	ChargeRate       float64
+	// ChargeEnergyAdded is the energy added during the current session, in kWh.
+	ChargeEnergyAdded  float64
+	ChargerPhases      int
+	ChargerPower       float64 // kW
+	FastChargerPresent bool
+	FastChargerType    string
+	FastChargerBrand   string
+}
+
+// Climate holds the cabin climate state. Temperatures are in Celsius, seat heater levels range from 0 (off) to 3.
+type Climate struct {
+	InsideTemp           float64
+	OutsideTemp          float64
+	DriverTempSetting    float64
+	PassengerTempSetting float64
+	FanStatus            int
+	SeatHeaterLeft       int
+	SeatHeaterRight      int
+	SeatHeaterRearLeft   int
+	SeatHeaterRearCenter int
+	SeatHeaterRearRight  int
+	IsClimateOn          bool
+	IsAutoConditioningOn bool
+	IsFrontDefrosterOn   bool
+	IsRearDefrosterOn    bool
+	IsPreconditioning    bool
+	SmartPreconditioning bool
+}
+
+// Security describes whether the car is locked and closed. Window positions are 0 when closed.
+type Security struct {
+	Locked                 bool
+	DriverFrontDoorOpen    bool
+	DriverRearDoorOpen     bool
+	PassengerFrontDoorOpen bool
+	PassengerRearDoorOpen  bool
+	FrunkOpen              bool
+	TrunkOpen              bool
+	DriverFrontWindow      int
+	DriverRearWindow       int
+	PassengerFrontWindow   int
+	PassengerRearWindow    int
+	SentryMode             bool
+	IsUserPresent          bool
+}
+
+// WindowOpen returns whether any window is not fully closed.
+func (s *Security) WindowOpen() bool {
+	return s.DriverFrontWindow != 0 || s.DriverRearWindow != 0 ||
+		s.PassengerFrontWindow != 0 || s.PassengerRearWindow != 0
+}
+
+// Software describes the installed firmware and any pending update.
+type Software struct {
+	Version string
+	// UpdateStatus is empty if no update is available. Otherwise, e.g. "available", "scheduled" or "installing".
+	UpdateStatus              string
+	UpdateVersion             string
+	UpdateExpectedDurationSec int
+}
+
+// maxGpsAge is how old the car's GPS fix may be for its timestamp to be used as the snapshot's timestamp.
+const maxGpsAge = 30 * time.Second
+
+// Tires holds the TPMS readings, in bar, and the car's own soft (low) and hard (critical) pressure warnings.
+type Tires struct {
+	FrontLeftPressure     float64
+	FrontRightPressure    float64
+	RearLeftPressure      float64
+	RearRightPressure     float64
+	FrontLeftSoftWarning  bool
+	FrontRightSoftWarning bool
+	RearLeftSoftWarning   bool
+	RearRightSoftWarning  bool
+	FrontLeftHardWarning  bool
+	FrontRightHardWarning bool
+	RearLeftHardWarning   bool
+	RearRightHardWarning  bool
+}
+
+// Pressures returns the pressure of each tire, keyed by position.
+func (t *Tires) Pressures() map[string]float64 {
+	return map[string]float64{
+		"front left":  t.FrontLeftPressure,
+		"front right": t.FrontRightPressure,
+		"rear left":   t.RearLeftPressure,
+		"rear right":  t.RearRightPressure,
+	}
 }
 
 type Bearings struct {
 	Latitude  float64
 	Longitude float64
 	Speed     float64
+	Heading   int       // Degrees, clockwise from north.
+	GpsAsOf   time.Time // When the car took the GPS fix. Zero if unknown.
+	// Native coordinates, in the datum given by NativeType (e.g. "wgs").
+	NativeLatitude  float64
+	NativeLongitude float64
+	NativeType      string
+	Elevation       *float64 // Meters. Nil if the car doesn't report it.
 }
 
-func NewSnapshot(vehicleData *tesla.VehicleData) *Snapshot {
+// NewSnapshot parses vehicle data fetched after the previous snapshot of the car, which was taken at lastTimestamp
+// (zero if there's none).
+func NewSnapshot(vehicleData *VehicleData, lastTimestamp time.Time) *Snapshot {
 	glog.Infof("Parsing message: %s", spew.Sprintf("%#v", vehicleData))
+	bearings := toBearings(vehicleData)
 	snapshot := Snapshot{
-		Timestamp:      time.Now(),
+		Timestamp:      sampleTime(bearings, time.Now(), lastTimestamp),
 		Name:           vehicleData.DisplayName,
 		Vin:            vehicleData.Vin,
 		WakeState:      vehicleData.State,
@@ -52,18 +164,131 @@ func NewSnapshot(vehicleData *tesla.VehicleData) *Snapshot {
 		BatteryLevel:   vehicleData.ChargeState.BatteryLevel,
 		RangeLeft:      vehicleData.ChargeState.BatteryRange,
 		ChargeLimitSoc: vehicleData.ChargeState.ChargeLimitSoc,
-		ChargeSession:  toChargeSession(vehicleData),
-		Odometer:       vehicleData.VehicleState.Odometer,
-		Bearings: Bearings{
-			Latitude:  vehicleData.DriveState.Latitude,
-			Longitude: vehicleData.DriveState.Longitude,
-			Speed:     vehicleData.DriveState.Speed,
-		},
-		DrivingState: vehicleData.DriveState.ShiftState,
+		// Battery and charge port details.
+		UsableBatteryLevel:         vehicleData.ChargeState.UsableBatteryLevel,
+		IdealRange:                 vehicleData.ChargeState.IdealBatteryRange,
+		EstimatedRange:             vehicleData.ChargeState.EstBatteryRange,
+		BatteryHeaterOn:            vehicleData.ChargeState.BatteryHeaterOn,
+		ChargePortDoorOpen:         vehicleData.ChargeState.ChargePortDoorOpen,
+		ChargePortLatch:            vehicleData.ChargeState.ChargePortLatch,
+		ScheduledChargingStartTime: unixTime(vehicleData.ChargeState.ScheduledChargingStartTime),
+		ChargeSession:              toChargeSession(vehicleData.VehicleData),
+		Odometer:                   vehicleData.VehicleState.Odometer,
+		CenterDisplayState:         vehicleData.VehicleState.CenterDisplayState,
+		Bearings:                   bearings,
+		DrivingState:               vehicleData.DriveState.ShiftState,
+		Climate:                    toClimate(vehicleData.VehicleData),
+		Security:                   toSecurity(vehicleData),
+		Software:                   toSoftware(vehicleData),
+		Tires:                      toTires(vehicleData),
 	}
 	return &snapshot
 }
 
+func toBearings(vehicleData *VehicleData) Bearings {
+	driveState := vehicleData.DriveState
+	bearings := Bearings{
+		Latitude:        driveState.Latitude,
+		Longitude:       driveState.Longitude,
+		Speed:           driveState.Speed,
+		Heading:         driveState.Heading,
+		NativeLatitude:  driveState.NativeLatitude,
+		NativeLongitude: driveState.NativeLongitude,
+		NativeType:      driveState.NativeType,
+		Elevation:       vehicleData.Extra.DriveState.Elevation,
+	}
+	if driveState.GpsAsOf > 0 {
+		bearings.GpsAsOf = time.Unix(int64(driveState.GpsAsOf), 0)
+	}
+	return bearings
+}
+
+// sampleTime prefers the car's own GPS timestamp over the fetch time. The GPS timestamp only has a resolution of one
+// second, and a fix can be reused for several fetches (e.g. while parked in a garage). Since snapshots are keyed by
+// timestamp, the fetch time is used unless the fix is recent and strictly newer than the previous snapshot of the car,
+// taken at lastTimestamp.
+func sampleTime(bearings Bearings, fetchTime time.Time, lastTimestamp time.Time) time.Time {
+	if bearings.GpsAsOf.IsZero() || fetchTime.Sub(bearings.GpsAsOf) > maxGpsAge ||
+		!bearings.GpsAsOf.After(lastTimestamp) {
+		return fetchTime
+	}
+	return bearings.GpsAsOf
+}
+
+func toClimate(parentResponse *tesla.VehicleData) *Climate {
+	climateState := parentResponse.ClimateState
+	return &Climate{
+		InsideTemp:           climateState.InsideTemp,
+		OutsideTemp:          climateState.OutsideTemp,
+		DriverTempSetting:    climateState.DriverTempSetting,
+		PassengerTempSetting: climateState.PassengerTempSetting,
+		FanStatus:            climateState.FanStatus,
+		SeatHeaterLeft:       climateState.SeatHeaterLeft,
+		SeatHeaterRight:      climateState.SeatHeaterRight,
+		SeatHeaterRearLeft:   climateState.SeatHeaterRearLeft,
+		SeatHeaterRearCenter: climateState.SeatHeaterRearCenter,
+		SeatHeaterRearRight:  climateState.SeatHeaterRearRight,
+		IsClimateOn:          climateState.IsClimateOn,
+		IsAutoConditioningOn: climateState.IsAutoConditioningOn,
+		IsFrontDefrosterOn:   climateState.IsFrontDefrosterOn,
+		IsRearDefrosterOn:    climateState.IsRearDefrosterOn,
+		IsPreconditioning:    climateState.IsPreconditioning,
+		SmartPreconditioning: climateState.SmartPreconditioning,
+	}
+}
+
+func toSecurity(vehicleData *VehicleData) *Security {
+	vehicleState := vehicleData.VehicleState
+	windows := vehicleData.Extra.VehicleState
+	return &Security{
+		Locked:                 vehicleState.Locked,
+		DriverFrontDoorOpen:    vehicleState.Df != 0,
+		DriverRearDoorOpen:     vehicleState.Dr != 0,
+		PassengerFrontDoorOpen: vehicleState.Pf != 0,
+		PassengerRearDoorOpen:  vehicleState.Pr != 0,
+		FrunkOpen:              vehicleState.Ft != 0,
+		TrunkOpen:              vehicleState.Rt != 0,
+		DriverFrontWindow:      windows.FdWindow,
+		DriverRearWindow:       windows.RdWindow,
+		PassengerFrontWindow:   windows.FpWindow,
+		PassengerRearWindow:    windows.RpWindow,
+		SentryMode:             vehicleState.SentryMode,
+		IsUserPresent:          vehicleState.IsUserPresent,
+	}
+}
+
+func toSoftware(vehicleData *VehicleData) *Software {
+	vehicleState := vehicleData.VehicleState
+	return &Software{
+		Version:                   vehicleState.CarVersion,
+		UpdateStatus:              vehicleState.SoftwareUpdate.Status,
+		UpdateVersion:             vehicleData.Extra.VehicleState.SoftwareUpdate.Version,
+		UpdateExpectedDurationSec: vehicleState.SoftwareUpdate.ExpectedDurationSec,
+	}
+}
+
+func toTires(vehicleData *VehicleData) *Tires {
+	vehicleState := vehicleData.Extra.VehicleState
+	if vehicleState.TpmsPressureFl == nil || vehicleState.TpmsPressureFr == nil ||
+		vehicleState.TpmsPressureRl == nil || vehicleState.TpmsPressureRr == nil {
+		return nil
+	}
+	return &Tires{
+		FrontLeftPressure:     *vehicleState.TpmsPressureFl,
+		FrontRightPressure:    *vehicleState.TpmsPressureFr,
+		RearLeftPressure:      *vehicleState.TpmsPressureRl,
+		RearRightPressure:     *vehicleState.TpmsPressureRr,
+		FrontLeftSoftWarning:  vehicleState.TpmsSoftWarningFl,
+		FrontRightSoftWarning: vehicleState.TpmsSoftWarningFr,
+		RearLeftSoftWarning:   vehicleState.TpmsSoftWarningRl,
+		RearRightSoftWarning:  vehicleState.TpmsSoftWarningRr,
+		FrontLeftHardWarning:  vehicleState.TpmsHardWarningFl,
+		FrontRightHardWarning: vehicleState.TpmsHardWarningFr,
+		RearLeftHardWarning:   vehicleState.TpmsHardWarningRl,
+		RearRightHardWarning:  vehicleState.TpmsHardWarningRr,
+	}
+}
+
 func toChargeSession(parentResponse *tesla.VehicleData) *ChargeSession {
 	chargeState := parentResponse.ChargeState
 	if chargeState.ChargingState == "Disconnected" || chargeState.ChargingState == "" {
@@ -77,7 +302,31 @@ func toChargeSession(parentResponse *tesla.VehicleData) *ChargeSession {
 		Voltage:          chargeState.ChargerVoltage,
 		ActualCurrent:    chargeState.ChargerActualCurrent,
 		PilotCurrent:     chargeState.ChargerPilotCurrent,
+
+		ChargeEnergyAdded:  chargeState.ChargeEnergyAdded,
+		ChargerPhases:      int(number(chargeState.ChargerPhases)),
+		ChargerPower:       chargeState.ChargerPower,
+		FastChargerPresent: chargeState.FastChargerPresent,
+		FastChargerType:    chargeState.FastChargerType,
+		FastChargerBrand:   chargeState.FastChargerBrand,
 	}
 
 	return session
 }
+
+// number returns the value of a JSON number decoded into an interface{}, or 0 if it was null.
+func number(v interface{}) float64 {
+	if n, ok := v.(float64); ok {
+		return n
+	}
+	return 0
+}
+
+// unixTime converts a JSON number of seconds since the epoch into a time. It returns the zero time for null.
+func unixTime(v interface{}) time.Time {
+	seconds := number(v)
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(seconds), 0)
+}
@@ -0,0 +1,262 @@
+package car
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kodek/tesler/common"
+	"github.com/pkg/errors"
+)
+
+// tariffStep is the resolution at which time-of-use prices are applied to a charging session.
+const tariffStep = time.Minute
+
+// timeOfUseRate is a price within a daily time window. Times are minutes since midnight.
+type timeOfUseRate struct {
+	start int
+	end   int
+	days  map[time.Weekday]bool // Every day if empty.
+	price float64
+}
+
+// appliesOn returns whether the rate applies on the given day.
+func (r *timeOfUseRate) appliesOn(day time.Weekday) bool {
+	return len(r.days) == 0 || r.days[day]
+}
+
+// matches returns whether the rate applies at the given local time. Windows wrapping past midnight belong to the day
+// they start on.
+func (r *timeOfUseRate) matches(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if r.start < r.end {
+		return r.appliesOn(t.Weekday()) && minute >= r.start && minute < r.end
+	}
+	if minute >= r.start {
+		return r.appliesOn(t.Weekday())
+	}
+	return minute < r.end && r.appliesOn(t.AddDate(0, 0, -1).Weekday())
+}
+
+// schedule is a flat price with optional time-of-use overrides. The first matching rate wins.
+type schedule struct {
+	price float64
+	rates []timeOfUseRate
+}
+
+func (s *schedule) priceAt(t time.Time) float64 {
+	for i := range s.rates {
+		if s.rates[i].matches(t) {
+			return s.rates[i].price
+		}
+	}
+	return s.price
+}
+
+// Tariff prices the energy added by charging sessions.
+type Tariff struct {
+	Currency string
+
+	loc              *time.Location
+	defaultSchedule  schedule
+	places           map[string]schedule
+	superchargePrice float64
+}
+
+// NewTariffFromConfig validates the configured tariff.
+func NewTariffFromConfig(conf common.Configuration) (*Tariff, error) {
+	tc := conf.Recorder.Tariff
+	t := &Tariff{
+		Currency:         tc.Currency,
+		loc:              time.Local,
+		places:           make(map[string]schedule),
+		superchargePrice: tc.SuperchargerPricePerKwh,
+	}
+	if tc.Timezone != "" {
+		loc, err := time.LoadLocation(tc.Timezone)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid tariff timezone")
+		}
+		t.loc = loc
+	}
+
+	var err error
+	t.defaultSchedule, err = newSchedule(tc.PricePerKwh, tc.TimeOfUse)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid default tariff")
+	}
+	priced := tc.PricePerKwh > 0 || len(tc.TimeOfUse) > 0 || tc.SuperchargerPricePerKwh > 0
+	geofences := make(map[string]bool)
+	for _, gc := range conf.Recorder.Geofences {
+		geofences[gc.Name] = true
+	}
+	for _, pt := range tc.Places {
+		priced = true
+		if !geofences[pt.Place] {
+			return nil, errors.Errorf("tariff for place %q doesn't match any geofence", pt.Place)
+		}
+		if _, ok := t.places[pt.Place]; ok {
+			return nil, errors.Errorf("duplicate tariff for place %q", pt.Place)
+		}
+		t.places[pt.Place], err = newSchedule(pt.PricePerKwh, pt.TimeOfUse)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid tariff for place %q", pt.Place)
+		}
+	}
+	if priced && t.Currency == "" {
+		return nil, errors.New("Tariff.Currency must be set along with prices")
+	}
+	return t, nil
+}
+
+func newSchedule(price float64, rates []common.TimeOfUseRate) (schedule, error) {
+	s := schedule{price: price}
+	for _, rc := range rates {
+		r := timeOfUseRate{
+			price: rc.PricePerKwh,
+			days:  make(map[time.Weekday]bool),
+		}
+		var err error
+		if r.start, err = parseTimeOfDay(rc.Start); err != nil {
+			return s, err
+		}
+		if r.end, err = parseTimeOfDay(rc.End); err != nil {
+			return s, err
+		}
+		if r.start == r.end {
+			return s, errors.Errorf("time-of-use window %s-%s is empty", rc.Start, rc.End)
+		}
+		for _, d := range rc.Days {
+			day, err := parseWeekday(d)
+			if err != nil {
+				return s, err
+			}
+			r.days[day] = true
+		}
+		s.rates = append(s.rates, r)
+	}
+	return s, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Errorf("invalid time of day %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(s, d.String()[:3]) || strings.EqualFold(s, d.String()) {
+			return d, nil
+		}
+	}
+	return 0, errors.Errorf("invalid day %q", s)
+}
+
+// Cost returns the cost of a charging session. DC sessions are priced at the supercharger price. Otherwise, the
+// schedule of the session's place (or the default one) is applied, assuming energy was added at a constant rate.
+func (t *Tariff) Cost(session *ChargingSession) float64 {
+	if session.DC {
+		return session.EnergyAdded * t.superchargePrice
+	}
+	s, ok := t.places[session.Place]
+	if !ok || session.Place == "" {
+		s = t.defaultSchedule
+	}
+	duration := session.Duration()
+	if duration <= 0 || len(s.rates) == 0 {
+		return session.EnergyAdded * s.priceAt(session.StartTime.In(t.loc))
+	}
+
+	cost := 0.0
+	for start := session.StartTime; start.Before(session.EndTime); start = start.Add(tariffStep) {
+		step := tariffStep
+		if remaining := session.EndTime.Sub(start); remaining < step {
+			step = remaining
+		}
+		energy := session.EnergyAdded * float64(step) / float64(duration)
+		cost += energy * s.priceAt(start.In(t.loc))
+	}
+	return cost
+}
+
+// Location returns the timezone of the tariff's schedules, which is also used to tell which day or month a session
+// belongs to.
+func (t *Tariff) Location() *time.Location {
+	return t.loc
+}
+
+// MonthlyChargingCost sums up the charging sessions of a car in a month that were paid in the same currency.
+type MonthlyChargingCost struct {
+	Month       string // YYYY-MM
+	Currency    string
+	Sessions    int
+	EnergyAdded float64 // kWh.
+	Cost        float64
+	// ByPlace breaks down the cost by geofence. Sessions outside any geofence are under "".
+	ByPlace map[string]float64
+}
+
+// MonthlyChargingCosts groups the costs of charging sessions by the month they started in, in the tariff's timezone,
+// and by currency. Sessions recorded without a cost are priced with the given tariff. The result is sorted by month,
+// oldest first, then by currency.
+func MonthlyChargingCosts(sessions []ChargingSession, tariff *Tariff) []MonthlyChargingCost {
+	type key struct {
+		month    string
+		currency string
+	}
+	months := make(map[key]*MonthlyChargingCost)
+	for i := range sessions {
+		session := &sessions[i]
+		cost, currency := session.Cost, session.Currency
+		if currency == "" {
+			cost, currency = tariff.Cost(session), tariff.Currency
+		}
+		k := key{session.StartTime.In(tariff.loc).Format("2006-01"), currency}
+		m, ok := months[k]
+		if !ok {
+			m = &MonthlyChargingCost{
+				Month:    k.month,
+				Currency: currency,
+				ByPlace:  make(map[string]float64),
+			}
+			months[k] = m
+		}
+		m.Sessions++
+		m.EnergyAdded += session.EnergyAdded
+		m.Cost += cost
+		m.ByPlace[session.Place] += cost
+	}
+
+	result := make([]MonthlyChargingCost, 0, len(months))
+	for _, m := range months {
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Month != result[j].Month {
+			return result[i].Month < result[j].Month
+		}
+		return result[i].Currency < result[j].Currency
+	})
+	return result
+}
+
+// StartOfMonth returns the start of the month the given number of months before t, in the given location.
+func StartOfMonth(t time.Time, monthsBefore int, loc *time.Location) time.Time {
+	local := t.In(loc)
+	return time.Date(local.Year(), local.Month()-time.Month(monthsBefore), 1, 0, 0, 0, 0, loc)
+}
+
+// FormatCost formats an amount of money in the tariff's currency.
+func (t *Tariff) FormatCost(amount float64) string {
+	return FormatCost(amount, t.Currency)
+}
+
+// FormatCost formats an amount of money in the given currency.
+func FormatCost(amount float64, currency string) string {
+	return strings.TrimSpace(fmt.Sprintf("%.2f %s", amount, currency))
+}
@@ -0,0 +1,121 @@
+package car
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kodek/tesler/common"
+)
+
+func TestTimeOfUseWindows(t *testing.T) {
+	// 2020-05-01 is a Friday.
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2020, 5, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		rate common.TimeOfUseRate
+		time time.Time
+		want bool
+	}{
+		{"within window", common.TimeOfUseRate{Start: "09:00", End: "17:00"}, at(1, 9, 0), true},
+		{"end is exclusive", common.TimeOfUseRate{Start: "09:00", End: "17:00"}, at(1, 17, 0), false},
+		{"before window", common.TimeOfUseRate{Start: "09:00", End: "17:00"}, at(1, 8, 59), false},
+		{"weekday", common.TimeOfUseRate{Start: "09:00", End: "17:00", Days: []string{"Mon", "Friday"}},
+			at(1, 12, 0), true},
+		{"other weekday", common.TimeOfUseRate{Start: "09:00", End: "17:00", Days: []string{"Mon", "Friday"}},
+			at(2, 12, 0), false},
+		{"wrapping, before midnight", common.TimeOfUseRate{Start: "22:00", End: "06:00"}, at(1, 23, 0), true},
+		{"wrapping, after midnight", common.TimeOfUseRate{Start: "22:00", End: "06:00"}, at(2, 5, 59), true},
+		{"wrapping, end is exclusive", common.TimeOfUseRate{Start: "22:00", End: "06:00"}, at(2, 6, 0), false},
+		{"wrapping, midday", common.TimeOfUseRate{Start: "22:00", End: "06:00"}, at(2, 12, 0), false},
+		{"wrapping on the start day", common.TimeOfUseRate{Start: "22:00", End: "06:00", Days: []string{"Fri"}},
+			at(1, 22, 0), true},
+		{"wrapping into the next day", common.TimeOfUseRate{Start: "22:00", End: "06:00", Days: []string{"Fri"}},
+			at(2, 2, 0), true},
+		{"wrapping from the previous day", common.TimeOfUseRate{Start: "22:00", End: "06:00", Days: []string{"Fri"}},
+			at(1, 2, 0), false},
+		{"wrapping, next day's own window", common.TimeOfUseRate{Start: "22:00", End: "06:00", Days: []string{"Fri"}},
+			at(2, 23, 0), false},
+		{"wrapping across the week", common.TimeOfUseRate{Start: "23:00", End: "01:00", Days: []string{"Sat"}},
+			at(3, 0, 30), true},
+		{"wrapping into Saturday", common.TimeOfUseRate{Start: "23:00", End: "01:00", Days: []string{"Sat"}},
+			at(2, 0, 30), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.rate.PricePerKwh = 1
+			s, err := newSchedule(0, []common.TimeOfUseRate{test.rate})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.priceAt(test.time) == 1; got != test.want {
+				t.Errorf("rate %s-%s %v applies on %s = %v, want %v", test.rate.Start, test.rate.End,
+					test.rate.Days, test.time.Format("Mon 15:04"), got, test.want)
+			}
+		})
+	}
+}
+
+func TestTimeOfUseFirstMatchingRateWins(t *testing.T) {
+	s, err := newSchedule(0.3, []common.TimeOfUseRate{
+		{Start: "00:00", End: "06:00", Days: []string{"Sat", "Sun"}, PricePerKwh: 0.05},
+		{Start: "22:00", End: "07:00", PricePerKwh: 0.1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2020-05-02 is a Saturday.
+	for _, test := range []struct {
+		time time.Time
+		want float64
+	}{
+		{time.Date(2020, 5, 2, 3, 0, 0, 0, time.UTC), 0.05},
+		{time.Date(2020, 5, 4, 3, 0, 0, 0, time.UTC), 0.1},
+		{time.Date(2020, 5, 2, 6, 30, 0, 0, time.UTC), 0.1},
+		{time.Date(2020, 5, 2, 12, 0, 0, 0, time.UTC), 0.3},
+	} {
+		if got := s.priceAt(test.time); got != test.want {
+			t.Errorf("price on %s = %v, want %v", test.time.Format("Mon 15:04"), got, test.want)
+		}
+	}
+}
+
+func TestNewScheduleValidatesRates(t *testing.T) {
+	for _, test := range []struct {
+		rate    common.TimeOfUseRate
+		wantErr string
+	}{
+		{common.TimeOfUseRate{Start: "22:00", End: "22:00"}, "is empty"},
+		{common.TimeOfUseRate{Start: "25:00", End: "06:00"}, "invalid time of day"},
+		{common.TimeOfUseRate{Start: "22:00", End: "6am"}, "invalid time of day"},
+		{common.TimeOfUseRate{Start: "22:00", End: "06:00", Days: []string{"Funday"}}, "invalid day"},
+	} {
+		_, err := newSchedule(0, []common.TimeOfUseRate{test.rate})
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("newSchedule(%+v) = %v, want an error containing %q", test.rate, err, test.wantErr)
+		}
+	}
+}
+
+func TestTariffCostAcrossWindowInTariffTimezone(t *testing.T) {
+	conf := common.Configuration{}
+	conf.Recorder.Tariff = common.TariffConfig{
+		Currency:    "USD",
+		Timezone:    "America/Los_Angeles",
+		PricePerKwh: 0.3,
+		TimeOfUse:   []common.TimeOfUseRate{{Start: "22:00", End: "06:00", PricePerKwh: 0.1}},
+	}
+	tariff, err := NewTariffFromConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 21:00 to 23:00 in Los Angeles, half of it off-peak.
+	start := time.Date(2020, 5, 2, 4, 0, 0, 0, time.UTC)
+	session := &ChargingSession{StartTime: start, EndTime: start.Add(2 * time.Hour), EnergyAdded: 10}
+	if cost := tariff.Cost(session); math.Abs(cost-2) > 1e-9 {
+		t.Errorf("Cost() = %v, want 2", cost)
+	}
+}
@@ -0,0 +1,124 @@
+package car
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	TirePressureLowEvent      = "tire_pressure_low"
+	TirePressureDroppingEvent = "tire_pressure_dropping"
+)
+
+// minPressureLossWindow is the shortest interval over which the rate of pressure loss is measured. Shorter
+// intervals are dominated by sensor noise and temperature swings while driving.
+const minPressureLossWindow = 30 * time.Minute
+
+// maxPressureLossWindow is the longest interval over which the rate of pressure loss is measured, so that a sudden
+// leak isn't averaged away over days of steady pressure.
+const maxPressureLossWindow = 6 * time.Hour
+
+// pressureNoiseMargin is how much a reading may go up without counting as a rise in pressure. The TPMS reports in
+// steps of about 0.025 bar, and readings jitter by a step or two.
+const pressureNoiseMargin = 0.05
+
+// pressureSample is a single tire pressure reading.
+type pressureSample struct {
+	timestamp time.Time
+	pressure  float64
+}
+
+// tireState tracks a single tire of a car.
+type tireState struct {
+	// reference is the reading that losses are measured from.
+	reference       *pressureSample
+	alertedLow      bool
+	alertedDropping bool
+}
+
+// NewTirePressureMonitor returns a snapshot listener that emits a TirePressureLowEvent when a tire drops below
+// minPressure (in bar), and a TirePressureDroppingEvent when a tire loses more than maxLossPerHour (bar per hour).
+// A non-positive threshold disables its check. The listener is safe for concurrent use.
+func NewTirePressureMonitor(minPressure float64, maxLossPerHour float64, onEvent OnEventFunc) OnSnapshotFunc {
+	var mu sync.Mutex
+	// Keyed by VIN, then tire position.
+	tires := make(map[string]map[string]*tireState)
+
+	return func(s *Snapshot) {
+		if s.Tires == nil {
+			return
+		}
+
+		var events []Event
+		mu.Lock()
+		carTires, ok := tires[s.Vin]
+		if !ok {
+			carTires = make(map[string]*tireState)
+			tires[s.Vin] = carTires
+		}
+		for position, pressure := range s.Tires.Pressures() {
+			if pressure <= 0 {
+				// Not measured yet.
+				continue
+			}
+			state, ok := carTires[position]
+			if !ok {
+				state = &tireState{}
+				carTires[position] = state
+			}
+
+			if minPressure > 0 {
+				if pressure < minPressure && !state.alertedLow {
+					state.alertedLow = true
+					events = append(events, tireEvent(s, TirePressureLowEvent,
+						fmt.Sprintf("The %s tire is at %.2f bar, below %.2f bar.", position, pressure, minPressure)))
+				} else if pressure >= minPressure {
+					state.alertedLow = false
+				}
+			}
+
+			sample := &pressureSample{timestamp: s.Timestamp, pressure: pressure}
+			if state.reference == nil || pressure > state.reference.pressure+pressureNoiseMargin {
+				// Pressure went up (e.g. tires warmed up or were inflated). Measure losses from here.
+				state.reference = sample
+				state.alertedDropping = false
+				continue
+			}
+			elapsed := s.Timestamp.Sub(state.reference.timestamp)
+			if elapsed < minPressureLossWindow {
+				continue
+			}
+			lossPerHour := (state.reference.pressure - pressure) / elapsed.Hours()
+			if maxLossPerHour > 0 && lossPerHour > maxLossPerHour {
+				if !state.alertedDropping {
+					state.alertedDropping = true
+					events = append(events, tireEvent(s, TirePressureDroppingEvent,
+						fmt.Sprintf("The %s tire lost %.2f bar in %s (%.3f bar/hour). It's now at %.2f bar.",
+							position, state.reference.pressure-pressure, elapsed.Round(time.Minute), lossPerHour,
+							pressure)))
+				}
+				continue
+			}
+			state.alertedDropping = false
+			if elapsed > maxPressureLossWindow {
+				state.reference = sample
+			}
+		}
+		mu.Unlock()
+
+		for _, e := range events {
+			onEvent(e)
+		}
+	}
+}
+
+func tireEvent(s *Snapshot, kind string, message string) Event {
+	return Event{
+		Timestamp: s.Timestamp,
+		Vin:       s.Vin,
+		CarName:   s.Name,
+		Kind:      kind,
+		Message:   message,
+	}
+}
@@ -0,0 +1,66 @@
+package car
+
+import (
+	"testing"
+	"time"
+)
+
+// observeFrontLeft feeds the monitor a front left pressure reading every 10 minutes, and returns the events.
+func observeFrontLeft(t *testing.T, monitor func(onEvent OnEventFunc) OnSnapshotFunc, pressures []float64) []Event {
+	t.Helper()
+	var events []Event
+	listener := monitor(func(e Event) {
+		events = append(events, e)
+	})
+	start := time.Date(2020, 5, 2, 10, 0, 0, 0, time.UTC)
+	for i, pressure := range pressures {
+		listener(&Snapshot{
+			Vin:       "VIN1",
+			Timestamp: start.Add(time.Duration(i) * 10 * time.Minute),
+			Tires: &Tires{
+				FrontLeftPressure:  pressure,
+				FrontRightPressure: 2.9,
+				RearLeftPressure:   2.9,
+				RearRightPressure:  2.9,
+			},
+		})
+	}
+	return events
+}
+
+func dropMonitor(onEvent OnEventFunc) OnSnapshotFunc {
+	return NewTirePressureMonitor(0, 0.05, onEvent)
+}
+
+func TestTirePressureSlowLeakWithNoisyReadings(t *testing.T) {
+	// Loses 0.1 bar/hour, with every other reading a sensor step high.
+	var pressures []float64
+	for i := 0; i < 18; i++ {
+		pressure := 2.9 - 0.1*float64(i)/6
+		if i%2 == 1 {
+			pressure += 0.025
+		}
+		pressures = append(pressures, pressure)
+	}
+
+	events := observeFrontLeft(t, dropMonitor, pressures)
+	if len(events) != 1 || events[0].Kind != TirePressureDroppingEvent {
+		t.Errorf("got events %+v, want a single dropping alert", events)
+	}
+}
+
+func TestTirePressureFastLeakAlertsOnce(t *testing.T) {
+	// Loses 0.6 bar/hour for 3 hours, then is inflated and starts leaking again.
+	var pressures []float64
+	for i := 0; i < 18; i++ {
+		pressures = append(pressures, 2.9-0.1*float64(i))
+	}
+	for i := 0; i < 6; i++ {
+		pressures = append(pressures, 2.9-0.1*float64(i))
+	}
+
+	events := observeFrontLeft(t, dropMonitor, pressures)
+	if len(events) != 2 {
+		t.Errorf("got %d events, want one per leak: %+v", len(events), events)
+	}
+}
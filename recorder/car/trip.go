@@ -0,0 +1,228 @@
+package car
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kodek/tesler/common"
+)
+
+// maxTripGap is the longest time without snapshots before an ongoing trip is considered over. This covers restarts
+// and lost connectivity while driving.
+const maxTripGap = 30 * time.Minute
+
+// DefaultRatedWhPerMile is the energy per mile of rated range assumed for cars without a configured one. It's close
+// to the rated consumption of a Model 3; a Model S or X is closer to 300.
+const DefaultRatedWhPerMile = 250
+
+// Location is a point on the map.
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Trip summarizes a drive, from shifting out of park until shifting back into park. Distances are in miles and
+// speeds in miles per hour, like the Tesla API.
+//
+// EnergyUsed is derived from the rated range lost during the trip, times the energy per mile of rated range of the
+// car, since the API doesn't report the usable capacity of the pack. IntegratedEnergy is integrated from the power
+// reported in each snapshot instead, as a cross-check. It's only as good as the polling interval: short bursts of
+// acceleration or regeneration between two snapshots are missed.
+type Trip struct {
+	Vin               string
+	CarName           string
+	StartTime         time.Time
+	EndTime           time.Time
+	StartLocation     Location
+	EndLocation       Location
+	StartPlace        string // Geofence names, if any.
+	EndPlace          string
+	StartOdometer     float64
+	EndOdometer       float64
+	StartBatteryLevel int
+	EndBatteryLevel   int
+	StartRange        float64
+	EndRange          float64
+	// EnergyUsed is the net energy drawn from the battery (regenerative braking included), in kWh. See above for how
+	// it's estimated.
+	EnergyUsed float64
+	// IntegratedEnergy is EnergyUsed as integrated from the reported power, in kWh.
+	IntegratedEnergy float64
+	MaxSpeed         float64
+	AverageSpeed     float64
+}
+
+func (t *Trip) Distance() float64 {
+	return t.EndOdometer - t.StartOdometer
+}
+
+func (t *Trip) Duration() time.Duration {
+	return t.EndTime.Sub(t.StartTime)
+}
+
+// RangeUsed is the rated range lost during the trip, in miles.
+func (t *Trip) RangeUsed() float64 {
+	return t.StartRange - t.EndRange
+}
+
+// IsParked returns whether the given driving state (shift state) means the car is parked. The API reports no shift
+// state at all while the car is off.
+func IsParked(drivingState string) bool {
+	return drivingState == "" || drivingState == "P"
+}
+
+// TripSegmenter turns a stream of snapshots into trips. It's safe for concurrent use by several cars.
+type TripSegmenter struct {
+	// ratedWhPerMile is the energy per mile of rated range of each car, by VIN.
+	ratedWhPerMile map[string]float64
+
+	mu    sync.Mutex
+	state map[string]*tripState
+}
+
+// tripState tracks the ongoing trip of a single car.
+type tripState struct {
+	ratedWhPerMile float64
+	trip           *Trip
+	last           *Snapshot
+	speedTotal     float64
+	samples        int
+}
+
+// NewTripSegmenter returns a TripSegmenter that estimates the energy used by each car from its energy per mile of
+// rated range, by VIN. Cars missing from ratedWhPerMile use DefaultRatedWhPerMile.
+func NewTripSegmenter(ratedWhPerMile map[string]float64) *TripSegmenter {
+	return &TripSegmenter{
+		ratedWhPerMile: ratedWhPerMile,
+		state:          make(map[string]*tripState),
+	}
+}
+
+// NewTripSegmenterFromConfig returns a TripSegmenter using the energy per mile of rated range configured for each car.
+func NewTripSegmenterFromConfig(conf common.Configuration) *TripSegmenter {
+	ratedWhPerMile := make(map[string]float64)
+	for _, c := range conf.Recorder.Cars {
+		if c.RatedWhPerMile > 0 {
+			ratedWhPerMile[c.Vin] = c.RatedWhPerMile
+		}
+	}
+	return NewTripSegmenter(ratedWhPerMile)
+}
+
+// Observe processes the next snapshot of a car, in chronological order. It returns the trip that the snapshot
+// completed, if any.
+func (ts *TripSegmenter) Observe(s *Snapshot) *Trip {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	state, ok := ts.state[s.Vin]
+	if !ok {
+		ratedWhPerMile, ok := ts.ratedWhPerMile[s.Vin]
+		if !ok {
+			ratedWhPerMile = DefaultRatedWhPerMile
+		}
+		state = &tripState{ratedWhPerMile: ratedWhPerMile}
+		ts.state[s.Vin] = state
+	}
+	defer func() {
+		state.last = s
+	}()
+
+	var completed *Trip
+	if state.trip != nil && s.Timestamp.Sub(state.last.Timestamp) > maxTripGap {
+		// We lost track of the car. End the trip where we last saw it.
+		completed = state.finish(state.last)
+	}
+
+	if IsParked(s.DrivingState) {
+		if state.trip != nil {
+			state.update(s)
+			completed = state.finish(s)
+		}
+		return completed
+	}
+
+	if state.trip == nil {
+		state.start(s)
+	} else {
+		state.update(s)
+	}
+	return completed
+}
+
+// Flush ends the ongoing trips of all cars where they were last seen, and returns them. It's meant to be called on
+// shutdown, since ongoing trips aren't resumed after a restart.
+func (ts *TripSegmenter) Flush() []Trip {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var trips []Trip
+	for _, state := range ts.state {
+		if state.trip == nil {
+			continue
+		}
+		if trip := state.finish(state.last); trip != nil {
+			trips = append(trips, *trip)
+		}
+	}
+	return trips
+}
+
+func (state *tripState) start(s *Snapshot) {
+	// If the car was seen parked right before, the trip started there.
+	first := s
+	if state.last != nil && IsParked(state.last.DrivingState) && s.Timestamp.Sub(state.last.Timestamp) <= maxTripGap {
+		first = state.last
+	}
+	state.trip = &Trip{
+		Vin:               s.Vin,
+		CarName:           s.Name,
+		StartTime:         first.Timestamp,
+		StartLocation:     Location{first.Bearings.Latitude, first.Bearings.Longitude},
+		StartPlace:        first.Place,
+		StartOdometer:     first.Odometer,
+		StartBatteryLevel: first.BatteryLevel,
+		StartRange:        first.RangeLeft,
+	}
+	state.speedTotal = 0
+	state.samples = 0
+	state.last = first
+	state.update(s)
+}
+
+// update accumulates a snapshot taken during the trip.
+func (state *tripState) update(s *Snapshot) {
+	if state.last != nil && s != state.last {
+		// Trapezoidal integration of power (kW) over time.
+		hours := s.Timestamp.Sub(state.last.Timestamp).Hours()
+		state.trip.IntegratedEnergy += (state.last.Power + s.Power) / 2 * hours
+	}
+	if s.Bearings.Speed > state.trip.MaxSpeed {
+		state.trip.MaxSpeed = s.Bearings.Speed
+	}
+	state.speedTotal += s.Bearings.Speed
+	state.samples++
+}
+
+// finish completes the ongoing trip at the given snapshot. Trips where the car never moved are discarded.
+func (state *tripState) finish(s *Snapshot) *Trip {
+	trip := state.trip
+	state.trip = nil
+
+	trip.EndTime = s.Timestamp
+	trip.EndLocation = Location{s.Bearings.Latitude, s.Bearings.Longitude}
+	trip.EndPlace = s.Place
+	trip.EndOdometer = s.Odometer
+	trip.EndBatteryLevel = s.BatteryLevel
+	trip.EndRange = s.RangeLeft
+	trip.EnergyUsed = trip.RangeUsed() * state.ratedWhPerMile / 1000
+	if trip.Distance() <= 0 {
+		return nil
+	}
+	if hours := trip.Duration().Hours(); hours > 0 {
+		trip.AverageSpeed = trip.Distance() / hours
+	} else if state.samples > 0 {
+		trip.AverageSpeed = state.speedTotal / float64(state.samples)
+	}
+	return trip
+}
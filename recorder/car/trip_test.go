@@ -0,0 +1,36 @@
+package car
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTripEnergyFromRatedRange(t *testing.T) {
+	segmenter := NewTripSegmenter(map[string]float64{"VIN1": 300})
+	start := time.Date(2020, 5, 2, 10, 0, 0, 0, time.UTC)
+	snapshots := []Snapshot{
+		{DrivingState: "P", Odometer: 100, RangeLeft: 200, BatteryLevel: 80},
+		{DrivingState: "D", Odometer: 105, RangeLeft: 194, BatteryLevel: 78, Power: 20},
+		{DrivingState: "P", Odometer: 110, RangeLeft: 190, BatteryLevel: 76, Power: 20},
+	}
+	var trip *Trip
+	for i := range snapshots {
+		s := &snapshots[i]
+		s.Vin = "VIN1"
+		s.Timestamp = start.Add(time.Duration(i) * 15 * time.Minute)
+		trip = segmenter.Observe(s)
+	}
+
+	if trip == nil {
+		t.Fatal("no trip")
+	}
+	// 10 miles of rated range at 300 Wh/mi.
+	if math.Abs(trip.EnergyUsed-3) > 1e-9 {
+		t.Errorf("EnergyUsed = %f kWh, want 3", trip.EnergyUsed)
+	}
+	// 20 kW for the last 15 minutes, ramping up from 0 in the first 15.
+	if math.Abs(trip.IntegratedEnergy-7.5) > 1e-9 {
+		t.Errorf("IntegratedEnergy = %f kWh, want 7.5", trip.IntegratedEnergy)
+	}
+}
@@ -0,0 +1,393 @@
+package car
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const VampireDrainSummaryEvent = "vampire_drain_summary"
+
+// Causes that parked battery drain is attributed to.
+const (
+	DrainSentry  = "sentry"
+	DrainClimate = "climate"
+	// DrainAwake is drain while the car was awake for any other reason, e.g. the display was on or something kept
+	// polling it.
+	DrainAwake = "awake"
+	// DrainAsleep is drain while the car was asleep or offline.
+	DrainAsleep = "asleep"
+)
+
+// maxAwakeSnapshotGap is the longest time between two snapshots of an awake car, when its wake state wasn't watched
+// in between (e.g. across a restart). A longer gap is assumed to be spent asleep.
+const maxAwakeSnapshotGap = 5 * time.Minute
+
+// DrainRetentionDays is how many days of drain summaries are kept.
+const DrainRetentionDays = 31
+
+// DrainStats is the battery lost while parked over some period. Range is in miles and SoC in percent.
+type DrainStats struct {
+	Hours            float64
+	RangeLost        float64
+	SocLost          float64
+	RangeLostPerHour float64
+	SocLostPerHour   float64
+}
+
+// Add accounts for drain over the given number of hours.
+func (d *DrainStats) Add(hours float64, rangeLost float64, socLost float64) {
+	d.Hours += hours
+	d.RangeLost += rangeLost
+	d.SocLost += socLost
+	if d.Hours > 0 {
+		d.RangeLostPerHour = d.RangeLost / d.Hours
+		d.SocLostPerHour = d.SocLost / d.Hours
+	}
+}
+
+// DailyDrainSummary is the battery a car lost while parked on a given day, in total and by cause.
+type DailyDrainSummary struct {
+	Vin     string
+	CarName string
+	Date    string // YYYY-MM-DD
+	Total   DrainStats
+	ByCause map[string]*DrainStats
+	// Complete is set once the day is over and its summary was published.
+	Complete bool
+}
+
+// DrainSummaryFunc is called with the summary of a day, e.g. to store it.
+type DrainSummaryFunc func(summary DailyDrainSummary)
+
+// Message describes the summary in a notification.
+func (d *DailyDrainSummary) Message() string {
+	causes := make([]string, 0, len(d.ByCause))
+	for cause := range d.ByCause {
+		causes = append(causes, cause)
+	}
+	sort.Strings(causes)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Lost %.1f miles (%.1f%%) over %.1f parked hours on %s.", d.Total.RangeLost, d.Total.SocLost,
+		d.Total.Hours, d.Date)
+	for _, cause := range causes {
+		stats := d.ByCause[cause]
+		fmt.Fprintf(&b, "\n%s: %.1f miles over %.1f hours (%.2f mi/h)", cause, stats.RangeLost, stats.Hours,
+			stats.RangeLostPerHour)
+	}
+	return b.String()
+}
+
+// VampireDrainTracker measures the battery lost by parked cars that aren't plugged in, and attributes it to sentry
+// mode, climate, the car being awake or the car sleeping. Whether a car was asleep between snapshots is told by the
+// StateMonitor, since the recorder stops fetching data from idle cars whether or not they fall asleep. It keeps daily
+// summaries in memory and is safe for concurrent use. Summaries can be stored as they complete, and restored after a
+// restart.
+type VampireDrainTracker struct {
+	loc       *time.Location
+	previous  PreviousSnapshotFunc
+	onEvent   OnEventFunc
+	onSummary DrainSummaryFunc
+
+	mu    sync.Mutex
+	state map[string]*drainState
+}
+
+// drainState tracks the drain of a single car.
+type drainState struct {
+	// seeded is set once last was looked up.
+	seeded bool
+	last   *Snapshot
+	days   map[string]*DailyDrainSummary
+	// watchedSince is when the StateMonitor first reported the car. Zero if it hasn't.
+	watchedSince time.Time
+	// wakeChanges are the changes of wake state reported after last.
+	wakeChanges []wakeChange
+}
+
+// wakeChange is a car falling asleep (or going offline) or waking up.
+type wakeChange struct {
+	at     time.Time
+	asleep bool
+}
+
+// drainSegment is a stretch of time between two snapshots attributed to a single cause.
+type drainSegment struct {
+	start time.Time
+	end   time.Time
+	cause string
+}
+
+// NewVampireDrainTracker returns a tracker that buckets days in the given location and publishes the summary of each
+// day to onEvent and onSummary (if not nil) once it's over. The previous snapshot of a car is looked up on its first
+// snapshot, so that drain across a restart is counted.
+func NewVampireDrainTracker(loc *time.Location, previous PreviousSnapshotFunc, onEvent OnEventFunc,
+	onSummary DrainSummaryFunc) *VampireDrainTracker {
+	return &VampireDrainTracker{
+		loc:       loc,
+		previous:  previous,
+		onEvent:   onEvent,
+		onSummary: onSummary,
+		state:     make(map[string]*drainState),
+	}
+}
+
+// Restore adds previously stored summaries, e.g. after a restart. It must be called before the first snapshot of
+// their cars is observed. Complete summaries aren't published again; drain is added to incomplete ones.
+func (t *VampireDrainTracker) Restore(summaries []DailyDrainSummary) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, summary := range summaries {
+		day := copySummary(&summary)
+		t.carState(summary.Vin).days[summary.Date] = &day
+	}
+}
+
+// Flush returns copies of the summaries of the days that aren't over yet, e.g. to store them before shutting down.
+func (t *VampireDrainTracker) Flush() []DailyDrainSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var summaries []DailyDrainSummary
+	for _, state := range t.state {
+		for _, day := range state.days {
+			if !day.Complete {
+				summaries = append(summaries, copySummary(day))
+			}
+		}
+	}
+	return summaries
+}
+
+// Observe processes the next snapshot of a car, in chronological order. It can be used as an OnSnapshotFunc.
+func (t *VampireDrainTracker) Observe(s *Snapshot) {
+	t.mu.Lock()
+	completed := t.observe(s)
+	t.mu.Unlock()
+
+	for _, day := range completed {
+		t.onEvent(Event{
+			Timestamp: s.Timestamp,
+			Vin:       day.Vin,
+			CarName:   day.CarName,
+			Kind:      VampireDrainSummaryEvent,
+			Message:   day.Message(),
+		})
+		if t.onSummary != nil {
+			t.onSummary(day)
+		}
+	}
+}
+
+// ObserveVehicle records the wake state changes of a car. It can be used as an OnVehicleChangeFunc, and must get the
+// events of a car before its recording starts.
+func (t *VampireDrainTracker) ObserveVehicle(e VehicleEvent) {
+	if !e.StateChanged() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := t.carState(e.Vin)
+	if state.watchedSince.IsZero() {
+		state.watchedSince = e.Timestamp
+	}
+	state.wakeChanges = append(state.wakeChanges, wakeChange{
+		at:     e.Timestamp,
+		asleep: e.NewState == "asleep" || e.NewState == "offline",
+	})
+}
+
+// carState returns the state of a car, creating it if needed. mu must be held.
+func (t *VampireDrainTracker) carState(vin string) *drainState {
+	state, ok := t.state[vin]
+	if !ok {
+		state = &drainState{days: make(map[string]*DailyDrainSummary)}
+		t.state[vin] = state
+	}
+	return state
+}
+
+// observe records the drain up to the given snapshot and returns copies of the days it completed. mu must be held.
+func (t *VampireDrainTracker) observe(s *Snapshot) []DailyDrainSummary {
+	state := t.carState(s.Vin)
+	if !state.seeded {
+		state.last = t.previous(s.Vin)
+		state.seeded = true
+	}
+	last := state.last
+	state.last = s
+	segments := drainSegments(state, last, s)
+	pending := state.wakeChanges[:0]
+	for _, change := range state.wakeChanges {
+		if change.at.After(s.Timestamp) {
+			pending = append(pending, change)
+		}
+	}
+	state.wakeChanges = pending
+	if last == nil || !isDraining(last) || !isDraining(s) || !s.Timestamp.After(last.Timestamp) {
+		return t.completedDays(state, s)
+	}
+
+	rangeLost := last.RangeLeft - s.RangeLeft
+	socLost := float64(last.BatteryLevel - s.BatteryLevel)
+	// Split the interval across its causes and the days it spans.
+	total := s.Timestamp.Sub(last.Timestamp)
+	for _, segment := range segments {
+		for start := segment.start; start.Before(segment.end); {
+			local := start.In(t.loc)
+			midnight := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, t.loc)
+			end := segment.end
+			if midnight.Before(end) {
+				end = midnight
+			}
+			share := float64(end.Sub(start)) / float64(total)
+			day := t.day(state, s, local.Format("2006-01-02"))
+			stats, ok := day.ByCause[segment.cause]
+			if !ok {
+				stats = &DrainStats{}
+				day.ByCause[segment.cause] = stats
+			}
+			hours := end.Sub(start).Hours()
+			stats.Add(hours, rangeLost*share, socLost*share)
+			day.Total.Add(hours, rangeLost*share, socLost*share)
+			start = end
+		}
+	}
+	t.expire(state, s.Timestamp)
+	return t.completedDays(state, s)
+}
+
+// isDraining returns whether the battery of a car can only be losing charge: it's parked and not plugged in.
+func isDraining(s *Snapshot) bool {
+	return IsParked(s.DrivingState) && s.ChargeSession == nil && !IsCharging(s.ChargingState)
+}
+
+// drainSegments attributes the interval between two consecutive snapshots to causes, using the wake state changes
+// reported in between. Returns nil if there's no interval.
+func drainSegments(state *drainState, prev *Snapshot, next *Snapshot) []drainSegment {
+	if prev == nil || !next.Timestamp.After(prev.Timestamp) {
+		return nil
+	}
+	if prev.WakeState != "online" {
+		return []drainSegment{{start: prev.Timestamp, end: next.Timestamp, cause: DrainAsleep}}
+	}
+	if state.watchedSince.IsZero() || state.watchedSince.After(prev.Timestamp) {
+		// The wake state wasn't watched, so guess from the gap between the snapshots.
+		if next.Timestamp.Sub(prev.Timestamp) > maxAwakeSnapshotGap {
+			return []drainSegment{{start: prev.Timestamp, end: next.Timestamp, cause: DrainAsleep}}
+		}
+		return []drainSegment{{start: prev.Timestamp, end: next.Timestamp, cause: awakeDrainCause(prev)}}
+	}
+
+	var segments []drainSegment
+	start := prev.Timestamp
+	asleep := false
+	for _, change := range state.wakeChanges {
+		if !change.at.After(start) || !change.at.Before(next.Timestamp) || change.asleep == asleep {
+			continue
+		}
+		segments = append(segments, drainSegment{start: start, end: change.at, cause: segmentCause(prev, asleep)})
+		start = change.at
+		asleep = change.asleep
+	}
+	return append(segments, drainSegment{start: start, end: next.Timestamp, cause: segmentCause(prev, asleep)})
+}
+
+func segmentCause(prev *Snapshot, asleep bool) string {
+	if asleep {
+		return DrainAsleep
+	}
+	return awakeDrainCause(prev)
+}
+
+// awakeDrainCause attributes drain while the car is awake to a cause, as of the last snapshot.
+func awakeDrainCause(prev *Snapshot) string {
+	if (prev.Security != nil && prev.Security.SentryMode) || prev.ActiveDescription == "Sentry mode" {
+		return DrainSentry
+	}
+	if (prev.Climate != nil && prev.Climate.IsClimateOn) || prev.ActiveDescription == "Climate on" {
+		return DrainClimate
+	}
+	return DrainAwake
+}
+
+// day returns the summary of a car for the given date, creating it if needed.
+func (t *VampireDrainTracker) day(state *drainState, s *Snapshot, date string) *DailyDrainSummary {
+	day, ok := state.days[date]
+	if !ok {
+		day = &DailyDrainSummary{
+			Vin:     s.Vin,
+			CarName: s.Name,
+			Date:    date,
+			ByCause: make(map[string]*DrainStats),
+		}
+		state.days[date] = day
+	}
+	return day
+}
+
+// expire forgets the summaries older than DrainRetentionDays.
+func (t *VampireDrainTracker) expire(state *drainState, now time.Time) {
+	oldest := now.In(t.loc).AddDate(0, 0, -DrainRetentionDays).Format("2006-01-02")
+	for date := range state.days {
+		if date < oldest {
+			delete(state.days, date)
+		}
+	}
+}
+
+// Summaries returns copies of the daily summaries of a car for the days within [from, to], oldest first.
+func (t *VampireDrainTracker) Summaries(vin string, from time.Time, to time.Time) []DailyDrainSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	summaries := []DailyDrainSummary{}
+	state, ok := t.state[vin]
+	if !ok {
+		return summaries
+	}
+	first := from.In(t.loc).Format("2006-01-02")
+	last := to.In(t.loc).Format("2006-01-02")
+	for date, day := range state.days {
+		if date >= first && date <= last {
+			summaries = append(summaries, copySummary(day))
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Date < summaries[j].Date
+	})
+	return summaries
+}
+
+// completedDays marks the days before the given snapshot as complete and returns copies of the ones that weren't
+// yet. A day is only complete once the car reports from a later day, since drain while sleeping is known on wake up.
+func (t *VampireDrainTracker) completedDays(state *drainState, s *Snapshot) []DailyDrainSummary {
+	today := s.Timestamp.In(t.loc).Format("2006-01-02")
+	var dates []string
+	for date, day := range state.days {
+		if date < today && !day.Complete {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+
+	completed := make([]DailyDrainSummary, 0, len(dates))
+	for _, date := range dates {
+		day := state.days[date]
+		day.Complete = true
+		completed = append(completed, copySummary(day))
+	}
+	return completed
+}
+
+func copySummary(d *DailyDrainSummary) DailyDrainSummary {
+	c := *d
+	c.ByCause = make(map[string]*DrainStats, len(d.ByCause))
+	for cause, stats := range d.ByCause {
+		statsCopy := *stats
+		c.ByCause[cause] = &statsCopy
+	}
+	return c
+}
@@ -0,0 +1,76 @@
+package car
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kodek/tesla"
+)
+
+func TestVampireDrainUsesWakeStateBetweenSnapshots(t *testing.T) {
+	noPrevious := func(vin string) *Snapshot { return nil }
+	tracker := NewVampireDrainTracker(time.UTC, noPrevious, func(Event) {}, nil)
+	start := time.Date(2020, 5, 2, 10, 0, 0, 0, time.UTC)
+	event := func(at time.Duration, state string) {
+		tracker.ObserveVehicle(VehicleEvent{
+			Timestamp: start.Add(at),
+			Vin:       "VIN1",
+			Vehicle:   &tesla.Vehicle{State: &state},
+			NewState:  state,
+			Reason:    VehicleStateChanged,
+		})
+	}
+	snapshot := func(at time.Duration, rangeLeft float64) {
+		tracker.Observe(&Snapshot{
+			Vin:          "VIN1",
+			Timestamp:    start.Add(at),
+			WakeState:    "online",
+			DrivingState: "P",
+			RangeLeft:    rangeLeft,
+		})
+	}
+
+	event(-time.Minute, "online")
+	snapshot(0, 200)
+	// The recorder leaves the car alone. It stays awake for an hour before falling asleep.
+	event(time.Hour, "asleep")
+	event(4*time.Hour, "online")
+	snapshot(4*time.Hour, 196)
+
+	summaries := tracker.Summaries("VIN1", start, start)
+	if len(summaries) != 1 {
+		t.Fatalf("got %d summaries, want 1", len(summaries))
+	}
+	for cause, want := range map[string]float64{DrainAwake: 1, DrainAsleep: 3} {
+		stats := summaries[0].ByCause[cause]
+		if stats == nil || math.Abs(stats.Hours-want) > 1e-9 || math.Abs(stats.RangeLost-want) > 1e-9 {
+			t.Errorf("%s drain = %+v, want %.0f hours and miles", cause, stats, want)
+		}
+	}
+}
+
+func TestVampireDrainGuessesSleepWithoutWakeState(t *testing.T) {
+	previous := &Snapshot{
+		Vin:          "VIN1",
+		Timestamp:    time.Date(2020, 5, 2, 10, 0, 0, 0, time.UTC),
+		WakeState:    "online",
+		DrivingState: "P",
+		RangeLeft:    200,
+	}
+	tracker := NewVampireDrainTracker(time.UTC, func(vin string) *Snapshot { return previous }, func(Event) {}, nil)
+
+	// After a restart, the wake state before the first report is unknown.
+	tracker.Observe(&Snapshot{
+		Vin:          "VIN1",
+		Timestamp:    previous.Timestamp.Add(2 * time.Hour),
+		WakeState:    "online",
+		DrivingState: "P",
+		RangeLeft:    198,
+	})
+
+	summaries := tracker.Summaries("VIN1", previous.Timestamp, previous.Timestamp)
+	if len(summaries) != 1 || len(summaries[0].ByCause) != 1 || summaries[0].ByCause[DrainAsleep] == nil {
+		t.Errorf("got summaries %+v, want the gap counted as asleep", summaries)
+	}
+}
@@ -0,0 +1,148 @@
+package car
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/kodek/tesla"
+	"github.com/pkg/errors"
+)
+
+// VehicleData is the response of the vehicle_data endpoint. It extends tesla.VehicleData with the fields that the
+// tesla library doesn't decode.
+type VehicleData struct {
+	*tesla.VehicleData
+	Extra ExtraVehicleData
+}
+
+// ExtraVehicleData holds the vehicle_data fields missing from tesla.VehicleData.
+type ExtraVehicleData struct {
+	VehicleState struct {
+		// Window positions. 0 is closed, any other value is (partially) open.
+		FdWindow int `json:"fd_window"`
+		FpWindow int `json:"fp_window"`
+		RdWindow int `json:"rd_window"`
+		RpWindow int `json:"rp_window"`
+
+		// Tire pressures in bar. Nil if the car hasn't measured them yet.
+		TpmsPressureFl    *float64 `json:"tpms_pressure_fl"`
+		TpmsPressureFr    *float64 `json:"tpms_pressure_fr"`
+		TpmsPressureRl    *float64 `json:"tpms_pressure_rl"`
+		TpmsPressureRr    *float64 `json:"tpms_pressure_rr"`
+		TpmsSoftWarningFl bool     `json:"tpms_soft_warning_fl"`
+		TpmsSoftWarningFr bool     `json:"tpms_soft_warning_fr"`
+		TpmsSoftWarningRl bool     `json:"tpms_soft_warning_rl"`
+		TpmsSoftWarningRr bool     `json:"tpms_soft_warning_rr"`
+		TpmsHardWarningFl bool     `json:"tpms_hard_warning_fl"`
+		TpmsHardWarningFr bool     `json:"tpms_hard_warning_fr"`
+		TpmsHardWarningRl bool     `json:"tpms_hard_warning_rl"`
+		TpmsHardWarningRr bool     `json:"tpms_hard_warning_rr"`
+
+		SoftwareUpdate struct {
+			// Version of the pending update, if any.
+			Version string `json:"version"`
+		} `json:"software_update"`
+	} `json:"vehicle_state"`
+	DriveState struct {
+		// Elevation in meters. Only reported by some cars and firmware versions.
+		Elevation *float64 `json:"elevation"`
+	} `json:"drive_state"`
+}
+
+// FetchVehicleData fetches all vehicle data using the active tesla.Client. It's equivalent to v.VehicleData(), but
+// also decodes the fields in ExtraVehicleData. The request is cancelled once ctx is done.
+func FetchVehicleData(ctx context.Context, v *tesla.Vehicle) (*VehicleData, error) {
+	body, err := get(ctx, tesla.ActiveClient, "/vehicles/"+strconv.FormatInt(v.ID, 10)+"/vehicle_data")
+	if err != nil {
+		return nil, err
+	}
+
+	response := &tesla.VehicleDataResponse{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+	if response.VehicleData == nil {
+		return nil, errors.New("empty vehicle_data response")
+	}
+	extraResponse := &struct {
+		Response ExtraVehicleData `json:"response"`
+	}{}
+	if err := json.Unmarshal(body, extraResponse); err != nil {
+		return nil, err
+	}
+
+	return &VehicleData{
+		VehicleData: response.VehicleData,
+		Extra:       extraResponse.Response,
+	}, nil
+}
+
+// Vehicle is an entry of the vehicle list. It extends tesla.Vehicle with the fields that the tesla library doesn't
+// decode.
+type Vehicle struct {
+	*tesla.Vehicle
+	// InService is true while the car is at a service center.
+	InService bool
+}
+
+// FetchVehicles lists the vehicles of the account. It's equivalent to tc.Vehicles(), but also decodes the fields in
+// Vehicle. Listing vehicles doesn't wake them up. The request is cancelled once ctx is done.
+func FetchVehicles(ctx context.Context, tc *tesla.Client) ([]Vehicle, error) {
+	body, err := get(ctx, tc, "/vehicles")
+	if err != nil {
+		return nil, err
+	}
+
+	response := &tesla.VehiclesResponse{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+	extraResponse := &struct {
+		Response []struct {
+			InService bool `json:"in_service"`
+		} `json:"response"`
+	}{}
+	if err := json.Unmarshal(body, extraResponse); err != nil {
+		return nil, err
+	}
+	if len(extraResponse.Response) != len(response.Response) {
+		return nil, errors.New("inconsistent vehicles response")
+	}
+
+	vehicles := make([]Vehicle, len(response.Response))
+	for i, v := range response.Response {
+		vehicles[i] = Vehicle{
+			Vehicle:   v.Vehicle,
+			InService: extraResponse.Response[i].InService,
+		}
+	}
+	return vehicles, nil
+}
+
+// get fetches the given path of the Tesla API.
+func get(ctx context.Context, client *tesla.Client, path string) ([]byte, error) {
+	if client == nil {
+		return nil, errors.New("no Tesla client")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", tesla.BaseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if client.Token != nil {
+		req.Header.Set("Authorization", "Bearer "+client.Token.AccessToken)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := client.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
@@ -0,0 +1,431 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/pkg/errors"
+)
+
+var (
+	writeBufferDepth    = expvar.NewInt("write_buffer_depth")
+	writeBufferBuffered = expvar.NewInt("write_buffer_buffered")
+	writeBufferReplayed = expvar.NewInt("write_buffer_replayed")
+	writeBufferDropped  = expvar.NewInt("write_buffer_dropped")
+)
+
+const defaultWriteBufferRetryInterval = 30 * time.Second
+
+// closeReplayTimeout bounds the last replay on Close, since writes to some databases can't be cancelled.
+const closeReplayTimeout = 2 * time.Second
+
+// Kinds of writes kept in the queue.
+const (
+	bufferedSnapshot         = "snapshot"
+	bufferedTrip             = "trip"
+	bufferedChargingSession  = "charging_session"
+	bufferedEfficiencySample = "efficiency_sample"
+	bufferedDrainSummary     = "drain_summary"
+)
+
+// bufferedDatabase persists writes to a local queue whenever the wrapped Database cannot be written to, and replays
+// them in order once it recovers. Snapshots, trips, charging sessions, efficiency samples and drain summaries are all
+// buffered. Writes only fail if the local queue itself cannot be written.
+type bufferedDatabase struct {
+	Database
+	path          string
+	queue         *sql.DB
+	maxSnapshots  int
+	retryInterval time.Duration
+
+	// mu serializes writes so that buffered items are always replayed before newer ones. It's only held for one item
+	// at a time, so that a long replay doesn't block the recorder.
+	mu      sync.Mutex
+	pending int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBufferedDatabase wraps d with a disk-backed write-ahead queue stored in a SQLite file at path. At most
+// maxSnapshots writes are kept; the oldest are dropped beyond that. A non-positive maxSnapshots means no limit.
+func NewBufferedDatabase(d Database, path string, maxSnapshots int, retryInterval time.Duration) (Database, error) {
+	queue, err := sql.Open("sqlite", fmt.Sprintf("file:%s", path))
+	if err != nil {
+		return nil, err
+	}
+	queue.SetMaxOpenConns(1)
+
+	if err := createWriteBuffer(queue); err != nil {
+		queue.Close()
+		return nil, errors.Wrap(err, "cannot create write buffer")
+	}
+
+	if retryInterval <= 0 {
+		retryInterval = defaultWriteBufferRetryInterval
+	}
+	b := &bufferedDatabase{
+		Database:      d,
+		path:          path,
+		queue:         queue,
+		maxSnapshots:  maxSnapshots,
+		retryInterval: retryInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if err := queue.QueryRow("SELECT COUNT(*) FROM pending_writes").Scan(&b.pending); err != nil {
+		queue.Close()
+		return nil, errors.Wrap(err, "cannot read write buffer")
+	}
+	writeBufferDepth.Add(b.pending)
+	if b.pending > 0 {
+		glog.Infof("Write buffer %s has %d writes left from a previous run.", path, b.pending)
+	}
+
+	go b.replayLoop()
+	return b, nil
+}
+
+// createWriteBuffer creates the queue table. Snapshots left by versions that only buffered snapshots are moved to it.
+func createWriteBuffer(queue *sql.DB) error {
+	tx, err := queue.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS pending_writes (
+		id      INTEGER PRIMARY KEY AUTOINCREMENT,
+		vin     TEXT NOT NULL,
+		kind    TEXT NOT NULL,
+		payload TEXT NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	var legacy int
+	err = tx.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'pending_snapshots'").
+		Scan(&legacy)
+	if err != nil {
+		return err
+	}
+	if legacy > 0 {
+		_, err = tx.Exec(`INSERT INTO pending_writes (vin, kind, payload)
+			SELECT vin, ?, snapshot FROM pending_snapshots ORDER BY id`, bufferedSnapshot)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DROP TABLE pending_snapshots"); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (this *bufferedDatabase) GetLatest(ctx context.Context, vin string) (*car.Snapshot, error) {
+	// Buffered snapshots are newer than anything in the wrapped database.
+	this.mu.Lock()
+	var encoded string
+	err := this.queue.QueryRowContext(ctx,
+		"SELECT payload FROM pending_writes WHERE vin = ? AND kind = ? ORDER BY id DESC LIMIT 1",
+		vin, bufferedSnapshot).Scan(&encoded)
+	this.mu.Unlock()
+	if err == sql.ErrNoRows {
+		return this.Database.GetLatest(ctx, vin)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read write buffer")
+	}
+	var snapshot car.Snapshot
+	if err := json.Unmarshal([]byte(encoded), &snapshot); err != nil {
+		return nil, errors.Wrap(err, "cannot decode buffered snapshot")
+	}
+	return &snapshot, nil
+}
+
+func (this *bufferedDatabase) Insert(ctx context.Context, snapshot car.Snapshot) error {
+	return this.bufferedWrite(ctx, snapshot.Vin, bufferedSnapshot, snapshot)
+}
+
+// InsertTrip writes a trip, buffering it like snapshots if the wrapped database is down.
+func (this *bufferedDatabase) InsertTrip(ctx context.Context, trip car.Trip) error {
+	if _, ok := this.Database.(TripStore); !ok {
+		return ErrNotSupported
+	}
+	return this.bufferedWrite(ctx, trip.Vin, bufferedTrip, trip)
+}
+
+func (this *bufferedDatabase) GetTrips(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.Trip, error) {
+	tripStore, ok := this.Database.(TripStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return tripStore.GetTrips(ctx, vin, from, to)
+}
+
+// InsertChargingSession writes a charging session, buffering it like snapshots if the wrapped database is down.
+func (this *bufferedDatabase) InsertChargingSession(ctx context.Context, session car.ChargingSession) error {
+	if _, ok := this.Database.(ChargingSessionStore); !ok {
+		return ErrNotSupported
+	}
+	return this.bufferedWrite(ctx, session.Vin, bufferedChargingSession, session)
+}
+
+func (this *bufferedDatabase) GetChargingSessions(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.ChargingSession, error) {
+	sessionStore, ok := this.Database.(ChargingSessionStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return sessionStore.GetChargingSessions(ctx, vin, from, to)
+}
+
+// InsertEfficiencySample writes an efficiency sample, buffering it like snapshots if the wrapped database is down.
+func (this *bufferedDatabase) InsertEfficiencySample(ctx context.Context, sample car.EfficiencySample) error {
+	if _, ok := this.Database.(EfficiencyStore); !ok {
+		return ErrNotSupported
+	}
+	return this.bufferedWrite(ctx, sample.Vin, bufferedEfficiencySample, sample)
+}
+
+func (this *bufferedDatabase) GetEfficiencySamples(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.EfficiencySample, error) {
+	efficiencyStore, ok := this.Database.(EfficiencyStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return efficiencyStore.GetEfficiencySamples(ctx, vin, from, to)
+}
+
+func (this *bufferedDatabase) GetChargeCompleteSnapshots(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.Snapshot, error) {
+	chargeStore, ok := this.Database.(ChargeCompleteStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return chargeStore.GetChargeCompleteSnapshots(ctx, vin, from, to)
+}
+
+// InsertDrainSummary writes a daily drain summary, buffering it like snapshots if the wrapped database is down.
+func (this *bufferedDatabase) InsertDrainSummary(ctx context.Context, summary car.DailyDrainSummary) error {
+	if _, ok := this.Database.(DrainSummaryStore); !ok {
+		return ErrNotSupported
+	}
+	return this.bufferedWrite(ctx, summary.Vin, bufferedDrainSummary, summary)
+}
+
+func (this *bufferedDatabase) GetDrainSummaries(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.DailyDrainSummary, error) {
+	drainStore, ok := this.Database.(DrainSummaryStore)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return drainStore.GetDrainSummaries(ctx, vin, from, to)
+}
+
+// bufferedWrite writes an item to the wrapped database, or queues it if the database is down or older items are
+// still queued.
+func (this *bufferedDatabase) bufferedWrite(ctx context.Context, vin string, kind string, item interface{}) error {
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		return errors.Wrapf(err, "cannot encode %s", kind)
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	if this.pending == 0 {
+		err := this.write(ctx, kind, encoded)
+		if err == nil {
+			return nil
+		}
+		glog.Errorf("Database write failed. Buffering writes in %s until it recovers: %s", this.path, err)
+	}
+	return this.enqueue(ctx, vin, kind, encoded)
+}
+
+// write decodes a queued item and writes it to the wrapped database.
+func (this *bufferedDatabase) write(ctx context.Context, kind string, encoded []byte) error {
+	switch kind {
+	case bufferedSnapshot:
+		var snapshot car.Snapshot
+		if err := json.Unmarshal(encoded, &snapshot); err != nil {
+			return errUndecodable{err}
+		}
+		return this.Database.Insert(ctx, snapshot)
+	case bufferedTrip:
+		var trip car.Trip
+		if err := json.Unmarshal(encoded, &trip); err != nil {
+			return errUndecodable{err}
+		}
+		return this.Database.(TripStore).InsertTrip(ctx, trip)
+	case bufferedChargingSession:
+		var session car.ChargingSession
+		if err := json.Unmarshal(encoded, &session); err != nil {
+			return errUndecodable{err}
+		}
+		return this.Database.(ChargingSessionStore).InsertChargingSession(ctx, session)
+	case bufferedEfficiencySample:
+		var sample car.EfficiencySample
+		if err := json.Unmarshal(encoded, &sample); err != nil {
+			return errUndecodable{err}
+		}
+		return this.Database.(EfficiencyStore).InsertEfficiencySample(ctx, sample)
+	case bufferedDrainSummary:
+		var summary car.DailyDrainSummary
+		if err := json.Unmarshal(encoded, &summary); err != nil {
+			return errUndecodable{err}
+		}
+		return this.Database.(DrainSummaryStore).InsertDrainSummary(ctx, summary)
+	}
+	return errUndecodable{errors.Errorf("unknown kind %q", kind)}
+}
+
+// errUndecodable is returned by write for queued items that can never be written.
+type errUndecodable struct {
+	error
+}
+
+// enqueue appends an item to the local queue, dropping the oldest ones if it's full. mu must be held.
+func (this *bufferedDatabase) enqueue(ctx context.Context, vin string, kind string, encoded []byte) error {
+	_, err := this.queue.ExecContext(ctx,
+		"INSERT INTO pending_writes (vin, kind, payload) VALUES (?, ?, ?)", vin, kind, string(encoded))
+	if err != nil {
+		return errors.Wrapf(err, "cannot write %s to write buffer", kind)
+	}
+	this.pending++
+	writeBufferDepth.Add(1)
+	writeBufferBuffered.Add(1)
+
+	if this.maxSnapshots > 0 && this.pending > int64(this.maxSnapshots) {
+		overflow := this.pending - int64(this.maxSnapshots)
+		res, err := this.queue.ExecContext(ctx,
+			"DELETE FROM pending_writes WHERE id IN (SELECT id FROM pending_writes ORDER BY id LIMIT ?)",
+			overflow)
+		if err != nil {
+			return errors.Wrap(err, "cannot trim write buffer")
+		}
+		dropped, _ := res.RowsAffected()
+		glog.Errorf("Write buffer %s is full. Dropped the %d oldest writes.", this.path, dropped)
+		this.pending -= dropped
+		writeBufferDepth.Add(-dropped)
+		writeBufferDropped.Add(dropped)
+	}
+	return nil
+}
+
+// replayLoop periodically flushes the queue until Close is called.
+func (this *bufferedDatabase) replayLoop() {
+	defer close(this.done)
+	ticker := time.NewTicker(this.retryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			if err := this.replay(context.Background()); err != nil {
+				glog.Errorf("Cannot replay write buffer %s yet: %s", this.path, err)
+			}
+		}
+	}
+}
+
+// replay writes buffered items to the wrapped database, oldest first, until the queue is empty or a write fails.
+func (this *bufferedDatabase) replay(ctx context.Context) error {
+	this.mu.Lock()
+	pending := this.pending
+	this.mu.Unlock()
+	if pending == 0 {
+		return nil
+	}
+
+	glog.Infof("Replaying %d buffered writes from %s.", pending, this.path)
+	for {
+		empty, err := this.replayOldest(ctx)
+		if err != nil {
+			return err
+		}
+		if empty {
+			glog.Infof("Write buffer %s is empty.", this.path)
+			return nil
+		}
+	}
+}
+
+// replayOldest writes the oldest buffered item to the wrapped database and removes it from the queue. It returns true
+// once the queue is empty.
+func (this *bufferedDatabase) replayOldest(ctx context.Context) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.pending == 0 {
+		return true, nil
+	}
+	var id int64
+	var kind, encoded string
+	err := this.queue.QueryRowContext(ctx,
+		"SELECT id, kind, payload FROM pending_writes ORDER BY id LIMIT 1").Scan(&id, &kind, &encoded)
+	if err == sql.ErrNoRows {
+		writeBufferDepth.Add(-this.pending)
+		this.pending = 0
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "cannot read write buffer")
+	}
+
+	if err := this.write(ctx, kind, []byte(encoded)); err != nil {
+		if _, ok := err.(errUndecodable); !ok {
+			return false, err
+		}
+		glog.Errorf("Dropping undecodable buffered %s %d: %s", kind, id, err)
+		writeBufferDropped.Add(1)
+	} else {
+		writeBufferReplayed.Add(1)
+	}
+
+	if _, err := this.queue.ExecContext(ctx, "DELETE FROM pending_writes WHERE id = ?", id); err != nil {
+		return false, errors.Wrapf(err, "cannot remove replayed %s from write buffer", kind)
+	}
+	this.pending--
+	writeBufferDepth.Add(-1)
+	return this.pending == 0, nil
+}
+
+// Close makes a last attempt to flush the queue for up to closeReplayTimeout, then closes both the queue and the
+// wrapped database. Writes that could not be flushed stay on disk for the next run.
+func (this *bufferedDatabase) Close() error {
+	close(this.stop)
+	<-this.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeReplayTimeout)
+	defer cancel()
+	replayed := make(chan error, 1)
+	go func() {
+		replayed <- this.replay(ctx)
+	}()
+	select {
+	case err := <-replayed:
+		if err != nil {
+			this.mu.Lock()
+			glog.Errorf("Closing with %d writes left in write buffer %s: %s", this.pending, this.path, err)
+			this.mu.Unlock()
+		}
+	case <-ctx.Done():
+		// The replay may be stuck in a write, holding mu. Whatever it doesn't remove from the queue is kept.
+		glog.Errorf("Write buffer %s wasn't replayed within %s. Leaving the remaining writes for the next run.",
+			this.path, closeReplayTimeout)
+	}
+	queueErr := this.queue.Close()
+	if err := this.Database.Close(); err != nil {
+		return err
+	}
+	return queueErr
+}
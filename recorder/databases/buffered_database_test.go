@@ -0,0 +1,337 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/pkg/errors"
+)
+
+// flakyDatabase is an in-memory Database that fails every write while down is set.
+type flakyDatabase struct {
+	mu        sync.Mutex
+	down      bool
+	writes    []string
+	snapshots []car.Snapshot
+	trips     []car.Trip
+	sessions  []car.ChargingSession
+	samples   []car.EfficiencySample
+}
+
+func (f *flakyDatabase) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *flakyDatabase) written() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.writes...)
+}
+
+func (f *flakyDatabase) record(kind string, store func()) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errors.New("database is down")
+	}
+	f.writes = append(f.writes, kind)
+	store()
+	return nil
+}
+
+func (f *flakyDatabase) GetLatest(ctx context.Context, vin string) (*car.Snapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.snapshots) - 1; i >= 0; i-- {
+		if f.snapshots[i].Vin == vin {
+			return &f.snapshots[i], nil
+		}
+	}
+	return nil, ErrNoData
+}
+
+func (f *flakyDatabase) Insert(ctx context.Context, snapshot car.Snapshot) error {
+	return f.record(bufferedSnapshot, func() { f.snapshots = append(f.snapshots, snapshot) })
+}
+
+func (f *flakyDatabase) InsertTrip(ctx context.Context, trip car.Trip) error {
+	return f.record(bufferedTrip, func() { f.trips = append(f.trips, trip) })
+}
+
+func (f *flakyDatabase) GetTrips(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.Trip, error) {
+	return f.trips, nil
+}
+
+func (f *flakyDatabase) InsertChargingSession(ctx context.Context, session car.ChargingSession) error {
+	return f.record(bufferedChargingSession, func() { f.sessions = append(f.sessions, session) })
+}
+
+func (f *flakyDatabase) GetChargingSessions(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.ChargingSession, error) {
+	return f.sessions, nil
+}
+
+func (f *flakyDatabase) InsertEfficiencySample(ctx context.Context, sample car.EfficiencySample) error {
+	return f.record(bufferedEfficiencySample, func() { f.samples = append(f.samples, sample) })
+}
+
+func (f *flakyDatabase) GetEfficiencySamples(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.EfficiencySample, error) {
+	return f.samples, nil
+}
+
+func (f *flakyDatabase) Close() error {
+	return nil
+}
+
+// bufferPath returns the path of a write buffer in a temporary directory.
+func bufferPath(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "write_buffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "buffer.db")
+}
+
+func openBuffered(t *testing.T, d Database, path string) *bufferedDatabase {
+	t.Helper()
+	// Replays are triggered by the test.
+	b, err := NewBufferedDatabase(d, path, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.(*bufferedDatabase)
+}
+
+func TestBufferedDatabaseReplaysAllKindsInOrder(t *testing.T) {
+	ctx := context.Background()
+	inner := &flakyDatabase{down: true}
+	b := openBuffered(t, inner, bufferPath(t))
+	defer b.Close()
+
+	start := time.Date(2020, 5, 2, 10, 0, 0, 0, time.UTC)
+	if err := b.Insert(ctx, car.Snapshot{Vin: "VIN1", Timestamp: start, BatteryLevel: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.InsertTrip(ctx, car.Trip{Vin: "VIN1", StartTime: start, EndOdometer: 12}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.InsertChargingSession(ctx, car.ChargingSession{Vin: "VIN1", EnergyAdded: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.InsertEfficiencySample(ctx, car.EfficiencySample{Vin: "VIN1", Distance: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := inner.written(); len(got) != 0 {
+		t.Fatalf("wrote %v while the database was down", got)
+	}
+
+	// The buffered snapshot is served before it reaches the database.
+	latest, err := b.GetLatest(ctx, "VIN1")
+	if err != nil || latest.BatteryLevel != 80 {
+		t.Errorf("GetLatest() = %+v, %v; want the buffered snapshot", latest, err)
+	}
+
+	if err := b.replay(ctx); err == nil {
+		t.Error("replay() succeeded while the database was down")
+	}
+	inner.setDown(false)
+	// Writes arriving while older ones are queued go behind them.
+	if err := b.Insert(ctx, car.Snapshot{Vin: "VIN1", Timestamp: start.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := inner.written(); len(got) != 0 {
+		t.Fatalf("wrote %v before replaying older writes", got)
+	}
+	if err := b.replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		bufferedSnapshot, bufferedTrip, bufferedChargingSession, bufferedEfficiencySample, bufferedSnapshot,
+	}
+	if got := inner.written(); !equalStrings(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+	if len(inner.trips) != 1 || inner.trips[0].EndOdometer != 12 || !inner.trips[0].StartTime.Equal(start) {
+		t.Errorf("replayed trips = %+v", inner.trips)
+	}
+	if len(inner.sessions) != 1 || inner.sessions[0].EnergyAdded != 20 {
+		t.Errorf("replayed charging sessions = %+v", inner.sessions)
+	}
+	if b.pending != 0 {
+		t.Errorf("%d writes still pending", b.pending)
+	}
+
+	// Once the queue is empty, writes go straight to the database.
+	if err := b.InsertTrip(ctx, car.Trip{Vin: "VIN1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := inner.written(); len(got) != len(want)+1 {
+		t.Errorf("wrote %v, want the new trip written immediately", got)
+	}
+}
+
+func TestBufferedDatabaseDoesNotBlockWritesDuringReplay(t *testing.T) {
+	ctx := context.Background()
+	inner := &flakyDatabase{down: true}
+	b := openBuffered(t, inner, bufferPath(t))
+	defer b.Close()
+
+	for i := 0; i < 200; i++ {
+		if err := b.Insert(ctx, car.Snapshot{Vin: "VIN1", Timestamp: time.Unix(int64(i), 0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inner.setDown(false)
+
+	replayed := make(chan error)
+	go func() {
+		replayed <- b.replay(ctx)
+	}()
+	for i := 200; i < 250; i++ {
+		if err := b.Insert(ctx, car.Snapshot{Vin: "VIN1", Timestamp: time.Unix(int64(i), 0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-replayed; err != nil {
+		t.Fatal(err)
+	}
+	// Writes queued after the replay finished are left for the next one.
+	if err := b.replay(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inner.snapshots) != 250 {
+		t.Fatalf("wrote %d snapshots, want 250", len(inner.snapshots))
+	}
+	for i, s := range inner.snapshots {
+		if s.Timestamp.Unix() != int64(i) {
+			t.Fatalf("snapshot %d has timestamp %d; writes are out of order", i, s.Timestamp.Unix())
+		}
+	}
+}
+
+func TestBufferedDatabaseUpgradesSnapshotQueue(t *testing.T) {
+	path := bufferPath(t)
+	legacy, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = legacy.Exec(`CREATE TABLE pending_snapshots (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		vin      TEXT NOT NULL,
+		snapshot TEXT NOT NULL
+	)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, level := range []int{50, 60} {
+		encoded, _ := json.Marshal(car.Snapshot{Vin: "VIN1", BatteryLevel: level})
+		if _, err := legacy.Exec("INSERT INTO pending_snapshots (vin, snapshot) VALUES (?, ?)", "VIN1",
+			string(encoded)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy.Close()
+
+	inner := &flakyDatabase{}
+	b := openBuffered(t, inner, path)
+	defer b.Close()
+	if b.pending != 2 {
+		t.Fatalf("pending = %d, want the 2 snapshots of the old queue", b.pending)
+	}
+	if err := b.replay(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(inner.snapshots) != 2 || inner.snapshots[0].BatteryLevel != 50 || inner.snapshots[1].BatteryLevel != 60 {
+		t.Errorf("replayed %+v", inner.snapshots)
+	}
+}
+
+func TestBufferedSinksDontHoldBackEachOther(t *testing.T) {
+	ctx := context.Background()
+	path := bufferPath(t)
+	down := &flakyDatabase{down: true}
+	up := &flakyDatabase{}
+	database, err := NewFanOutDatabase([]FanOutSink{
+		{Name: "down", Database: openBuffered(t, down, sinkBufferPath(path, "down")), Policy: FailFast},
+		{Name: "up", Database: openBuffered(t, up, sinkBufferPath(path, "up")), Policy: FailFast},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := database.Insert(ctx, car.Snapshot{Vin: "VIN1", Timestamp: time.Unix(int64(i), 0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(up.snapshots) != 3 {
+		t.Errorf("healthy sink got %d snapshots, want all 3 while the other sink is down", len(up.snapshots))
+	}
+	if len(down.snapshots) != 0 {
+		t.Errorf("broken sink got %d snapshots", len(down.snapshots))
+	}
+}
+
+// stuckDatabase is a Database whose writes block until unblock is closed, regardless of their context.
+type stuckDatabase struct {
+	flakyDatabase
+	unblock chan struct{}
+}
+
+func (s *stuckDatabase) Insert(ctx context.Context, snapshot car.Snapshot) error {
+	<-s.unblock
+	return s.flakyDatabase.Insert(ctx, snapshot)
+}
+
+func TestBufferedDatabaseCloseDoesNotWaitForStuckWrites(t *testing.T) {
+	ctx := context.Background()
+	path := bufferPath(t)
+	inner := &stuckDatabase{unblock: make(chan struct{})}
+	defer close(inner.unblock)
+	b := openBuffered(t, inner, path)
+	// Queue a write without trying the database.
+	encoded, _ := json.Marshal(car.Snapshot{Vin: "VIN1", BatteryLevel: 50})
+	if err := b.enqueue(ctx, "VIN1", bufferedSnapshot, encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	b.Close()
+	if elapsed := time.Since(start); elapsed > closeReplayTimeout+time.Second {
+		t.Errorf("Close() took %s", elapsed)
+	}
+
+	reopened := openBuffered(t, &flakyDatabase{}, path)
+	defer reopened.Close()
+	if reopened.pending != 1 {
+		t.Errorf("pending = %d after reopening, want the write left on disk", reopened.pending)
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
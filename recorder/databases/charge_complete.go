@@ -0,0 +1,36 @@
+package databases
+
+import (
+	"time"
+
+	"github.com/kodek/tesler/recorder/car"
+)
+
+// chargeCompleteSnapshot builds a snapshot returned by GetChargeCompleteSnapshots from the charge fields of a
+// snapshot.
+func chargeCompleteSnapshot(vin string, timestamp time.Time, f fieldValues, odometer float64) car.Snapshot {
+	return car.Snapshot{
+		Timestamp:     timestamp,
+		Vin:           vin,
+		ChargingState: car.ChargeComplete,
+		BatteryLevel:  f.int("batt_level"),
+		RangeLeft:     f.float("range_left"),
+		Odometer:      odometer,
+	}
+}
+
+// odometerDay is the key of the daily odometer readings in InfluxDB: the date in UTC.
+func odometerDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// dailyOdometers indexes the highest odometer reading of each day, given points with a time and an "odometer" field.
+func dailyOdometers(points []fieldValues) map[string]float64 {
+	odometers := make(map[string]float64, len(points))
+	for _, point := range points {
+		if point.has("odometer") {
+			odometers[odometerDay(point.time())] = point.float("odometer")
+		}
+	}
+	return odometers
+}
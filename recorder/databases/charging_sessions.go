@@ -0,0 +1,76 @@
+package databases
+
+import (
+	"time"
+
+	"github.com/kodek/tesler/recorder/car"
+)
+
+// chargingSessionMeasurement is the InfluxDB measurement holding charging sessions. Points are timestamped with the
+// session's start.
+const chargingSessionMeasurement = "charging_session"
+
+// chargingSessionFields returns the fields of a charging session, named alike in InfluxDB and SQL. The VIN, car name
+// and start and end times are left to each backend.
+func chargingSessionFields(session car.ChargingSession) map[string]interface{} {
+	return map[string]interface{}{
+		"latitude":           session.Location.Latitude,
+		"longitude":          session.Location.Longitude,
+		"place":              session.Place,
+		"start_batt_level":   session.StartBatteryLevel,
+		"end_batt_level":     session.EndBatteryLevel,
+		"end_range":          session.EndRange,
+		"odometer":           session.Odometer,
+		"charge_limit_soc":   session.ChargeLimitSoc,
+		"energy_added_kwh":   session.EnergyAdded,
+		"peak_power":         session.PeakPower,
+		"avg_power":          session.AveragePower,
+		"dc":                 session.DC,
+		"fast_charger_type":  session.FastChargerType,
+		"fast_charger_brand": session.FastChargerBrand,
+		"reached_limit":      session.ReachedLimit,
+		"duration_sec":       int64(session.Duration().Seconds()),
+		"cost":               session.Cost,
+		"currency":           session.Currency,
+	}
+}
+
+// chargingSessionFromFields is the inverse of chargingSessionFields.
+func chargingSessionFromFields(vin string, startTime time.Time, endTime time.Time,
+	f fieldValues) car.ChargingSession {
+	return car.ChargingSession{
+		Vin:               vin,
+		CarName:           f.string("car_name"),
+		StartTime:         startTime,
+		EndTime:           endTime,
+		Location:          car.Location{Latitude: f.float("latitude"), Longitude: f.float("longitude")},
+		Place:             f.string("place"),
+		StartBatteryLevel: f.int("start_batt_level"),
+		EndBatteryLevel:   f.int("end_batt_level"),
+		EndRange:          f.float("end_range"),
+		Odometer:          f.float("odometer"),
+		ChargeLimitSoc:    f.int("charge_limit_soc"),
+		EnergyAdded:       f.float("energy_added_kwh"),
+		PeakPower:         f.float("peak_power"),
+		AveragePower:      f.float("avg_power"),
+		DC:                f.bool("dc"),
+		FastChargerType:   f.string("fast_charger_type"),
+		FastChargerBrand:  f.string("fast_charger_brand"),
+		ReachedLimit:      f.bool("reached_limit"),
+		Cost:              f.float("cost"),
+		Currency:          f.string("currency"),
+	}
+}
+
+// influxChargingSessionFields returns the fields of a charging session's InfluxDB point. The end time is stored as
+// Unix seconds.
+func influxChargingSessionFields(session car.ChargingSession) map[string]interface{} {
+	fields := chargingSessionFields(session)
+	fields["end_time"] = session.EndTime.Unix()
+	return fields
+}
+
+// chargingSessionFromPoint decodes a charging session read back from InfluxDB.
+func chargingSessionFromPoint(vin string, point fieldValues) car.ChargingSession {
+	return chargingSessionFromFields(vin, point.time(), time.Unix(int64(point.float("end_time")), 0), point)
+}
@@ -2,14 +2,203 @@ package databases
 
 import (
 	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/golang/glog"
+	"github.com/kodek/tesler/common"
 	"github.com/kodek/tesler/recorder/car"
+	"github.com/pkg/errors"
 )
 
+// ErrNoData is returned when a query finds nothing recorded for the requested car.
+var ErrNoData = errors.New("no data recorded")
+
+// ErrNotSupported is returned by wrapping databases when the wrapped database lacks an optional capability.
+var ErrNotSupported = errors.New("not supported by this database")
+
 type Database interface {
-	GetLatest(ctx context.Context) (*car.Snapshot, error)
+	// GetLatest returns the most recent snapshot recorded for the given VIN, or ErrNoData if there is none.
+	GetLatest(ctx context.Context, vin string) (*car.Snapshot, error)
 
 	Insert(ctx context.Context, info car.Snapshot) error
 
 	Close() error
 }
+
+// TripStore is implemented by databases that can store trips.
+type TripStore interface {
+	InsertTrip(ctx context.Context, trip car.Trip) error
+
+	// GetTrips returns the trips of a car that started within [from, to], oldest first.
+	GetTrips(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.Trip, error)
+}
+
+// ChargingSessionStore is implemented by databases that can store charging sessions.
+type ChargingSessionStore interface {
+	InsertChargingSession(ctx context.Context, session car.ChargingSession) error
+
+	// GetChargingSessions returns the charging sessions of a car that started within [from, to], oldest first.
+	GetChargingSessions(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.ChargingSession, error)
+}
+
+// EfficiencyStore is implemented by databases that can store efficiency samples.
+type EfficiencyStore interface {
+	InsertEfficiencySample(ctx context.Context, sample car.EfficiencySample) error
+
+	// GetEfficiencySamples returns the efficiency samples of a car taken within [from, to], oldest first.
+	GetEfficiencySamples(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.EfficiencySample, error)
+}
+
+// ChargeCompleteStore is implemented by databases that can find the snapshots taken once cars finished charging.
+type ChargeCompleteStore interface {
+	// GetChargeCompleteSnapshots returns the snapshots of a car taken within [from, to] while its charging state was
+	// car.ChargeComplete, oldest first. Only the timestamp, charging state, battery level, range and odometer are
+	// filled in. InfluxDB backends take the odometer from the highest reading of the day (UTC).
+	GetChargeCompleteSnapshots(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.Snapshot, error)
+}
+
+// DrainSummaryStore is implemented by databases that can store daily vampire drain summaries.
+type DrainSummaryStore interface {
+	// InsertDrainSummary stores the summary of a day, replacing the one stored before for the same car and day.
+	InsertDrainSummary(ctx context.Context, summary car.DailyDrainSummary) error
+
+	// GetDrainSummaries returns the summaries of a car for the days within [from, to], oldest first. Days are compared
+	// by their date, taken as midnight UTC.
+	GetDrainSummaries(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.DailyDrainSummary, error)
+}
+
+// OpenDatabaseFromConfig opens the storage backend selected in the recorder's configuration. If several sinks are
+// configured, they're combined into a single fan-out Database. If a write buffer is configured, every sink gets its
+// own, so that a sink that's down doesn't hold back writes to the others.
+func OpenDatabaseFromConfig(conf common.Configuration) (Database, error) {
+	recorderConf := conf.Recorder
+	bufferConf := recorderConf.WriteBuffer
+	if len(recorderConf.Sinks) == 0 {
+		return openBufferedSink(common.DatabaseSink{
+			Database:        recorderConf.Database,
+			InfluxDbConfig:  recorderConf.InfluxDbConfig,
+			InfluxDb2Config: recorderConf.InfluxDb2Config,
+			SqliteConfig:    recorderConf.SqliteConfig,
+			PostgresConfig:  recorderConf.PostgresConfig,
+		}, bufferConf, bufferConf.Path)
+	}
+
+	var sinks []FanOutSink
+	closeAll := func() {
+		for _, s := range sinks {
+			s.Database.Close()
+		}
+	}
+	for _, sinkConf := range recorderConf.Sinks {
+		policy, err := parseErrorPolicy(sinkConf.ErrorPolicy)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		name := sinkConf.Name
+		if name == "" {
+			name = sinkDatabaseType(sinkConf)
+		}
+		database, err := openBufferedSink(sinkConf, bufferConf, sinkBufferPath(bufferConf.Path, name))
+		if err != nil {
+			closeAll()
+			return nil, errors.Wrapf(err, "cannot open database sink %s", name)
+		}
+		sinks = append(sinks, FanOutSink{
+			Name:     name,
+			Database: database,
+			Policy:   policy,
+		})
+	}
+	database, err := NewFanOutDatabase(sinks)
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return database, nil
+}
+
+// sinkBufferPath returns the path of the write buffer of a sink, e.g. "buffer-influxdb.db" for "buffer.db". Returns ""
+// if buffering is disabled.
+func sinkBufferPath(path string, name string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), name, ext)
+}
+
+// openBufferedSink opens a single storage backend behind a write buffer at bufferPath. If bufferPath is empty, the
+// backend isn't buffered.
+func openBufferedSink(conf common.DatabaseSink, bufferConf common.WriteBufferConfig,
+	bufferPath string) (Database, error) {
+	database, err := openSink(conf, bufferPath != "")
+	if err != nil || bufferPath == "" {
+		return database, err
+	}
+	buffered, err := NewBufferedDatabase(
+		database,
+		bufferPath,
+		bufferConf.MaxSnapshots,
+		time.Duration(bufferConf.RetryIntervalSeconds)*time.Second)
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+	return buffered, nil
+}
+
+func sinkDatabaseType(conf common.DatabaseSink) string {
+	if conf.Database == "" {
+		return "influxdb"
+	}
+	return conf.Database
+}
+
+// openSink opens a single storage backend. If it'll be behind a write buffer, batching is disabled, since failed
+// batches are retried in the background where the buffer doesn't see them.
+func openSink(conf common.DatabaseSink, buffered bool) (Database, error) {
+	switch sinkDatabaseType(conf) {
+	case "influxdb":
+		influxConf := conf.InfluxDbConfig
+		batchSize := influxConf.BatchSize
+		if buffered && batchSize > 1 {
+			glog.Warning("Ignoring InfluxDbConfig.BatchSize: batched points aren't covered by the write buffer.")
+			batchSize = 1
+		}
+		// TODO: Check that config isn't empty/missing.
+		return OpenInfluxDbDatabase(
+			influxConf.Address,
+			influxConf.Username,
+			influxConf.Password,
+			influxConf.Database,
+			batchSize,
+			time.Duration(influxConf.FlushIntervalSeconds)*time.Second)
+	case "influxdb2":
+		influx2Conf := conf.InfluxDb2Config
+		return OpenInfluxDb2Database(influx2Conf.Address, influx2Conf.Org, influx2Conf.Bucket, influx2Conf.Token)
+	case "sqlite":
+		if conf.SqliteConfig.Path == "" {
+			return nil, errors.New("SqliteConfig.Path must be set to use sqlite")
+		}
+		return OpenSqliteDatabase(conf.SqliteConfig.Path)
+	case "postgres":
+		return OpenPostgresDatabase(conf.PostgresConfig)
+	default:
+		return nil, errors.Errorf("unknown database type %q", conf.Database)
+	}
+}
+
+func parseErrorPolicy(policy string) (ErrorPolicy, error) {
+	switch policy {
+	case "", "fail_fast":
+		return FailFast, nil
+	case "best_effort":
+		return BestEffort, nil
+	default:
+		return FailFast, errors.Errorf("unknown error policy %q", policy)
+	}
+}
@@ -0,0 +1,61 @@
+package databases
+
+import (
+	"time"
+
+	"github.com/kodek/tesler/recorder/car"
+)
+
+// drainMeasurement is the InfluxDB measurement holding daily vampire drain summaries.
+const drainMeasurement = "vampire_drain"
+
+// drainCauses lists the causes stored with each summary.
+var drainCauses = []string{car.DrainSentry, car.DrainClimate, car.DrainAwake, car.DrainAsleep}
+
+// drainSummaryTime is the timestamp a summary is stored at: midnight UTC of its date. Storing a summary again for the
+// same day replaces it.
+func drainSummaryTime(summary car.DailyDrainSummary) time.Time {
+	t, _ := time.Parse("2006-01-02", summary.Date)
+	return t
+}
+
+// drainSummaryFields returns the fields of a daily drain summary, named alike in InfluxDB and SQL. The VIN, car name
+// and timestamp are left to each backend.
+func drainSummaryFields(summary car.DailyDrainSummary) map[string]interface{} {
+	fields := map[string]interface{}{
+		"date":       summary.Date,
+		"hours":      summary.Total.Hours,
+		"range_lost": summary.Total.RangeLost,
+		"soc_lost":   summary.Total.SocLost,
+		"complete":   summary.Complete,
+	}
+	for _, cause := range drainCauses {
+		if stats, ok := summary.ByCause[cause]; ok {
+			fields[cause+"_hours"] = stats.Hours
+			fields[cause+"_range_lost"] = stats.RangeLost
+			fields[cause+"_soc_lost"] = stats.SocLost
+		}
+	}
+	return fields
+}
+
+// drainSummaryFromFields is the inverse of drainSummaryFields.
+func drainSummaryFromFields(vin string, f fieldValues) car.DailyDrainSummary {
+	summary := car.DailyDrainSummary{
+		Vin:      vin,
+		CarName:  f.string("car_name"),
+		Date:     f.string("date"),
+		ByCause:  make(map[string]*car.DrainStats),
+		Complete: f.bool("complete"),
+	}
+	summary.Total.Add(f.float("hours"), f.float("range_lost"), f.float("soc_lost"))
+	for _, cause := range drainCauses {
+		if !f.has(cause + "_hours") {
+			continue
+		}
+		stats := &car.DrainStats{}
+		stats.Add(f.float(cause+"_hours"), f.float(cause+"_range_lost"), f.float(cause+"_soc_lost"))
+		summary.ByCause[cause] = stats
+	}
+	return summary
+}
@@ -0,0 +1,43 @@
+package databases
+
+import (
+	"time"
+
+	"github.com/kodek/tesler/recorder/car"
+)
+
+// efficiencyMeasurement is the InfluxDB measurement holding efficiency samples.
+const efficiencyMeasurement = "efficiency"
+
+// efficiencyFields returns the fields of an efficiency sample, named alike in InfluxDB and SQL. The VIN, car name and
+// timestamp are left to each backend.
+func efficiencyFields(sample car.EfficiencySample) map[string]interface{} {
+	fields := map[string]interface{}{
+		"duration_sec":    sample.Duration.Seconds(),
+		"distance":        sample.Distance,
+		"energy_used_kwh": sample.EnergyUsed,
+		"avg_speed":       sample.AverageSpeed(),
+		"wh_per_mile":     car.WhPerMile(sample.EnergyUsed, sample.Distance),
+	}
+	if sample.OutsideTemp != nil {
+		fields["outside_temp"] = *sample.OutsideTemp
+	}
+	return fields
+}
+
+// efficiencyFromFields is the inverse of efficiencyFields.
+func efficiencyFromFields(vin string, timestamp time.Time, f fieldValues) car.EfficiencySample {
+	sample := car.EfficiencySample{
+		Vin:        vin,
+		CarName:    f.string("car_name"),
+		Timestamp:  timestamp,
+		Duration:   time.Duration(f.float("duration_sec") * float64(time.Second)),
+		Distance:   f.float("distance"),
+		EnergyUsed: f.float("energy_used_kwh"),
+	}
+	if f.has("outside_temp") {
+		temp := f.float("outside_temp")
+		sample.OutsideTemp = &temp
+	}
+	return sample
+}
@@ -0,0 +1,225 @@
+package databases
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/pkg/errors"
+)
+
+var (
+	sinkWrites      = expvar.NewMap("database_sink_writes")
+	sinkWriteErrors = expvar.NewMap("database_sink_write_errors")
+)
+
+// ErrorPolicy decides what a fan-out database does when one of its sinks fails.
+type ErrorPolicy int
+
+const (
+	// FailFast sinks fail the whole Insert when they fail. The sinks after them aren't written to.
+	FailFast ErrorPolicy = iota
+	// BestEffort sinks only log and count their errors.
+	BestEffort
+)
+
+// FanOutSink is a named Database written to by a fan-out database.
+type FanOutSink struct {
+	Name     string
+	Database Database
+	Policy   ErrorPolicy
+}
+
+// fanOutDatabase writes every snapshot to its sinks, in order. Reads are served by the first sink that has data.
+type fanOutDatabase struct {
+	sinks []FanOutSink
+}
+
+// NewFanOutDatabase combines several sinks into a single Database. Sink names must be unique.
+func NewFanOutDatabase(sinks []FanOutSink) (Database, error) {
+	if len(sinks) == 0 {
+		return nil, errors.New("fan-out database needs at least one sink")
+	}
+	names := make(map[string]bool)
+	for _, s := range sinks {
+		if names[s.Name] {
+			return nil, errors.Errorf("duplicate database sink name %q", s.Name)
+		}
+		names[s.Name] = true
+	}
+	return &fanOutDatabase{
+		sinks: sinks,
+	}, nil
+}
+
+func (this *fanOutDatabase) GetLatest(ctx context.Context, vin string) (*car.Snapshot, error) {
+	var lastErr error
+	for _, s := range this.sinks {
+		snapshot, err := s.Database.GetLatest(ctx, vin)
+		if err == nil {
+			return snapshot, nil
+		}
+		if errors.Cause(err) != ErrNoData {
+			glog.Errorf("Cannot read latest snapshot from sink %s: %s", s.Name, err)
+		}
+		lastErr = errors.Wrapf(err, "sink %s", s.Name)
+	}
+	return nil, lastErr
+}
+
+func (this *fanOutDatabase) Insert(ctx context.Context, snapshot car.Snapshot) error {
+	for _, s := range this.sinks {
+		err := s.Database.Insert(ctx, snapshot)
+		if err == nil {
+			sinkWrites.Add(s.Name, 1)
+			continue
+		}
+		sinkWriteErrors.Add(s.Name, 1)
+		if s.Policy == BestEffort {
+			glog.Errorf("Ignoring write error from best-effort sink %s: %s", s.Name, err)
+			continue
+		}
+		return errors.Wrapf(err, "sink %s", s.Name)
+	}
+	return nil
+}
+
+// InsertTrip writes a trip to every sink that can store trips.
+func (this *fanOutDatabase) InsertTrip(ctx context.Context, trip car.Trip) error {
+	return this.writeOptional("trip", func(d Database) (bool, error) {
+		tripStore, ok := d.(TripStore)
+		if !ok {
+			return false, nil
+		}
+		return true, tripStore.InsertTrip(ctx, trip)
+	})
+}
+
+// GetTrips reads trips from the first sink that can store them.
+func (this *fanOutDatabase) GetTrips(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.Trip, error) {
+	for _, s := range this.sinks {
+		if tripStore, ok := s.Database.(TripStore); ok {
+			trips, err := tripStore.GetTrips(ctx, vin, from, to)
+			return trips, errors.Wrapf(err, "sink %s", s.Name)
+		}
+	}
+	return nil, ErrNotSupported
+}
+
+// InsertChargingSession writes a charging session to every sink that can store them.
+func (this *fanOutDatabase) InsertChargingSession(ctx context.Context, session car.ChargingSession) error {
+	return this.writeOptional("charging session", func(d Database) (bool, error) {
+		sessionStore, ok := d.(ChargingSessionStore)
+		if !ok {
+			return false, nil
+		}
+		return true, sessionStore.InsertChargingSession(ctx, session)
+	})
+}
+
+// GetChargingSessions reads charging sessions from the first sink that can store them.
+func (this *fanOutDatabase) GetChargingSessions(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.ChargingSession, error) {
+	for _, s := range this.sinks {
+		if sessionStore, ok := s.Database.(ChargingSessionStore); ok {
+			sessions, err := sessionStore.GetChargingSessions(ctx, vin, from, to)
+			return sessions, errors.Wrapf(err, "sink %s", s.Name)
+		}
+	}
+	return nil, ErrNotSupported
+}
+
+// InsertEfficiencySample writes an efficiency sample to every sink that can store them.
+func (this *fanOutDatabase) InsertEfficiencySample(ctx context.Context, sample car.EfficiencySample) error {
+	return this.writeOptional("efficiency sample", func(d Database) (bool, error) {
+		efficiencyStore, ok := d.(EfficiencyStore)
+		if !ok {
+			return false, nil
+		}
+		return true, efficiencyStore.InsertEfficiencySample(ctx, sample)
+	})
+}
+
+// GetEfficiencySamples reads efficiency samples from the first sink that can store them.
+func (this *fanOutDatabase) GetEfficiencySamples(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.EfficiencySample, error) {
+	for _, s := range this.sinks {
+		if efficiencyStore, ok := s.Database.(EfficiencyStore); ok {
+			samples, err := efficiencyStore.GetEfficiencySamples(ctx, vin, from, to)
+			return samples, errors.Wrapf(err, "sink %s", s.Name)
+		}
+	}
+	return nil, ErrNotSupported
+}
+
+// GetChargeCompleteSnapshots reads snapshots from the first sink that can find them.
+func (this *fanOutDatabase) GetChargeCompleteSnapshots(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.Snapshot, error) {
+	for _, s := range this.sinks {
+		if chargeStore, ok := s.Database.(ChargeCompleteStore); ok {
+			snapshots, err := chargeStore.GetChargeCompleteSnapshots(ctx, vin, from, to)
+			return snapshots, errors.Wrapf(err, "sink %s", s.Name)
+		}
+	}
+	return nil, ErrNotSupported
+}
+
+// InsertDrainSummary writes a daily drain summary to every sink that can store them.
+func (this *fanOutDatabase) InsertDrainSummary(ctx context.Context, summary car.DailyDrainSummary) error {
+	return this.writeOptional("drain summary", func(d Database) (bool, error) {
+		drainStore, ok := d.(DrainSummaryStore)
+		if !ok {
+			return false, nil
+		}
+		return true, drainStore.InsertDrainSummary(ctx, summary)
+	})
+}
+
+// GetDrainSummaries reads daily drain summaries from the first sink that can store them.
+func (this *fanOutDatabase) GetDrainSummaries(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.DailyDrainSummary, error) {
+	for _, s := range this.sinks {
+		if drainStore, ok := s.Database.(DrainSummaryStore); ok {
+			summaries, err := drainStore.GetDrainSummaries(ctx, vin, from, to)
+			return summaries, errors.Wrapf(err, "sink %s", s.Name)
+		}
+	}
+	return nil, ErrNotSupported
+}
+
+// writeOptional writes to every sink with an optional capability, following the same error policies as Insert. write
+// returns false if the sink lacks the capability. If no sink has it, ErrNotSupported is returned.
+func (this *fanOutDatabase) writeOptional(kind string, write func(d Database) (bool, error)) error {
+	supported := false
+	for _, s := range this.sinks {
+		ok, err := write(s.Database)
+		if !ok {
+			continue
+		}
+		supported = true
+		if err == nil {
+			continue
+		}
+		if s.Policy == BestEffort {
+			glog.Errorf("Ignoring %s write error from best-effort sink %s: %s", kind, s.Name, err)
+			continue
+		}
+		return errors.Wrapf(err, "sink %s", s.Name)
+	}
+	if !supported {
+		return ErrNotSupported
+	}
+	return nil
+}
+
+func (this *fanOutDatabase) Close() error {
+	var firstErr error
+	for _, s := range this.sinks {
+		if err := s.Database.Close(); err != nil && firstErr == nil {
+			firstErr = errors.Wrapf(err, "cannot close sink %s", s.Name)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,437 @@
+package databases
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/kodek/tesler/recorder/car"
+)
+
+// measurement is a single InfluxDB point of a snapshot. All measurements of a snapshot share its tags and timestamp.
+type measurement struct {
+	name   string
+	fields map[string]interface{}
+}
+
+// snapshotMeasurementNames lists every measurement written for a snapshot.
+var snapshotMeasurementNames = []string{"charge", "position", "misc", "climate", "security", "software", "tires"}
+
+// snapshotTags returns the indexed tags written with every measurement of a snapshot.
+func snapshotTags(snapshot car.Snapshot) map[string]string {
+	tags := map[string]string{
+		"car_name": snapshot.Name,
+		"vin":      snapshot.Vin,
+	}
+	if snapshot.Place != "" {
+		tags["place"] = snapshot.Place
+	}
+	return tags
+}
+
+// snapshotMeasurements splits a snapshot into the measurements shared by the InfluxDB 1.x and 2.x backends.
+func snapshotMeasurements(snapshot car.Snapshot) []measurement {
+	// Charging
+	chargeFields := map[string]interface{}{
+		"state":            snapshot.ChargingState,
+		"batt_level":       snapshot.BatteryLevel,
+		"range_left":       snapshot.RangeLeft,
+		"charge_limit_soc": snapshot.ChargeLimitSoc,
+	}
+	if snapshot.ChargeSession != nil {
+		ci := snapshot.ChargeSession
+		chargeFields["voltage"] = ci.Voltage
+		chargeFields["actual_current"] = ci.ActualCurrent
+		chargeFields["pilot_current"] = ci.PilotCurrent
+		chargeFields["charge_miles_added"] = ci.ChargeMilesAdded
+		chargeFields["charge_rate"] = ci.ChargeRate
+		// NOTE: "time_to_full_charge" accidentally stored pointers. We're writing to a new field
+		// until we reset the database.
+		chargeFields["time_to_full_charge_hrs"] = ci.TimeToFullCharge
+	}
+	for field, value := range chargeDetailFields(snapshot) {
+		chargeFields[field] = value
+	}
+
+	measurements := []measurement{
+		{
+			name:   "charge",
+			fields: chargeFields,
+		},
+		{
+			name:   "position",
+			fields: positionFields(snapshot),
+		},
+		{
+			name: "misc",
+			fields: map[string]interface{}{
+				"wake_state":           snapshot.WakeState,
+				"active_description":   snapshot.ActiveDescription,
+				"center_display_state": snapshot.CenterDisplayState,
+			},
+		},
+	}
+
+	if c := snapshot.Climate; c != nil {
+		measurements = append(measurements, measurement{
+			name: "climate",
+			fields: map[string]interface{}{
+				"inside_temp":             c.InsideTemp,
+				"outside_temp":            c.OutsideTemp,
+				"driver_temp_setting":     c.DriverTempSetting,
+				"passenger_temp_setting":  c.PassengerTempSetting,
+				"fan_status":              c.FanStatus,
+				"seat_heater_left":        c.SeatHeaterLeft,
+				"seat_heater_right":       c.SeatHeaterRight,
+				"seat_heater_rear_left":   c.SeatHeaterRearLeft,
+				"seat_heater_rear_center": c.SeatHeaterRearCenter,
+				"seat_heater_rear_right":  c.SeatHeaterRearRight,
+				"is_climate_on":           c.IsClimateOn,
+				"is_auto_conditioning_on": c.IsAutoConditioningOn,
+				"is_front_defroster_on":   c.IsFrontDefrosterOn,
+				"is_rear_defroster_on":    c.IsRearDefrosterOn,
+				"is_preconditioning":      c.IsPreconditioning,
+				"smart_preconditioning":   c.SmartPreconditioning,
+			},
+		})
+	}
+
+	if sec := snapshot.Security; sec != nil {
+		measurements = append(measurements, measurement{
+			name: "security",
+			fields: map[string]interface{}{
+				"locked":                    sec.Locked,
+				"driver_front_door_open":    sec.DriverFrontDoorOpen,
+				"driver_rear_door_open":     sec.DriverRearDoorOpen,
+				"passenger_front_door_open": sec.PassengerFrontDoorOpen,
+				"passenger_rear_door_open":  sec.PassengerRearDoorOpen,
+				"frunk_open":                sec.FrunkOpen,
+				"trunk_open":                sec.TrunkOpen,
+				"driver_front_window":       sec.DriverFrontWindow,
+				"driver_rear_window":        sec.DriverRearWindow,
+				"passenger_front_window":    sec.PassengerFrontWindow,
+				"passenger_rear_window":     sec.PassengerRearWindow,
+				"sentry_mode":               sec.SentryMode,
+				"is_user_present":           sec.IsUserPresent,
+			},
+		})
+	}
+
+	if sw := snapshot.Software; sw != nil {
+		measurements = append(measurements, measurement{
+			name: "software",
+			fields: map[string]interface{}{
+				"car_version":                  sw.Version,
+				"update_status":                sw.UpdateStatus,
+				"update_version":               sw.UpdateVersion,
+				"update_expected_duration_sec": sw.UpdateExpectedDurationSec,
+			},
+		})
+	}
+
+	if t := snapshot.Tires; t != nil {
+		measurements = append(measurements, measurement{
+			name: "tires",
+			fields: map[string]interface{}{
+				"tpms_pressure_fl":     t.FrontLeftPressure,
+				"tpms_pressure_fr":     t.FrontRightPressure,
+				"tpms_pressure_rl":     t.RearLeftPressure,
+				"tpms_pressure_rr":     t.RearRightPressure,
+				"tpms_soft_warning_fl": t.FrontLeftSoftWarning,
+				"tpms_soft_warning_fr": t.FrontRightSoftWarning,
+				"tpms_soft_warning_rl": t.RearLeftSoftWarning,
+				"tpms_soft_warning_rr": t.RearRightSoftWarning,
+				"tpms_hard_warning_fl": t.FrontLeftHardWarning,
+				"tpms_hard_warning_fr": t.FrontRightHardWarning,
+				"tpms_hard_warning_rl": t.RearLeftHardWarning,
+				"tpms_hard_warning_rr": t.RearRightHardWarning,
+			},
+		})
+	}
+	return measurements
+}
+
+// chargeDetailFields returns the extended battery and charging fields, which are named alike in InfluxDB and SQL.
+func chargeDetailFields(snapshot car.Snapshot) map[string]interface{} {
+	fields := map[string]interface{}{
+		"usable_batt_level":     snapshot.UsableBatteryLevel,
+		"ideal_range":           snapshot.IdealRange,
+		"est_range":             snapshot.EstimatedRange,
+		"battery_heater_on":     snapshot.BatteryHeaterOn,
+		"charge_port_door_open": snapshot.ChargePortDoorOpen,
+		"charge_port_latch":     snapshot.ChargePortLatch,
+	}
+	if !snapshot.ScheduledChargingStartTime.IsZero() {
+		fields["scheduled_charging_start_time"] = snapshot.ScheduledChargingStartTime.Unix()
+	}
+	if ci := snapshot.ChargeSession; ci != nil {
+		fields["charge_energy_added"] = ci.ChargeEnergyAdded
+		fields["charger_phases"] = ci.ChargerPhases
+		fields["charger_power"] = ci.ChargerPower
+		fields["fast_charger_present"] = ci.FastChargerPresent
+		fields["fast_charger_type"] = ci.FastChargerType
+		fields["fast_charger_brand"] = ci.FastChargerBrand
+	}
+	return fields
+}
+
+// positionFields returns the position fields, which are named alike in InfluxDB and SQL.
+func positionFields(snapshot car.Snapshot) map[string]interface{} {
+	b := snapshot.Bearings
+	fields := map[string]interface{}{
+		"latitude":         b.Latitude,
+		"longitude":        b.Longitude,
+		"power":            snapshot.Power,
+		"odometer":         snapshot.Odometer,
+		"speed":            b.Speed,
+		"driving_state":    snapshot.DrivingState,
+		"heading":          b.Heading,
+		"native_latitude":  b.NativeLatitude,
+		"native_longitude": b.NativeLongitude,
+		"native_type":      b.NativeType,
+	}
+	if !b.GpsAsOf.IsZero() {
+		fields["gps_as_of"] = b.GpsAsOf.Unix()
+	}
+	if b.Elevation != nil {
+		fields["elevation"] = *b.Elevation
+	}
+	return fields
+}
+
+// snapshotFromMeasurements reassembles a Snapshot from the newest point of each measurement, keyed by measurement
+// name. Missing measurements leave their part of the snapshot empty.
+func snapshotFromMeasurements(vin string, points map[string]fieldValues) *car.Snapshot {
+	snapshot := &car.Snapshot{
+		Vin: vin,
+	}
+	for _, point := range points {
+		if t := point.time(); t.After(snapshot.Timestamp) {
+			snapshot.Timestamp = t
+		}
+		if name := point.string("car_name"); name != "" {
+			snapshot.Name = name
+		}
+		if place := point.string("place"); place != "" {
+			snapshot.Place = place
+		}
+	}
+
+	if charge, ok := points["charge"]; ok {
+		snapshot.ChargingState = charge.string("state")
+		snapshot.BatteryLevel = charge.int("batt_level")
+		snapshot.RangeLeft = charge.float("range_left")
+		snapshot.ChargeLimitSoc = charge.int("charge_limit_soc")
+		if charge.has("voltage") {
+			snapshot.ChargeSession = &car.ChargeSession{
+				Voltage:          charge.float("voltage"),
+				ActualCurrent:    charge.float("actual_current"),
+				PilotCurrent:     charge.float("pilot_current"),
+				ChargeMilesAdded: charge.float("charge_miles_added"),
+				ChargeRate:       charge.float("charge_rate"),
+				TimeToFullCharge: charge.float("time_to_full_charge_hrs"),
+			}
+		}
+		readChargeDetailFields(charge, snapshot)
+	}
+
+	if position, ok := points["position"]; ok {
+		snapshot.Bearings = bearingsFromFields(position)
+		snapshot.Power = position.float("power")
+		snapshot.Odometer = position.float("odometer")
+		snapshot.DrivingState = position.string("driving_state")
+	}
+
+	if misc, ok := points["misc"]; ok {
+		snapshot.WakeState = misc.string("wake_state")
+		snapshot.ActiveDescription = misc.string("active_description")
+		snapshot.CenterDisplayState = misc.int("center_display_state")
+	}
+
+	if climate, ok := points["climate"]; ok {
+		snapshot.Climate = climateFromFields(climate)
+	}
+
+	if security, ok := points["security"]; ok {
+		snapshot.Security = securityFromFields(security)
+	}
+
+	if software, ok := points["software"]; ok {
+		snapshot.Software = softwareFromFields(software)
+	}
+
+	if tires, ok := points["tires"]; ok {
+		snapshot.Tires = tiresFromFields(tires)
+	}
+	return snapshot
+}
+
+// readChargeDetailFields reads the fields written by chargeDetailFields. It must be called after the snapshot's
+// ChargeSession is set.
+func readChargeDetailFields(f fieldValues, snapshot *car.Snapshot) {
+	snapshot.UsableBatteryLevel = f.int("usable_batt_level")
+	snapshot.IdealRange = f.float("ideal_range")
+	snapshot.EstimatedRange = f.float("est_range")
+	snapshot.BatteryHeaterOn = f.bool("battery_heater_on")
+	snapshot.ChargePortDoorOpen = f.bool("charge_port_door_open")
+	snapshot.ChargePortLatch = f.string("charge_port_latch")
+	if f.has("scheduled_charging_start_time") {
+		snapshot.ScheduledChargingStartTime = time.Unix(int64(f.float("scheduled_charging_start_time")), 0)
+	}
+	if ci := snapshot.ChargeSession; ci != nil {
+		ci.ChargeEnergyAdded = f.float("charge_energy_added")
+		ci.ChargerPhases = f.int("charger_phases")
+		ci.ChargerPower = f.float("charger_power")
+		ci.FastChargerPresent = f.bool("fast_charger_present")
+		ci.FastChargerType = f.string("fast_charger_type")
+		ci.FastChargerBrand = f.string("fast_charger_brand")
+	}
+}
+
+// bearingsFromFields reads the position fields written by positionFields.
+func bearingsFromFields(f fieldValues) car.Bearings {
+	bearings := car.Bearings{
+		Latitude:        f.float("latitude"),
+		Longitude:       f.float("longitude"),
+		Speed:           f.float("speed"),
+		Heading:         f.int("heading"),
+		NativeLatitude:  f.float("native_latitude"),
+		NativeLongitude: f.float("native_longitude"),
+		NativeType:      f.string("native_type"),
+	}
+	if f.has("gps_as_of") {
+		bearings.GpsAsOf = time.Unix(int64(f.float("gps_as_of")), 0)
+	}
+	if f.has("elevation") {
+		elevation := f.float("elevation")
+		bearings.Elevation = &elevation
+	}
+	return bearings
+}
+
+// climateFromFields reads the climate fields, which are named alike in InfluxDB and SQL.
+func climateFromFields(f fieldValues) *car.Climate {
+	return &car.Climate{
+		InsideTemp:           f.float("inside_temp"),
+		OutsideTemp:          f.float("outside_temp"),
+		DriverTempSetting:    f.float("driver_temp_setting"),
+		PassengerTempSetting: f.float("passenger_temp_setting"),
+		FanStatus:            f.int("fan_status"),
+		SeatHeaterLeft:       f.int("seat_heater_left"),
+		SeatHeaterRight:      f.int("seat_heater_right"),
+		SeatHeaterRearLeft:   f.int("seat_heater_rear_left"),
+		SeatHeaterRearCenter: f.int("seat_heater_rear_center"),
+		SeatHeaterRearRight:  f.int("seat_heater_rear_right"),
+		IsClimateOn:          f.bool("is_climate_on"),
+		IsAutoConditioningOn: f.bool("is_auto_conditioning_on"),
+		IsFrontDefrosterOn:   f.bool("is_front_defroster_on"),
+		IsRearDefrosterOn:    f.bool("is_rear_defroster_on"),
+		IsPreconditioning:    f.bool("is_preconditioning"),
+		SmartPreconditioning: f.bool("smart_preconditioning"),
+	}
+}
+
+// securityFromFields reads the security fields, which are named alike in InfluxDB and SQL.
+func securityFromFields(f fieldValues) *car.Security {
+	return &car.Security{
+		Locked:                 f.bool("locked"),
+		DriverFrontDoorOpen:    f.bool("driver_front_door_open"),
+		DriverRearDoorOpen:     f.bool("driver_rear_door_open"),
+		PassengerFrontDoorOpen: f.bool("passenger_front_door_open"),
+		PassengerRearDoorOpen:  f.bool("passenger_rear_door_open"),
+		FrunkOpen:              f.bool("frunk_open"),
+		TrunkOpen:              f.bool("trunk_open"),
+		DriverFrontWindow:      f.int("driver_front_window"),
+		DriverRearWindow:       f.int("driver_rear_window"),
+		PassengerFrontWindow:   f.int("passenger_front_window"),
+		PassengerRearWindow:    f.int("passenger_rear_window"),
+		SentryMode:             f.bool("sentry_mode"),
+		IsUserPresent:          f.bool("is_user_present"),
+	}
+}
+
+// softwareFromFields reads the software fields, which are named alike in InfluxDB and SQL.
+func softwareFromFields(f fieldValues) *car.Software {
+	return &car.Software{
+		Version:                   f.string("car_version"),
+		UpdateStatus:              f.string("update_status"),
+		UpdateVersion:             f.string("update_version"),
+		UpdateExpectedDurationSec: f.int("update_expected_duration_sec"),
+	}
+}
+
+// tiresFromFields reads the tires fields, which are named alike in InfluxDB and SQL.
+func tiresFromFields(f fieldValues) *car.Tires {
+	return &car.Tires{
+		FrontLeftPressure:     f.float("tpms_pressure_fl"),
+		FrontRightPressure:    f.float("tpms_pressure_fr"),
+		RearLeftPressure:      f.float("tpms_pressure_rl"),
+		RearRightPressure:     f.float("tpms_pressure_rr"),
+		FrontLeftSoftWarning:  f.bool("tpms_soft_warning_fl"),
+		FrontRightSoftWarning: f.bool("tpms_soft_warning_fr"),
+		RearLeftSoftWarning:   f.bool("tpms_soft_warning_rl"),
+		RearRightSoftWarning:  f.bool("tpms_soft_warning_rr"),
+		FrontLeftHardWarning:  f.bool("tpms_hard_warning_fl"),
+		FrontRightHardWarning: f.bool("tpms_hard_warning_fr"),
+		RearLeftHardWarning:   f.bool("tpms_hard_warning_rl"),
+		RearRightHardWarning:  f.bool("tpms_hard_warning_rr"),
+	}
+}
+
+// fieldValues holds the columns of a single query result row, keyed by column name. InfluxDB points store their
+// time under "time" as an RFC 3339 string.
+type fieldValues map[string]interface{}
+
+func (f fieldValues) has(key string) bool {
+	v, ok := f[key]
+	return ok && v != nil
+}
+
+func (f fieldValues) float(key string) float64 {
+	switch v := f[key].(type) {
+	case json.Number:
+		n, _ := v.Float64()
+		return n
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
+
+func (f fieldValues) int(key string) int {
+	return int(f.float(key))
+}
+
+func (f fieldValues) bool(key string) bool {
+	switch v := f[key].(type) {
+	case bool:
+		return v
+	case int64:
+		// SQLite stores booleans as integers.
+		return v != 0
+	}
+	return false
+}
+
+func (f fieldValues) string(key string) string {
+	switch v := f[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func (f fieldValues) timestamp(key string) time.Time {
+	if t, ok := f[key].(time.Time); ok {
+		return t
+	}
+	t, _ := time.Parse(time.RFC3339Nano, f.string(key))
+	return t
+}
+
+func (f fieldValues) time() time.Time {
+	return f.timestamp("time")
+}
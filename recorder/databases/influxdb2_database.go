@@ -0,0 +1,423 @@
+package databases
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/pkg/errors"
+)
+
+// influxDb2Database writes snapshots as line protocol through the InfluxDB 2.x HTTP API.
+type influxDb2Database struct {
+	client  *http.Client
+	address string
+	org     string
+	bucket  string
+	token   string
+}
+
+func (this *influxDb2Database) GetLatest(ctx context.Context, vin string) (*car.Snapshot, error) {
+	points := make(map[string]fieldValues)
+	for _, name := range snapshotMeasurementNames {
+		rows, err := this.query(ctx, fmt.Sprintf(`from(bucket: %s)
+			|> range(start: 0)
+			|> filter(fn: (r) => r._measurement == %s and r.vin == %s)
+			|> last()
+			|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+			|> group()
+			|> sort(columns: ["_time"], desc: true)
+			|> limit(n: 1)`,
+			strconv.Quote(this.bucket), strconv.Quote(name), strconv.Quote(vin)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot query measurement %s", name)
+		}
+		if len(rows) > 0 {
+			points[name] = rows[0]
+		}
+	}
+	if len(points) == 0 {
+		return nil, errors.Wrapf(ErrNoData, "no measurements for VIN %s", vin)
+	}
+	return snapshotFromMeasurements(vin, points), nil
+}
+
+func (this *influxDb2Database) Insert(ctx context.Context, snapshot car.Snapshot) error {
+	glog.Infof("Recording measurement to influxdb2")
+
+	var body bytes.Buffer
+	tags := snapshotTags(snapshot)
+	for _, m := range snapshotMeasurements(snapshot) {
+		writeLineProtocol(&body, m.name, tags, m.fields, snapshot.Timestamp)
+	}
+	if err := this.write(ctx, &body); err != nil {
+		return err
+	}
+
+	glog.Info("Writing to InfluxDB 2 successful")
+	return nil
+}
+
+func (this *influxDb2Database) InsertTrip(ctx context.Context, trip car.Trip) error {
+	var body bytes.Buffer
+	writeLineProtocol(&body, tripMeasurement, carTags(trip.Vin, trip.CarName), influxTripFields(trip), trip.StartTime)
+	return errors.Wrap(this.write(ctx, &body), "cannot write trip to InfluxDB 2")
+}
+
+func (this *influxDb2Database) GetTrips(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.Trip, error) {
+	rows, err := this.queryRange(ctx, tripMeasurement, vin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	trips := make([]car.Trip, 0, len(rows))
+	for _, row := range rows {
+		trips = append(trips, tripFromPoint(vin, row))
+	}
+	return trips, nil
+}
+
+func (this *influxDb2Database) InsertChargingSession(ctx context.Context, session car.ChargingSession) error {
+	var body bytes.Buffer
+	writeLineProtocol(&body, chargingSessionMeasurement, carTags(session.Vin, session.CarName),
+		influxChargingSessionFields(session), session.StartTime)
+	return errors.Wrap(this.write(ctx, &body), "cannot write charging session to InfluxDB 2")
+}
+
+func (this *influxDb2Database) GetChargingSessions(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.ChargingSession, error) {
+	rows, err := this.queryRange(ctx, chargingSessionMeasurement, vin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]car.ChargingSession, 0, len(rows))
+	for _, row := range rows {
+		sessions = append(sessions, chargingSessionFromPoint(vin, row))
+	}
+	return sessions, nil
+}
+
+func (this *influxDb2Database) InsertEfficiencySample(ctx context.Context, sample car.EfficiencySample) error {
+	var body bytes.Buffer
+	writeLineProtocol(&body, efficiencyMeasurement, carTags(sample.Vin, sample.CarName), efficiencyFields(sample),
+		sample.Timestamp)
+	return errors.Wrap(this.write(ctx, &body), "cannot write efficiency sample to InfluxDB 2")
+}
+
+func (this *influxDb2Database) GetEfficiencySamples(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.EfficiencySample, error) {
+	rows, err := this.queryRange(ctx, efficiencyMeasurement, vin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]car.EfficiencySample, 0, len(rows))
+	for _, row := range rows {
+		samples = append(samples, efficiencyFromFields(vin, row.time(), row))
+	}
+	return samples, nil
+}
+
+// InsertDrainSummary writes a daily drain summary. It replaces the summary written before for the same day, since both
+// have the same timestamp.
+func (this *influxDb2Database) InsertDrainSummary(ctx context.Context, summary car.DailyDrainSummary) error {
+	var body bytes.Buffer
+	writeLineProtocol(&body, drainMeasurement, carTags(summary.Vin, summary.CarName), drainSummaryFields(summary),
+		drainSummaryTime(summary))
+	return errors.Wrap(this.write(ctx, &body), "cannot write drain summary to InfluxDB 2")
+}
+
+func (this *influxDb2Database) GetDrainSummaries(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.DailyDrainSummary, error) {
+	rows, err := this.queryRange(ctx, drainMeasurement, vin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]car.DailyDrainSummary, 0, len(rows))
+	for _, row := range rows {
+		summaries = append(summaries, drainSummaryFromFields(vin, row))
+	}
+	return summaries, nil
+}
+
+func (this *influxDb2Database) GetChargeCompleteSnapshots(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.Snapshot, error) {
+	start, stop := fluxRange(from, to)
+	charges, err := this.query(ctx, fmt.Sprintf(`from(bucket: %s)
+		|> range(start: %s, stop: %s)
+		|> filter(fn: (r) => r._measurement == "charge" and r.vin == %s)
+		|> filter(fn: (r) => r._field == "state" or r._field == "batt_level" or r._field == "range_left")
+		|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+		|> filter(fn: (r) => r.state == %s)
+		|> group()
+		|> sort(columns: ["_time"])`,
+		strconv.Quote(this.bucket), start, stop, strconv.Quote(vin), strconv.Quote(car.ChargeComplete)))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query measurement charge")
+	}
+	if len(charges) == 0 {
+		return []car.Snapshot{}, nil
+	}
+	// The highest odometer reading of each day, across places.
+	positions, err := this.query(ctx, fmt.Sprintf(`from(bucket: %s)
+		|> range(start: %s, stop: %s)
+		|> filter(fn: (r) => r._measurement == "position" and r.vin == %s and r._field == "odometer")
+		|> group(columns: ["_field"])
+		|> aggregateWindow(every: 1d, fn: max, timeSrc: "_start", createEmpty: false)
+		|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")`,
+		strconv.Quote(this.bucket), start, stop, strconv.Quote(vin)))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query measurement position")
+	}
+	odometers := dailyOdometers(positions)
+	snapshots := make([]car.Snapshot, 0, len(charges))
+	for _, charge := range charges {
+		snapshots = append(snapshots,
+			chargeCompleteSnapshot(vin, charge.time(), charge, odometers[odometerDay(charge.time())]))
+	}
+	return snapshots, nil
+}
+
+// fluxRange formats the bounds of a Flux range covering [from, to].
+func fluxRange(from time.Time, to time.Time) (string, string) {
+	// The range stop is exclusive.
+	return from.UTC().Format(time.RFC3339Nano), to.Add(time.Nanosecond).UTC().Format(time.RFC3339Nano)
+}
+
+// queryRange returns the points of a measurement for a VIN within [from, to], oldest first.
+func (this *influxDb2Database) queryRange(ctx context.Context, measurement string, vin string, from time.Time,
+	to time.Time) ([]fieldValues, error) {
+	start, stop := fluxRange(from, to)
+	rows, err := this.query(ctx, fmt.Sprintf(`from(bucket: %s)
+		|> range(start: %s, stop: %s)
+		|> filter(fn: (r) => r._measurement == %s and r.vin == %s)
+		|> pivot(rowKey: ["_time"], columnKey: ["_field"], valueColumn: "_value")
+		|> group()
+		|> sort(columns: ["_time"])`,
+		strconv.Quote(this.bucket), start, stop, strconv.Quote(measurement), strconv.Quote(vin)))
+	return rows, errors.Wrapf(err, "cannot query measurement %s", measurement)
+}
+
+func (this *influxDb2Database) Close() error {
+	this.client.CloseIdleConnections()
+	return nil
+}
+
+// write sends line protocol to the /api/v2/write endpoint. Nothing is sent if there are no points.
+func (this *influxDb2Database) write(ctx context.Context, body *bytes.Buffer) error {
+	if body.Len() == 0 {
+		return nil
+	}
+	params := url.Values{
+		"org":       []string{this.org},
+		"bucket":    []string{this.bucket},
+		"precision": []string{"ns"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, this.address+"/api/v2/write?"+params.Encode(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return this.do(req, nil)
+}
+
+// query runs a Flux query and returns every row of the result.
+func (this *influxDb2Database) query(ctx context.Context, flux string) ([]fieldValues, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query": flux,
+		"type":  "flux",
+		"dialect": map[string]interface{}{
+			"header":      true,
+			"annotations": []string{"datatype"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{"org": []string{this.org}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, this.address+"/api/v2/query?"+params.Encode(),
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+
+	var rows []fieldValues
+	err = this.do(req, func(r io.Reader) error {
+		var err error
+		rows, err = parseAnnotatedCsv(r)
+		return err
+	})
+	return rows, err
+}
+
+// do sends an authenticated request and hands the response body to handleBody, if given.
+func (this *influxDb2Database) do(req *http.Request, handleBody func(io.Reader) error) error {
+	req.Header.Set("Authorization", "Token "+this.token)
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("influxdb2 returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if handleBody == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return handleBody(resp.Body)
+}
+
+// parseAnnotatedCsv decodes a Flux CSV response with "datatype" annotations. Values are converted to the types used
+// by fieldValues, and "_time" is renamed to "time".
+func parseAnnotatedCsv(r io.Reader) ([]fieldValues, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	var rows []fieldValues
+	var datatypes, header []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot parse flux response")
+		}
+
+		switch {
+		case record[0] == "#datatype":
+			// A new table starts. Its header follows.
+			datatypes = record
+			header = nil
+		case strings.HasPrefix(record[0], "#"):
+			continue
+		case header == nil:
+			header = record
+		default:
+			row := make(fieldValues, len(record))
+			for i, cell := range record {
+				if i >= len(header) || header[i] == "" || cell == "" {
+					continue
+				}
+				column := header[i]
+				if column == "_time" {
+					column = "time"
+				}
+				datatype := ""
+				if i < len(datatypes) {
+					datatype = datatypes[i]
+				}
+				row[column] = parseCsvValue(datatype, cell)
+			}
+			rows = append(rows, row)
+		}
+	}
+}
+
+func parseCsvValue(datatype string, cell string) interface{} {
+	switch datatype {
+	case "long":
+		if v, err := strconv.ParseInt(cell, 10, 64); err == nil {
+			return v
+		}
+	case "unsignedLong", "double":
+		if v, err := strconv.ParseFloat(cell, 64); err == nil {
+			return v
+		}
+	case "boolean":
+		return cell == "true"
+	}
+	return cell
+}
+
+// writeLineProtocol appends a single point in InfluxDB line protocol. Tags and fields are sorted for stable output.
+// Points without any field that can be written are skipped, since InfluxDB would reject the whole write.
+func writeLineProtocol(w *bytes.Buffer, name string, tags map[string]string, fields map[string]interface{}, t time.Time) {
+	fieldKeys := make([]string, 0, len(fields))
+	for k := range fields {
+		fieldKeys = append(fieldKeys, k)
+	}
+	sort.Strings(fieldKeys)
+	var fieldSet strings.Builder
+	for _, k := range fieldKeys {
+		value, ok := lineProtocolValue(fields[k])
+		if !ok {
+			continue
+		}
+		if fieldSet.Len() > 0 {
+			fieldSet.WriteString(",")
+		}
+		fmt.Fprintf(&fieldSet, "%s=%s", lineProtocolEscaper.Replace(k), value)
+	}
+	if fieldSet.Len() == 0 {
+		return
+	}
+
+	w.WriteString(lineProtocolEscaper.Replace(name))
+
+	tagKeys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		// Empty tag values are not allowed by line protocol.
+		if v != "" {
+			tagKeys = append(tagKeys, k)
+		}
+	}
+	sort.Strings(tagKeys)
+	for _, k := range tagKeys {
+		fmt.Fprintf(w, ",%s=%s", lineProtocolEscaper.Replace(k), lineProtocolEscaper.Replace(tags[k]))
+	}
+	fmt.Fprintf(w, " %s %d\n", fieldSet.String(), t.UnixNano())
+}
+
+// lineProtocolEscaper escapes measurement names, tag keys, tag values and field keys.
+var lineProtocolEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// lineProtocolValue formats a field value. It returns false for values that cannot be written.
+func lineProtocolValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int:
+		return strconv.Itoa(v) + "i", true
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`, true
+	}
+	return "", false
+}
+
+// OpenInfluxDb2Database creates a client for the InfluxDB 2.x API at the given address, e.g. http://localhost:8086.
+func OpenInfluxDb2Database(address string, org string, bucket string, token string) (Database, error) {
+	if address == "" || org == "" || bucket == "" {
+		return nil, errors.New("influxdb2 address, org and bucket must be set")
+	}
+	return &influxDb2Database{
+		client:  &http.Client{Timeout: 30 * time.Second},
+		address: strings.TrimSuffix(address, "/"),
+		org:     org,
+		bucket:  bucket,
+		token:   token,
+	}, nil
+}
@@ -0,0 +1,357 @@
+package databases
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/pkg/errors"
+)
+
+// fakeInfluxDb2 is a stand-in for the InfluxDB 2.x HTTP API. It records write requests and answers every query with
+// the response returned by respond.
+type fakeInfluxDb2 struct {
+	writes  []*http.Request
+	bodies  []string
+	queries []string
+	respond func(flux string) string
+}
+
+func (f *fakeInfluxDb2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	switch r.URL.Path {
+	case "/api/v2/write":
+		f.writes = append(f.writes, r)
+		f.bodies = append(f.bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/v2/query":
+		var query struct {
+			Query string `json:"query"`
+		}
+		if err := json.Unmarshal(body, &query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.queries = append(f.queries, query.Query)
+		w.Header().Set("Content-Type", "text/csv")
+		response := ""
+		if f.respond != nil {
+			response = f.respond(query.Query)
+		}
+		w.Write([]byte(response))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func openFakeInfluxDb2(t *testing.T, fake *fakeInfluxDb2) Database {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	db, err := OpenInfluxDb2Database(server.URL+"/", "my org", "tesla", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestInfluxDb2InsertWritesLineProtocol(t *testing.T) {
+	fake := &fakeInfluxDb2{}
+	db := openFakeInfluxDb2(t, fake)
+
+	timestamp := time.Date(2020, 5, 2, 10, 30, 0, 123456789, time.UTC)
+	snapshot := car.Snapshot{
+		Timestamp:     timestamp,
+		Name:          "My Car, the=best",
+		Vin:           "5YJ3E1EA0KF000001",
+		ChargingState: `Say "hi"\`,
+		BatteryLevel:  80,
+		RangeLeft:     250.5,
+		Software:      &car.Software{Version: "2020.12.5"},
+		Security:      &car.Security{Locked: true},
+	}
+	if err := db.Insert(context.Background(), snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.writes) != 1 {
+		t.Fatalf("got %d writes, want 1", len(fake.writes))
+	}
+	req := fake.writes[0]
+	if got := req.Header.Get("Authorization"); got != "Token secret" {
+		t.Errorf("Authorization = %q, want %q", got, "Token secret")
+	}
+	params := req.URL.Query()
+	if params.Get("org") != "my org" || params.Get("bucket") != "tesla" || params.Get("precision") != "ns" {
+		t.Errorf("unexpected write parameters: %s", req.URL.RawQuery)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(fake.bodies[0], "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("got %d lines, want one per measurement (charge, position, misc, security, software):\n%s",
+			len(lines), fake.bodies[0])
+	}
+	const tags = `,car_name=My\ Car\,\ the\=best,vin=5YJ3E1EA0KF000001 `
+	for _, line := range lines {
+		if !strings.Contains(line, tags) {
+			t.Errorf("line doesn't have the escaped tags %q: %s", tags, line)
+		}
+		if !strings.HasSuffix(line, " 1588415400123456789") {
+			t.Errorf("line doesn't end with the timestamp in nanoseconds: %s", line)
+		}
+	}
+	charge := lines[0]
+	for _, want := range []string{
+		`batt_level=80i`,
+		`range_left=250.5`,
+		`state="Say \"hi\"\\"`,
+		`battery_heater_on=false`,
+	} {
+		if !strings.Contains(charge, want) {
+			t.Errorf("charge line doesn't contain %s: %s", want, charge)
+		}
+	}
+	if !strings.HasPrefix(lines[3], "security,") || !strings.Contains(lines[3], "locked=true") {
+		t.Errorf("unexpected security line: %s", lines[3])
+	}
+}
+
+func TestWriteLineProtocol(t *testing.T) {
+	var buf bytes.Buffer
+	writeLineProtocol(&buf, "my measurement", map[string]string{"b": "x y", "a": "1", "empty": ""},
+		map[string]interface{}{
+			"int":       3,
+			"int64":     int64(-4),
+			"float":     1.5,
+			"nan":       math.NaN(),
+			"bool":      true,
+			"string":    "a,b=c",
+			"field key": "v",
+			"ignored":   []int{1},
+		},
+		time.Unix(1, 5))
+
+	want := `my\ measurement,a=1,b=x\ y bool=true,field\ key="v",float=1.5,int=3i,int64=-4i,string="a,b=c" 1000000005` +
+		"\n"
+	if got := buf.String(); got != want {
+		t.Errorf("writeLineProtocol() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteLineProtocolSkipsPointsWithoutFields(t *testing.T) {
+	var buf bytes.Buffer
+	writeLineProtocol(&buf, "empty", map[string]string{"vin": "VIN1"},
+		map[string]interface{}{"nan": math.NaN(), "ignored": []int{1}}, time.Unix(1, 0))
+	writeLineProtocol(&buf, "full", map[string]string{"vin": "VIN1"}, map[string]interface{}{"a": 1}, time.Unix(1, 0))
+
+	if got, want := buf.String(), "full,vin=VIN1 a=1i 1000000000\n"; got != want {
+		t.Errorf("writeLineProtocol() = %q, want %q", got, want)
+	}
+}
+
+func TestInfluxDb2SkipsEmptyWrites(t *testing.T) {
+	fake := &fakeInfluxDb2{}
+	db := openFakeInfluxDb2(t, fake)
+	if err := db.(*influxDb2Database).write(context.Background(), &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.writes) != 0 {
+		t.Errorf("sent %d write requests without points", len(fake.writes))
+	}
+}
+
+const annotatedCsvResponse = `#datatype,string,long,dateTime:RFC3339,string,string,string,double,long,boolean
+,result,table,_time,_measurement,vin,car_name,range_left,batt_level,battery_heater_on
+,_result,0,2020-05-02T10:30:00.5Z,charge,VIN1,"My Car, the best",250.5,80,true
+
+#datatype,string,long,dateTime:RFC3339,string,string,string
+,result,table,_time,_measurement,vin,car_version
+,_result,1,2020-05-02T10:29:00Z,software,VIN1,2020.12.5
+`
+
+func TestParseAnnotatedCsv(t *testing.T) {
+	rows, err := parseAnnotatedCsv(strings.NewReader(annotatedCsvResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	charge := rows[0]
+	if got := charge.time(); !got.Equal(time.Date(2020, 5, 2, 10, 30, 0, 5e8, time.UTC)) {
+		t.Errorf("time = %s", got)
+	}
+	if got := charge.string("car_name"); got != "My Car, the best" {
+		t.Errorf("car_name = %q", got)
+	}
+	if got := charge.float("range_left"); got != 250.5 {
+		t.Errorf("range_left = %v", got)
+	}
+	if v, ok := charge["batt_level"].(int64); !ok || v != 80 {
+		t.Errorf("batt_level = %#v, want int64 80", charge["batt_level"])
+	}
+	if !charge.bool("battery_heater_on") {
+		t.Error("battery_heater_on = false, want true")
+	}
+	if got := rows[1].string("car_version"); got != "2020.12.5" {
+		t.Errorf("car_version = %q", got)
+	}
+}
+
+func TestInfluxDb2GetLatest(t *testing.T) {
+	fake := &fakeInfluxDb2{
+		respond: func(flux string) string {
+			switch {
+			case strings.Contains(flux, `r._measurement == "charge"`):
+				return `#datatype,string,long,dateTime:RFC3339,string,string,double,long,string
+,result,table,_time,vin,car_name,range_left,batt_level,place
+,_result,0,2020-05-02T10:30:00Z,VIN1,My Car,250.5,80,Home
+`
+			case strings.Contains(flux, `r._measurement == "software"`):
+				return `#datatype,string,long,dateTime:RFC3339,string,string
+,result,table,_time,vin,car_version
+,_result,0,2020-05-02T10:29:00Z,VIN1,2020.12.5
+`
+			case strings.Contains(flux, `r._measurement == "tires"`):
+				return `#datatype,string,long,dateTime:RFC3339,string,double,double,double,double,boolean
+,result,table,_time,vin,tpms_pressure_fl,tpms_pressure_fr,tpms_pressure_rl,tpms_pressure_rr,tpms_soft_warning_rl
+,_result,0,2020-05-02T10:29:00Z,VIN1,2.9,2.9,2.5,2.9,true
+`
+			}
+			return ""
+		},
+	}
+	db := openFakeInfluxDb2(t, fake)
+
+	snapshot, err := db.GetLatest(context.Background(), "VIN1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.queries) != len(snapshotMeasurementNames) {
+		t.Errorf("got %d queries, want one per measurement", len(fake.queries))
+	}
+	if !strings.Contains(fake.queries[0], `r.vin == "VIN1"`) {
+		t.Errorf("query doesn't filter by VIN: %s", fake.queries[0])
+	}
+	if snapshot.Name != "My Car" || snapshot.Place != "Home" || snapshot.BatteryLevel != 80 ||
+		snapshot.RangeLeft != 250.5 {
+		t.Errorf("unexpected snapshot: %+v", snapshot)
+	}
+	if !snapshot.Timestamp.Equal(time.Date(2020, 5, 2, 10, 30, 0, 0, time.UTC)) {
+		t.Errorf("Timestamp = %s, want the newest measurement", snapshot.Timestamp)
+	}
+	if snapshot.Software == nil || snapshot.Software.Version != "2020.12.5" {
+		t.Errorf("Software = %+v", snapshot.Software)
+	}
+	if snapshot.Tires == nil || snapshot.Tires.RearLeftPressure != 2.5 || !snapshot.Tires.RearLeftSoftWarning {
+		t.Errorf("Tires = %+v", snapshot.Tires)
+	}
+	if snapshot.Climate != nil {
+		t.Errorf("Climate = %+v, want nil since it wasn't recorded", snapshot.Climate)
+	}
+}
+
+func TestInfluxDb2GetLatestNoData(t *testing.T) {
+	db := openFakeInfluxDb2(t, &fakeInfluxDb2{})
+	if _, err := db.GetLatest(context.Background(), "VIN1"); errors.Cause(err) != ErrNoData {
+		t.Errorf("GetLatest() error = %v, want ErrNoData", err)
+	}
+}
+
+func TestInfluxDb2GetTrips(t *testing.T) {
+	fake := &fakeInfluxDb2{
+		respond: func(flux string) string {
+			return `#datatype,string,long,dateTime:RFC3339,string,string,double,double,long,string
+,result,table,_time,vin,car_name,start_odometer,end_odometer,end_time,start_place
+,_result,0,2020-05-02T10:00:00Z,VIN1,My Car,1000,1012.5,1588415400,Home
+,_result,0,2020-05-03T08:00:00Z,VIN1,My Car,1012.5,1020,1588496400,
+`
+		},
+	}
+	db := openFakeInfluxDb2(t, fake)
+
+	from := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, 5, 4, 0, 0, 0, 0, time.UTC)
+	trips, err := db.(TripStore).GetTrips(context.Background(), "VIN1", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := fake.queries[0]
+	for _, want := range []string{
+		`range(start: 2020-05-01T00:00:00Z, stop: 2020-05-04T00:00:00.000000001Z)`,
+		`r._measurement == "trip"`,
+		`sort(columns: ["_time"])`,
+	} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query doesn't contain %s:\n%s", want, query)
+		}
+	}
+	if len(trips) != 2 {
+		t.Fatalf("got %d trips, want 2", len(trips))
+	}
+	if trips[0].Distance() != 12.5 || trips[0].StartPlace != "Home" || trips[0].CarName != "My Car" {
+		t.Errorf("unexpected trip: %+v", trips[0])
+	}
+	if !trips[0].StartTime.Equal(time.Date(2020, 5, 2, 10, 0, 0, 0, time.UTC)) ||
+		!trips[0].EndTime.Equal(time.Unix(1588415400, 0)) {
+		t.Errorf("trip times = %s to %s", trips[0].StartTime, trips[0].EndTime)
+	}
+}
+
+func TestInfluxDb2GetChargeCompleteSnapshots(t *testing.T) {
+	fake := &fakeInfluxDb2{
+		respond: func(flux string) string {
+			if strings.Contains(flux, `r._measurement == "charge"`) {
+				return `#datatype,string,long,dateTime:RFC3339,string,string,long,double
+,result,table,_time,vin,state,batt_level,range_left
+,_result,0,2020-05-02T22:00:00Z,VIN1,Complete,90,270
+`
+			}
+			return `#datatype,string,long,dateTime:RFC3339,double
+,result,table,_time,odometer
+,_result,0,2020-05-01T00:00:00Z,990
+,_result,0,2020-05-02T00:00:00Z,1012.5
+`
+		},
+	}
+	db := openFakeInfluxDb2(t, fake)
+
+	snapshots, err := db.(ChargeCompleteStore).GetChargeCompleteSnapshots(context.Background(), "VIN1",
+		time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 5, 4, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.queries) != 2 || !strings.Contains(fake.queries[0], `r.state == "Complete"`) ||
+		!strings.Contains(fake.queries[1], "aggregateWindow(every: 1d, fn: max") {
+		t.Errorf("unexpected queries:\n%s", strings.Join(fake.queries, "\n"))
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("got %d snapshots, want 1", len(snapshots))
+	}
+	if s := snapshots[0]; s.BatteryLevel != 90 || s.RangeLeft != 270 || s.Odometer != 1012.5 {
+		t.Errorf("unexpected snapshot: %+v, want the odometer of the same day", s)
+	}
+}
+
+func TestInfluxDb2WriteError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"unauthorized access"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	db, err := OpenInfluxDb2Database(server.URL, "org", "bucket", "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Insert(context.Background(), car.Snapshot{Vin: "VIN1", Timestamp: time.Now()})
+	if err == nil || !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "unauthorized access") {
+		t.Errorf("Insert() error = %v, want the status and message of the server", err)
+	}
+}
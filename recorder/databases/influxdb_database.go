@@ -2,108 +2,382 @@ package databases
 
 import (
 	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	influxdb "github.com/influxdata/influxdb1-client/v2"
 	"github.com/kodek/tesler/recorder/car"
+	"github.com/pkg/errors"
 )
 
+var influxPendingPoints = expvar.NewInt("influxdb_pending_points")
+
+// maxPendingBatches bounds how many batches worth of points are kept while InfluxDB is unreachable.
+const maxPendingBatches = 10
+
+const defaultInfluxFlushInterval = 10 * time.Second
+
 type influxDbDatabase struct {
 	conn     influxdb.Client
 	database string
+
+	// Points are accumulated and written once batchSize is reached or every flushInterval. A batchSize of 1 or less
+	// writes every snapshot immediately.
+	batchSize     int
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	pending []*influxdb.Point
+
+	stop chan struct{}
+	done chan struct{}
 }
 
-func (this *influxDbDatabase) GetLatest(ctx context.Context) (*car.Snapshot, error) {
-	panic("implement me")
+func (this *influxDbDatabase) GetLatest(ctx context.Context, vin string) (*car.Snapshot, error) {
+	// Make sure recent snapshots are visible to the query.
+	if err := this.flush(); err != nil {
+		glog.Errorf("Cannot flush pending points before reading: %s", err)
+	}
+
+	points := make(map[string]fieldValues)
+	for _, name := range snapshotMeasurementNames {
+		point, err := this.queryLatest(name, vin)
+		if err != nil {
+			return nil, err
+		}
+		if point != nil {
+			points[name] = point
+		}
+	}
+	if len(points) == 0 {
+		return nil, errors.Wrapf(ErrNoData, "no measurements for VIN %s", vin)
+	}
+	return snapshotFromMeasurements(vin, points), nil
+}
+
+// queryLatest returns the newest point of the given measurement for a VIN, or nil if there is none.
+func (this *influxDbDatabase) queryLatest(measurement string, vin string) (fieldValues, error) {
+	q := influxdb.NewQueryWithParameters(
+		fmt.Sprintf(`SELECT * FROM %q WHERE "vin" = $vin ORDER BY time DESC LIMIT 1`, measurement),
+		this.database,
+		"",
+		map[string]interface{}{"vin": vin})
+	resp, err := this.conn.Query(q)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot query measurement %s", measurement)
+	}
+	if err := resp.Error(); err != nil {
+		return nil, errors.Wrapf(err, "cannot query measurement %s", measurement)
+	}
+
+	for _, result := range resp.Results {
+		for _, row := range result.Series {
+			if len(row.Values) == 0 {
+				continue
+			}
+			values := make(fieldValues, len(row.Columns))
+			for i, column := range row.Columns {
+				values[column] = row.Values[0][i]
+			}
+			return values, nil
+		}
+	}
+	return nil, nil
 }
 
 func (this *influxDbDatabase) Insert(ctx context.Context, snapshot car.Snapshot) error {
 	glog.Infof("Recording measurement to influxdb")
 
-	bp, err := influxdb.NewBatchPoints(influxdb.BatchPointsConfig{
-		Database:  this.database,
-		Precision: "s",
-	})
+	// Indexed tags
+	tags := snapshotTags(snapshot)
+	var points []*influxdb.Point
+	for _, m := range snapshotMeasurements(snapshot) {
+		point, err := influxdb.NewPoint(m.name, tags, m.fields, snapshot.Timestamp)
+		if err != nil {
+			return err
+		}
+		points = append(points, point)
+	}
+
+	this.mu.Lock()
+	this.pending = append(this.pending, points...)
+	full := len(this.pending) >= this.batchSize*len(points)
+	this.mu.Unlock()
+	influxPendingPoints.Add(int64(len(points)))
+
+	if !full {
+		return nil
+	}
+	return this.flush()
+}
+
+// InsertTrip writes a trip immediately, bypassing the snapshot batch.
+func (this *influxDbDatabase) InsertTrip(ctx context.Context, trip car.Trip) error {
+	err := this.writePoint(tripMeasurement, carTags(trip.Vin, trip.CarName), influxTripFields(trip), trip.StartTime)
+	return errors.Wrap(err, "cannot write trip to InfluxDB")
+}
+
+func (this *influxDbDatabase) GetTrips(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.Trip, error) {
+	points, err := this.queryRange(tripMeasurement, vin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	trips := make([]car.Trip, 0, len(points))
+	for _, point := range points {
+		trips = append(trips, tripFromPoint(vin, point))
+	}
+	return trips, nil
+}
+
+// InsertChargingSession writes a charging session immediately, bypassing the snapshot batch.
+func (this *influxDbDatabase) InsertChargingSession(ctx context.Context, session car.ChargingSession) error {
+	err := this.writePoint(chargingSessionMeasurement, carTags(session.Vin, session.CarName),
+		influxChargingSessionFields(session), session.StartTime)
+	return errors.Wrap(err, "cannot write charging session to InfluxDB")
+}
+
+func (this *influxDbDatabase) GetChargingSessions(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.ChargingSession, error) {
+	points, err := this.queryRange(chargingSessionMeasurement, vin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]car.ChargingSession, 0, len(points))
+	for _, point := range points {
+		sessions = append(sessions, chargingSessionFromPoint(vin, point))
+	}
+	return sessions, nil
+}
+
+// InsertEfficiencySample batches a sample along with snapshots, since samples are frequent while driving. Without
+// batching, it's written immediately.
+func (this *influxDbDatabase) InsertEfficiencySample(ctx context.Context, sample car.EfficiencySample) error {
+	point, err := influxdb.NewPoint(efficiencyMeasurement, carTags(sample.Vin, sample.CarName),
+		efficiencyFields(sample), sample.Timestamp)
 	if err != nil {
 		return err
 	}
 
-	// Indexed tags
-	tags := map[string]string{
-		"car_name": snapshot.Name,
-		"vin":      snapshot.Vin,
-	}
-
-	// Charging
-	chargeFields := map[string]interface{}{
-		"state":            snapshot.ChargingState,
-		"batt_level":       snapshot.BatteryLevel,
-		"range_left":       snapshot.RangeLeft,
-		"charge_limit_soc": snapshot.ChargeLimitSoc,
-	}
-	if snapshot.ChargeSession != nil {
-		ci := snapshot.ChargeSession
-		chargeFields["voltage"] = ci.Voltage
-		chargeFields["actual_current"] = ci.ActualCurrent
-		chargeFields["pilot_current"] = ci.PilotCurrent
-		chargeFields["charge_miles_added"] = ci.ChargeMilesAdded
-		chargeFields["charge_rate"] = ci.ChargeRate
-		// NOTE: "time_to_full_charge" accidentally stored pointers. We're writing to a new field
-		// until we reset the database.
-		chargeFields["time_to_full_charge_hrs"] = ci.TimeToFullCharge
-	}
-	charge, err := influxdb.NewPoint("charge", tags, chargeFields, snapshot.Timestamp)
+	this.mu.Lock()
+	this.pending = append(this.pending, point)
+	full := this.batchSize <= 1 || len(this.pending) >= this.batchSize*len(snapshotMeasurementNames)
+	this.mu.Unlock()
+	influxPendingPoints.Add(1)
+
+	if !full {
+		return nil
+	}
+	return errors.Wrap(this.flush(), "cannot write efficiency sample to InfluxDB")
+}
+
+func (this *influxDbDatabase) GetEfficiencySamples(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.EfficiencySample, error) {
+	if err := this.flush(); err != nil {
+		glog.Errorf("Cannot flush pending points before reading: %s", err)
+	}
+	points, err := this.queryRange(efficiencyMeasurement, vin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]car.EfficiencySample, 0, len(points))
+	for _, point := range points {
+		samples = append(samples, efficiencyFromFields(vin, point.time(), point))
+	}
+	return samples, nil
+}
+
+// InsertDrainSummary writes a daily drain summary immediately, bypassing the snapshot batch. It replaces the summary
+// written before for the same day, since both have the same timestamp.
+func (this *influxDbDatabase) InsertDrainSummary(ctx context.Context, summary car.DailyDrainSummary) error {
+	err := this.writePoint(drainMeasurement, carTags(summary.Vin, summary.CarName), drainSummaryFields(summary),
+		drainSummaryTime(summary))
+	return errors.Wrap(err, "cannot write drain summary to InfluxDB")
+}
+
+func (this *influxDbDatabase) GetDrainSummaries(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.DailyDrainSummary, error) {
+	points, err := this.queryRange(drainMeasurement, vin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]car.DailyDrainSummary, 0, len(points))
+	for _, point := range points {
+		summaries = append(summaries, drainSummaryFromFields(vin, point))
+	}
+	return summaries, nil
+}
+
+func (this *influxDbDatabase) GetChargeCompleteSnapshots(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.Snapshot, error) {
+	if err := this.flush(); err != nil {
+		glog.Errorf("Cannot flush pending points before reading: %s", err)
+	}
+	charges, err := this.queryVinRange(
+		fmt.Sprintf(`SELECT "batt_level", "range_left" FROM "charge" WHERE "vin" = $vin AND "state" = '%s' `+
+			`AND time >= $from AND time <= $to ORDER BY time`, car.ChargeComplete),
+		"charge", vin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(charges) == 0 {
+		return []car.Snapshot{}, nil
+	}
+	// The odometer is in another measurement, which cannot be joined.
+	positions, err := this.queryVinRange(
+		`SELECT max("odometer") AS "odometer" FROM "position" WHERE "vin" = $vin AND time >= $from AND time <= $to `+
+			`GROUP BY time(1d) fill(none)`,
+		"position", vin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	odometers := dailyOdometers(positions)
+	snapshots := make([]car.Snapshot, 0, len(charges))
+	for _, charge := range charges {
+		snapshots = append(snapshots,
+			chargeCompleteSnapshot(vin, charge.time(), charge, odometers[odometerDay(charge.time())]))
+	}
+	return snapshots, nil
+}
+
+// writePoint writes a single point immediately.
+func (this *influxDbDatabase) writePoint(measurement string, tags map[string]string, fields map[string]interface{},
+	t time.Time) error {
+	point, err := influxdb.NewPoint(measurement, tags, fields, t)
 	if err != nil {
 		return err
 	}
-	bp.AddPoint(charge)
-
-	// Position
-	posMap := map[string]interface{}{
-		"latitude":      snapshot.Bearings.Latitude,
-		"longitude":     snapshot.Bearings.Longitude,
-		"power":         snapshot.Power,
-		"odometer":      snapshot.Odometer,
-		"speed":         snapshot.Bearings.Speed,
-		"driving_state": snapshot.DrivingState,
-	}
-	pos, err := influxdb.NewPoint(
-		"position",
-		tags,
-		posMap,
-		snapshot.Timestamp)
+	bp, err := influxdb.NewBatchPoints(influxdb.BatchPointsConfig{
+		Database:  this.database,
+		Precision: "s",
+	})
 	if err != nil {
 		return err
 	}
-	bp.AddPoint(pos)
+	bp.AddPoint(point)
+	return this.conn.Write(bp)
+}
+
+// queryRange returns the points of a measurement for a VIN within [from, to], oldest first.
+func (this *influxDbDatabase) queryRange(measurement string, vin string, from time.Time,
+	to time.Time) ([]fieldValues, error) {
+	return this.queryVinRange(
+		fmt.Sprintf(`SELECT * FROM %q WHERE "vin" = $vin AND time >= $from AND time <= $to ORDER BY time`,
+			measurement),
+		measurement, vin, from, to)
+}
 
-	// Misc
-	misc, err := influxdb.NewPoint(
-		"misc",
-		tags,
+// queryVinRange runs a query of a measurement, binding the $vin, $from and $to parameters.
+func (this *influxDbDatabase) queryVinRange(query string, measurement string, vin string, from time.Time,
+	to time.Time) ([]fieldValues, error) {
+	q := influxdb.NewQueryWithParameters(
+		query,
+		this.database,
+		"",
 		map[string]interface{}{
-			"wake_state":         snapshot.WakeState,
-			"active_description": snapshot.ActiveDescription,
-		}, snapshot.Timestamp)
+			"vin":  vin,
+			"from": from.UTC().Format(time.RFC3339Nano),
+			"to":   to.UTC().Format(time.RFC3339Nano),
+		})
+	resp, err := this.conn.Query(q)
 	if err != nil {
-		return err
+		return nil, errors.Wrapf(err, "cannot query measurement %s", measurement)
+	}
+	if err := resp.Error(); err != nil {
+		return nil, errors.Wrapf(err, "cannot query measurement %s", measurement)
 	}
-	bp.AddPoint(misc)
 
-	err = this.conn.Write(bp)
+	var points []fieldValues
+	for _, result := range resp.Results {
+		for _, row := range result.Series {
+			for _, value := range row.Values {
+				point := make(fieldValues, len(row.Columns))
+				for i, column := range row.Columns {
+					point[column] = value[i]
+				}
+				points = append(points, point)
+			}
+		}
+	}
+	return points, nil
+}
+
+// flush writes all pending points in a single batch. On failure, the points are kept for the next attempt, up to
+// maxPendingBatches batches. Rewriting a point that was already stored is harmless: InfluxDB overwrites it.
+func (this *influxDbDatabase) flush() error {
+	// Take the pending points, so that inserts don't wait for the write.
+	this.mu.Lock()
+	points := this.pending
+	this.pending = nil
+	this.mu.Unlock()
+	if len(points) == 0 {
+		return nil
+	}
+
+	bp, err := influxdb.NewBatchPoints(influxdb.BatchPointsConfig{
+		Database:  this.database,
+		Precision: "s",
+	})
+	if err == nil {
+		bp.AddPoints(points)
+		err = this.conn.Write(bp)
+	}
 	if err != nil {
+		this.mu.Lock()
+		// Points inserted during the write are newer.
+		this.pending = append(points, this.pending...)
+		limit := maxPendingBatches * this.batchSize * len(snapshotMeasurementNames)
+		if overflow := len(this.pending) - limit; overflow > 0 {
+			glog.Errorf("Dropping %d unwritten InfluxDB points.", overflow)
+			this.pending = this.pending[overflow:]
+			influxPendingPoints.Add(int64(-overflow))
+		}
+		this.mu.Unlock()
 		return err
 	}
 
-	glog.Info("Writing to InfluxDB successful")
+	glog.Infof("Writing %d points to InfluxDB successful", len(points))
+	influxPendingPoints.Add(int64(-len(points)))
 	return nil
 }
 
+// flushLoop flushes pending points every flushInterval until Close is called.
+func (this *influxDbDatabase) flushLoop() {
+	defer close(this.done)
+	ticker := time.NewTicker(this.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+			if err := this.flush(); err != nil {
+				glog.Errorf("Cannot flush points to InfluxDB: %s", err)
+			}
+		}
+	}
+}
+
+// Close flushes all pending points before closing the connection.
 func (this *influxDbDatabase) Close() error {
-	return this.conn.Close()
+	if this.stop != nil {
+		close(this.stop)
+		<-this.done
+	}
+	flushErr := this.flush()
+	if err := this.conn.Close(); err != nil {
+		return err
+	}
+	return errors.Wrap(flushErr, "cannot flush pending points on close")
 }
 
-func OpenInfluxDbDatabase(address string, username string, password string, database string) (Database, error) {
+// OpenInfluxDbDatabase connects to an InfluxDB 1.x server. Snapshots are written in batches of batchSize, and
+// pending points are flushed at least every flushInterval (10 seconds if not positive). Failed batches are kept and
+// retried, but Insert doesn't report their errors, so batching must not be used behind a write buffer.
+func OpenInfluxDbDatabase(address string, username string, password string, database string, batchSize int,
+	flushInterval time.Duration) (Database, error) {
 	// Create a new HTTPClient
 	c, err := influxdb.NewHTTPClient(influxdb.HTTPConfig{
 		Addr:     address,
@@ -114,8 +388,22 @@ func OpenInfluxDbDatabase(address string, username string, password string, data
 		return nil, err
 	}
 
-	return &influxDbDatabase{
-		conn:     c,
-		database: database,
-	}, nil
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultInfluxFlushInterval
+	}
+	db := &influxDbDatabase{
+		conn:          c,
+		database:      database,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+	}
+	if batchSize > 1 {
+		db.stop = make(chan struct{})
+		db.done = make(chan struct{})
+		go db.flushLoop()
+	}
+	return db, nil
 }
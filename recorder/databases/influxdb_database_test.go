@@ -0,0 +1,62 @@
+package databases
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kodek/tesler/recorder/car"
+)
+
+// fakeInfluxDb is a stand-in for the InfluxDB 1.x write endpoint. Writes fail while down is set.
+type fakeInfluxDb struct {
+	mu     sync.Mutex
+	down   bool
+	bodies []string
+}
+
+func (f *fakeInfluxDb) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/write" {
+		http.NotFound(w, r)
+		return
+	}
+	if f.down {
+		http.Error(w, `{"error":"database is down"}`, http.StatusInternalServerError)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	f.bodies = append(f.bodies, string(body))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestInfluxDbWritesEfficiencySampleWithoutBatching(t *testing.T) {
+	fake := &fakeInfluxDb{down: true}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	db, err := OpenInfluxDbDatabase(server.URL, "", "", "tesla", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	efficiencyStore := db.(EfficiencyStore)
+	sample := car.EfficiencySample{Vin: "VIN1", Timestamp: time.Unix(1588413600, 0), Distance: 1}
+
+	if err := efficiencyStore.InsertEfficiencySample(context.Background(), sample); err == nil {
+		t.Error("InsertEfficiencySample() succeeded while InfluxDB was down")
+	}
+	fake.mu.Lock()
+	fake.down = false
+	fake.mu.Unlock()
+	if err := efficiencyStore.InsertEfficiencySample(context.Background(), sample); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.bodies) != 1 || !strings.HasPrefix(fake.bodies[0], efficiencyMeasurement+",") {
+		t.Errorf("wrote %q, want the efficiency sample", fake.bodies)
+	}
+}
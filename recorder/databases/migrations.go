@@ -0,0 +1,70 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// migration is a single, versioned step of a SQL schema. Once released, a migration must never be edited; add a
+// new one instead.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// migrate brings the schema up to date by applying, in order, every migration newer than the recorded version.
+func migrate(ctx context.Context, db *sql.DB, dialect sqlDialect) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version     INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at  TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "cannot create schema_migrations table")
+	}
+
+	var current sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&current); err != nil {
+		return errors.Wrap(err, "cannot read schema version")
+	}
+
+	for _, m := range dialect.migrations {
+		if int64(m.version) <= current.Int64 {
+			continue
+		}
+		glog.Infof("Applying %s migration %d: %s", dialect.name, m.version, m.description)
+		if err := applyMigration(ctx, db, dialect, m); err != nil {
+			return errors.Wrapf(err, "%s migration %d (%s) failed", dialect.name, m.version, m.description)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs all statements of a migration and records it, atomically.
+func applyMigration(ctx context.Context, db *sql.DB, dialect sqlDialect, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range m.statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO schema_migrations (version, description, applied_at) VALUES (%s, %s, %s)",
+			dialect.placeholder(1), dialect.placeholder(2), dialect.placeholder(3)),
+		m.version, m.description, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
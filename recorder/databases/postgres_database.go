@@ -0,0 +1,350 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/golang/glog"
+	"github.com/kodek/tesler/common"
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+var postgresDialect = sqlDialect{
+	name:        "postgres",
+	placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	migrations: []migration{
+		{
+			version:     1,
+			description: "create snapshots table",
+			statements: []string{`
+				CREATE TABLE IF NOT EXISTS snapshots (
+					vin                     TEXT NOT NULL,
+					timestamp               TIMESTAMPTZ NOT NULL,
+					car_name                TEXT,
+					wake_state              TEXT,
+					active_description      TEXT,
+					driving_state           TEXT,
+					latitude                DOUBLE PRECISION,
+					longitude               DOUBLE PRECISION,
+					speed                   DOUBLE PRECISION,
+					power                   DOUBLE PRECISION,
+					odometer                DOUBLE PRECISION,
+					charging_state          TEXT,
+					batt_level              INTEGER,
+					range_left              DOUBLE PRECISION,
+					charge_limit_soc        INTEGER,
+					voltage                 DOUBLE PRECISION,
+					actual_current          DOUBLE PRECISION,
+					pilot_current           DOUBLE PRECISION,
+					charge_miles_added      DOUBLE PRECISION,
+					charge_rate             DOUBLE PRECISION,
+					time_to_full_charge_hrs DOUBLE PRECISION,
+					PRIMARY KEY (vin, timestamp)
+				)`,
+			},
+		},
+		{
+			version:     2,
+			description: "add climate columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN inside_temp DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN outside_temp DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN driver_temp_setting DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN passenger_temp_setting DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN fan_status INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN seat_heater_left INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN seat_heater_right INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN seat_heater_rear_left INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN seat_heater_rear_center INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN seat_heater_rear_right INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN is_climate_on BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN is_auto_conditioning_on BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN is_front_defroster_on BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN is_rear_defroster_on BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN is_preconditioning BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN smart_preconditioning BOOLEAN",
+			},
+		},
+		{
+			version:     3,
+			description: "add security columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN locked BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN driver_front_door_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN driver_rear_door_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN passenger_front_door_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN passenger_rear_door_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN frunk_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN trunk_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN driver_front_window INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN driver_rear_window INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN passenger_front_window INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN passenger_rear_window INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN sentry_mode BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN is_user_present BOOLEAN",
+			},
+		},
+		{
+			version:     4,
+			description: "add software columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN car_version TEXT",
+				"ALTER TABLE snapshots ADD COLUMN update_status TEXT",
+				"ALTER TABLE snapshots ADD COLUMN update_version TEXT",
+				"ALTER TABLE snapshots ADD COLUMN update_expected_duration_sec INTEGER",
+			},
+		},
+		{
+			version:     5,
+			description: "add drive state detail columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN heading INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN gps_as_of BIGINT",
+				"ALTER TABLE snapshots ADD COLUMN native_latitude DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN native_longitude DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN native_type TEXT",
+				"ALTER TABLE snapshots ADD COLUMN elevation DOUBLE PRECISION",
+			},
+		},
+		{
+			version:     6,
+			description: "add extended battery and charging columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN usable_batt_level INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN ideal_range DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN est_range DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN battery_heater_on BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN charge_port_door_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN charge_port_latch TEXT",
+				"ALTER TABLE snapshots ADD COLUMN scheduled_charging_start_time BIGINT",
+				"ALTER TABLE snapshots ADD COLUMN charge_energy_added DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN charger_phases INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN charger_power DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN fast_charger_present BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN fast_charger_type TEXT",
+				"ALTER TABLE snapshots ADD COLUMN fast_charger_brand TEXT",
+			},
+		},
+		{
+			version:     7,
+			description: "add tire pressure columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN tpms_pressure_fl DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN tpms_pressure_fr DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN tpms_pressure_rl DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN tpms_pressure_rr DOUBLE PRECISION",
+				"ALTER TABLE snapshots ADD COLUMN tpms_soft_warning_fl BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_soft_warning_fr BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_soft_warning_rl BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_soft_warning_rr BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_hard_warning_fl BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_hard_warning_fr BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_hard_warning_rl BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_hard_warning_rr BOOLEAN",
+			},
+		},
+		{
+			version:     8,
+			description: "create trips table",
+			statements: []string{`
+				CREATE TABLE trips (
+					vin              TEXT NOT NULL,
+					car_name         TEXT,
+					start_time       TIMESTAMPTZ NOT NULL,
+					end_time         TIMESTAMPTZ NOT NULL,
+					start_latitude   DOUBLE PRECISION,
+					start_longitude  DOUBLE PRECISION,
+					end_latitude     DOUBLE PRECISION,
+					end_longitude    DOUBLE PRECISION,
+					start_odometer   DOUBLE PRECISION,
+					end_odometer     DOUBLE PRECISION,
+					distance         DOUBLE PRECISION,
+					duration_sec     BIGINT,
+					start_batt_level INTEGER,
+					end_batt_level   INTEGER,
+					start_range      DOUBLE PRECISION,
+					end_range        DOUBLE PRECISION,
+					energy_used_kwh  DOUBLE PRECISION,
+					max_speed        DOUBLE PRECISION,
+					avg_speed        DOUBLE PRECISION,
+					PRIMARY KEY (vin, start_time)
+				)`,
+			},
+		},
+		{
+			version:     9,
+			description: "create charging sessions table",
+			statements: []string{`
+				CREATE TABLE charging_sessions (
+					vin                TEXT NOT NULL,
+					car_name           TEXT,
+					start_time         TIMESTAMPTZ NOT NULL,
+					end_time           TIMESTAMPTZ NOT NULL,
+					latitude           DOUBLE PRECISION,
+					longitude          DOUBLE PRECISION,
+					start_batt_level   INTEGER,
+					end_batt_level     INTEGER,
+					charge_limit_soc   INTEGER,
+					energy_added_kwh   DOUBLE PRECISION,
+					peak_power         DOUBLE PRECISION,
+					avg_power          DOUBLE PRECISION,
+					dc                 BOOLEAN,
+					fast_charger_type  TEXT,
+					fast_charger_brand TEXT,
+					reached_limit      BOOLEAN,
+					duration_sec       BIGINT,
+					PRIMARY KEY (vin, start_time)
+				)`,
+			},
+		},
+		{
+			version:     10,
+			description: "add trip efficiency and create efficiency samples table",
+			statements: []string{
+				"ALTER TABLE trips ADD COLUMN wh_per_mile DOUBLE PRECISION",
+				"ALTER TABLE trips ADD COLUMN wh_per_km DOUBLE PRECISION",
+				`CREATE TABLE efficiency_samples (
+					vin             TEXT NOT NULL,
+					car_name        TEXT,
+					timestamp       TIMESTAMPTZ NOT NULL,
+					duration_sec    DOUBLE PRECISION,
+					distance        DOUBLE PRECISION,
+					energy_used_kwh DOUBLE PRECISION,
+					avg_speed       DOUBLE PRECISION,
+					wh_per_mile     DOUBLE PRECISION,
+					outside_temp    DOUBLE PRECISION,
+					PRIMARY KEY (vin, timestamp)
+				)`,
+			},
+		},
+		{
+			version:     11,
+			description: "add end range and odometer to charging sessions",
+			statements: []string{
+				"ALTER TABLE charging_sessions ADD COLUMN end_range DOUBLE PRECISION",
+				"ALTER TABLE charging_sessions ADD COLUMN odometer DOUBLE PRECISION",
+			},
+		},
+		{
+			version:     12,
+			description: "add geofence places",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN place TEXT",
+				"ALTER TABLE trips ADD COLUMN start_place TEXT",
+				"ALTER TABLE trips ADD COLUMN end_place TEXT",
+				"ALTER TABLE charging_sessions ADD COLUMN place TEXT",
+			},
+		},
+		{
+			version:     13,
+			description: "add charging session cost",
+			statements: []string{
+				"ALTER TABLE charging_sessions ADD COLUMN cost DOUBLE PRECISION",
+				"ALTER TABLE charging_sessions ADD COLUMN currency TEXT",
+			},
+		},
+		{
+			version:     14,
+			description: "add center display state",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN center_display_state INTEGER",
+			},
+		},
+		{
+			version:     15,
+			description: "create drain summaries table",
+			statements: []string{
+				`CREATE TABLE drain_summaries (
+					vin                TEXT NOT NULL,
+					car_name           TEXT,
+					date               TEXT NOT NULL,
+					timestamp          TIMESTAMPTZ NOT NULL,
+					hours              DOUBLE PRECISION,
+					range_lost         DOUBLE PRECISION,
+					soc_lost           DOUBLE PRECISION,
+					complete           BOOLEAN,
+					sentry_hours       DOUBLE PRECISION,
+					sentry_range_lost  DOUBLE PRECISION,
+					sentry_soc_lost    DOUBLE PRECISION,
+					climate_hours      DOUBLE PRECISION,
+					climate_range_lost DOUBLE PRECISION,
+					climate_soc_lost   DOUBLE PRECISION,
+					awake_hours        DOUBLE PRECISION,
+					awake_range_lost   DOUBLE PRECISION,
+					awake_soc_lost     DOUBLE PRECISION,
+					asleep_hours       DOUBLE PRECISION,
+					asleep_range_lost  DOUBLE PRECISION,
+					asleep_soc_lost    DOUBLE PRECISION,
+					PRIMARY KEY (vin, date)
+				)`,
+			},
+		},
+		{
+			version:     16,
+			description: "add integrated trip energy",
+			statements: []string{
+				"ALTER TABLE trips ADD COLUMN integrated_energy_kwh DOUBLE PRECISION",
+			},
+		},
+	},
+}
+
+// OpenPostgresDatabase connects to PostgreSQL and migrates the schema. If conf.Timescale is set, snapshots are
+// stored in a TimescaleDB hypertable.
+func OpenPostgresDatabase(conf common.PostgresConfig) (Database, error) {
+	db, err := sql.Open("postgres", postgresConnectionString(conf))
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "cannot connect to postgres")
+	}
+
+	if err := migrate(ctx, db, postgresDialect); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if conf.Timescale {
+		if err := createHypertables(ctx, db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &sqlDatabase{
+		db:      db,
+		dialect: postgresDialect,
+	}, nil
+}
+
+// createHypertables converts the time series tables into TimescaleDB hypertables. It's a no-op for tables that
+// already are.
+func createHypertables(ctx context.Context, db *sql.DB) error {
+	glog.Info("Ensuring TimescaleDB hypertables exist")
+	if _, err := db.ExecContext(ctx, "CREATE EXTENSION IF NOT EXISTS timescaledb"); err != nil {
+		return errors.Wrap(err, "cannot enable timescaledb extension")
+	}
+	_, err := db.ExecContext(ctx,
+		"SELECT create_hypertable('snapshots', 'timestamp', if_not_exists => TRUE, migrate_data => TRUE)")
+	return errors.Wrap(err, "cannot create snapshots hypertable")
+}
+
+func postgresConnectionString(conf common.PostgresConfig) string {
+	sslMode := conf.SslMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(conf.Username, conf.Password),
+		Host:     conf.Address,
+		Path:     conf.Database,
+		RawQuery: url.Values{"sslmode": []string{sslMode}}.Encode(),
+	}
+	return u.String()
+}
@@ -0,0 +1,464 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/pkg/errors"
+)
+
+// sqlDialect captures the differences between the SQL engines that back sqlDatabase.
+type sqlDialect struct {
+	name string
+	// placeholder returns the bind parameter for the n-th (1-based) query argument.
+	placeholder func(n int) string
+	migrations  []migration
+}
+
+// snapshotColumns lists the columns of the snapshots table, as produced by snapshotRow.
+var snapshotColumns = []string{
+	"vin", "timestamp", "car_name", "wake_state", "active_description", "driving_state",
+	"latitude", "longitude", "speed", "power", "odometer",
+	"charging_state", "batt_level", "range_left", "charge_limit_soc",
+	"voltage", "actual_current", "pilot_current", "charge_miles_added", "charge_rate", "time_to_full_charge_hrs",
+	"inside_temp", "outside_temp", "driver_temp_setting", "passenger_temp_setting", "fan_status",
+	"seat_heater_left", "seat_heater_right", "seat_heater_rear_left", "seat_heater_rear_center",
+	"seat_heater_rear_right", "is_climate_on", "is_auto_conditioning_on", "is_front_defroster_on",
+	"is_rear_defroster_on", "is_preconditioning", "smart_preconditioning",
+	"locked", "driver_front_door_open", "driver_rear_door_open", "passenger_front_door_open",
+	"passenger_rear_door_open", "frunk_open", "trunk_open", "driver_front_window", "driver_rear_window",
+	"passenger_front_window", "passenger_rear_window", "sentry_mode", "is_user_present",
+	"car_version", "update_status", "update_version", "update_expected_duration_sec",
+	"heading", "gps_as_of", "native_latitude", "native_longitude", "native_type", "elevation",
+	"usable_batt_level", "ideal_range", "est_range", "battery_heater_on", "charge_port_door_open", "charge_port_latch",
+	"scheduled_charging_start_time", "charge_energy_added", "charger_phases", "charger_power", "fast_charger_present",
+	"fast_charger_type", "fast_charger_brand",
+	"tpms_pressure_fl", "tpms_pressure_fr", "tpms_pressure_rl", "tpms_pressure_rr", "tpms_soft_warning_fl",
+	"tpms_soft_warning_fr", "tpms_soft_warning_rl", "tpms_soft_warning_rr", "tpms_hard_warning_fl",
+	"tpms_hard_warning_fr", "tpms_hard_warning_rl", "tpms_hard_warning_rr",
+	"place", "center_display_state",
+}
+
+// tripColumns lists the columns of the trips table.
+var tripColumns = []string{
+	"vin", "car_name", "start_time", "end_time", "start_latitude", "start_longitude", "end_latitude", "end_longitude",
+	"start_odometer", "end_odometer", "distance", "duration_sec", "start_batt_level", "end_batt_level", "start_range",
+	"end_range", "energy_used_kwh", "max_speed", "avg_speed", "wh_per_mile", "wh_per_km", "start_place", "end_place",
+	"integrated_energy_kwh",
+}
+
+// chargingSessionColumns lists the columns of the charging_sessions table.
+var chargingSessionColumns = []string{
+	"vin", "car_name", "start_time", "end_time", "latitude", "longitude", "start_batt_level", "end_batt_level",
+	"charge_limit_soc", "energy_added_kwh", "peak_power", "avg_power", "dc", "fast_charger_type", "fast_charger_brand",
+	"reached_limit", "duration_sec", "end_range", "odometer", "place", "cost", "currency",
+}
+
+// efficiencyColumns lists the columns of the efficiency_samples table.
+var efficiencyColumns = []string{
+	"vin", "car_name", "timestamp", "duration_sec", "distance", "energy_used_kwh", "avg_speed", "wh_per_mile",
+	"outside_temp",
+}
+
+// drainSummaryColumns lists the columns of the drain_summaries table.
+var drainSummaryColumns = []string{
+	"vin", "car_name", "date", "timestamp", "hours", "range_lost", "soc_lost", "complete",
+	"sentry_hours", "sentry_range_lost", "sentry_soc_lost", "climate_hours", "climate_range_lost", "climate_soc_lost",
+	"awake_hours", "awake_range_lost", "awake_soc_lost", "asleep_hours", "asleep_range_lost", "asleep_soc_lost",
+}
+
+// sqlDatabase stores snapshots in a relational database through database/sql.
+type sqlDatabase struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func (this *sqlDatabase) GetLatest(ctx context.Context, vin string) (*car.Snapshot, error) {
+	rows, err := this.queryRows(ctx,
+		fmt.Sprintf("SELECT %s FROM snapshots WHERE vin = %s ORDER BY timestamp DESC LIMIT 1",
+			strings.Join(snapshotColumns, ", "), this.dialect.placeholder(1)),
+		vin)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read latest snapshot from %s", this.dialect.name)
+	}
+	if len(rows) == 0 {
+		return nil, errors.Wrapf(ErrNoData, "no snapshots for VIN %s", vin)
+	}
+	return snapshotFromRow(rows[0]), nil
+}
+
+func (this *sqlDatabase) Insert(ctx context.Context, snapshot car.Snapshot) error {
+	glog.Infof("Recording measurement to %s", this.dialect.name)
+
+	if err := this.insertRow(ctx, "snapshots", snapshotColumns, snapshotRow(snapshot)); err != nil {
+		return errors.Wrapf(err, "cannot insert snapshot into %s", this.dialect.name)
+	}
+
+	glog.Infof("Writing to %s successful", this.dialect.name)
+	return nil
+}
+
+func (this *sqlDatabase) InsertTrip(ctx context.Context, trip car.Trip) error {
+	row := tripFields(trip)
+	row["vin"] = trip.Vin
+	row["car_name"] = trip.CarName
+	row["start_time"] = trip.StartTime.UTC()
+	row["end_time"] = trip.EndTime.UTC()
+	return errors.Wrapf(this.insertRow(ctx, "trips", tripColumns, row), "cannot insert trip into %s", this.dialect.name)
+}
+
+func (this *sqlDatabase) GetTrips(ctx context.Context, vin string, from time.Time, to time.Time) ([]car.Trip, error) {
+	rows, err := this.queryRows(ctx,
+		fmt.Sprintf("SELECT %s FROM trips WHERE vin = %s AND start_time >= %s AND start_time <= %s ORDER BY start_time",
+			strings.Join(tripColumns, ", "),
+			this.dialect.placeholder(1), this.dialect.placeholder(2), this.dialect.placeholder(3)),
+		vin, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read trips from %s", this.dialect.name)
+	}
+
+	trips := make([]car.Trip, 0, len(rows))
+	for _, row := range rows {
+		trips = append(trips, tripFromFields(vin, row.timestamp("start_time"), row.timestamp("end_time"), row))
+	}
+	return trips, nil
+}
+
+func (this *sqlDatabase) InsertChargingSession(ctx context.Context, session car.ChargingSession) error {
+	row := chargingSessionFields(session)
+	row["vin"] = session.Vin
+	row["car_name"] = session.CarName
+	row["start_time"] = session.StartTime.UTC()
+	row["end_time"] = session.EndTime.UTC()
+	return errors.Wrapf(this.insertRow(ctx, "charging_sessions", chargingSessionColumns, row),
+		"cannot insert charging session into %s", this.dialect.name)
+}
+
+func (this *sqlDatabase) GetChargingSessions(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.ChargingSession, error) {
+	rows, err := this.queryRows(ctx,
+		fmt.Sprintf("SELECT %s FROM charging_sessions WHERE vin = %s AND start_time >= %s AND start_time <= %s "+
+			"ORDER BY start_time",
+			strings.Join(chargingSessionColumns, ", "),
+			this.dialect.placeholder(1), this.dialect.placeholder(2), this.dialect.placeholder(3)),
+		vin, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read charging sessions from %s", this.dialect.name)
+	}
+
+	sessions := make([]car.ChargingSession, 0, len(rows))
+	for _, row := range rows {
+		sessions = append(sessions,
+			chargingSessionFromFields(vin, row.timestamp("start_time"), row.timestamp("end_time"), row))
+	}
+	return sessions, nil
+}
+
+func (this *sqlDatabase) InsertEfficiencySample(ctx context.Context, sample car.EfficiencySample) error {
+	row := efficiencyFields(sample)
+	row["vin"] = sample.Vin
+	row["car_name"] = sample.CarName
+	row["timestamp"] = sample.Timestamp.UTC()
+	return errors.Wrapf(this.insertRow(ctx, "efficiency_samples", efficiencyColumns, row),
+		"cannot insert efficiency sample into %s", this.dialect.name)
+}
+
+func (this *sqlDatabase) GetEfficiencySamples(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.EfficiencySample, error) {
+	rows, err := this.queryRows(ctx,
+		fmt.Sprintf("SELECT %s FROM efficiency_samples WHERE vin = %s AND timestamp >= %s AND timestamp <= %s "+
+			"ORDER BY timestamp",
+			strings.Join(efficiencyColumns, ", "),
+			this.dialect.placeholder(1), this.dialect.placeholder(2), this.dialect.placeholder(3)),
+		vin, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read efficiency samples from %s", this.dialect.name)
+	}
+
+	samples := make([]car.EfficiencySample, 0, len(rows))
+	for _, row := range rows {
+		samples = append(samples, efficiencyFromFields(vin, row.timestamp("timestamp"), row))
+	}
+	return samples, nil
+}
+
+func (this *sqlDatabase) GetChargeCompleteSnapshots(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.Snapshot, error) {
+	rows, err := this.queryRows(ctx,
+		fmt.Sprintf("SELECT timestamp, batt_level, range_left, odometer FROM snapshots WHERE vin = %s "+
+			"AND charging_state = %s AND timestamp >= %s AND timestamp <= %s ORDER BY timestamp",
+			this.dialect.placeholder(1), this.dialect.placeholder(2), this.dialect.placeholder(3),
+			this.dialect.placeholder(4)),
+		vin, car.ChargeComplete, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read snapshots from %s", this.dialect.name)
+	}
+
+	snapshots := make([]car.Snapshot, 0, len(rows))
+	for _, row := range rows {
+		snapshots = append(snapshots, chargeCompleteSnapshot(vin, row.timestamp("timestamp"), row,
+			row.float("odometer")))
+	}
+	return snapshots, nil
+}
+
+func (this *sqlDatabase) InsertDrainSummary(ctx context.Context, summary car.DailyDrainSummary) error {
+	row := drainSummaryFields(summary)
+	row["vin"] = summary.Vin
+	row["car_name"] = summary.CarName
+	row["timestamp"] = drainSummaryTime(summary)
+	return errors.Wrapf(this.upsertRow(ctx, "drain_summaries", []string{"vin", "date"}, drainSummaryColumns, row),
+		"cannot insert drain summary into %s", this.dialect.name)
+}
+
+func (this *sqlDatabase) GetDrainSummaries(ctx context.Context, vin string, from time.Time,
+	to time.Time) ([]car.DailyDrainSummary, error) {
+	rows, err := this.queryRows(ctx,
+		fmt.Sprintf("SELECT %s FROM drain_summaries WHERE vin = %s AND timestamp >= %s AND timestamp <= %s "+
+			"ORDER BY timestamp",
+			strings.Join(drainSummaryColumns, ", "),
+			this.dialect.placeholder(1), this.dialect.placeholder(2), this.dialect.placeholder(3)),
+		vin, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read drain summaries from %s", this.dialect.name)
+	}
+
+	summaries := make([]car.DailyDrainSummary, 0, len(rows))
+	for _, row := range rows {
+		summaries = append(summaries, drainSummaryFromFields(vin, row))
+	}
+	return summaries, nil
+}
+
+// insertRow inserts the given columns of a row into a table. Missing columns are stored as NULL. Inserting a row
+// with an existing primary key is a no-op, so replaying writes is not an error.
+func (this *sqlDatabase) insertRow(ctx context.Context, table string, columns []string, row map[string]interface{}) error {
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		values[i] = row[column]
+	}
+	_, err := this.db.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING",
+			table, strings.Join(columns, ", "), this.placeholders(len(columns))),
+		values...)
+	return err
+}
+
+// upsertRow inserts the given columns of a row into a table, or updates them if a row with the same key exists.
+func (this *sqlDatabase) upsertRow(ctx context.Context, table string, key []string, columns []string,
+	row map[string]interface{}) error {
+	values := make([]interface{}, len(columns))
+	updates := make([]string, 0, len(columns))
+	for i, column := range columns {
+		values[i] = row[column]
+		updates = append(updates, fmt.Sprintf("%s = excluded.%s", column, column))
+	}
+	_, err := this.db.ExecContext(ctx,
+		fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO UPDATE SET %s",
+			table, strings.Join(columns, ", "), this.placeholders(len(columns)), strings.Join(key, ", "),
+			strings.Join(updates, ", ")),
+		values...)
+	return err
+}
+
+// queryRows runs a query and reads all resulting rows.
+func (this *sqlDatabase) queryRows(ctx context.Context, query string, args ...interface{}) ([]fieldValues, error) {
+	rows, err := this.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []fieldValues
+	for rows.Next() {
+		row, err := scanRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+func (this *sqlDatabase) Close() error {
+	return this.db.Close()
+}
+
+// placeholders returns a comma-separated list of n bind parameters.
+func (this *sqlDatabase) placeholders(n int) string {
+	params := make([]string, n)
+	for i := range params {
+		params[i] = this.dialect.placeholder(i + 1)
+	}
+	return strings.Join(params, ", ")
+}
+
+// snapshotRow flattens a snapshot into the columns of the snapshots table. Columns of optional parts of the
+// snapshot are left out (and stored as NULL) when those parts are missing.
+func snapshotRow(snapshot car.Snapshot) map[string]interface{} {
+	row := map[string]interface{}{
+		"vin":                snapshot.Vin,
+		"timestamp":          snapshot.Timestamp.UTC(),
+		"car_name":           snapshot.Name,
+		"wake_state":         snapshot.WakeState,
+		"active_description": snapshot.ActiveDescription,
+		"charging_state":     snapshot.ChargingState,
+		"batt_level":         snapshot.BatteryLevel,
+		"range_left":         snapshot.RangeLeft,
+		"charge_limit_soc":   snapshot.ChargeLimitSoc,
+		"place":              snapshot.Place,
+	}
+
+	// Position columns include power, odometer and driving state.
+	for column, value := range positionFields(snapshot) {
+		row[column] = value
+	}
+	row["center_display_state"] = snapshot.CenterDisplayState
+
+	if ci := snapshot.ChargeSession; ci != nil {
+		row["voltage"] = ci.Voltage
+		row["actual_current"] = ci.ActualCurrent
+		row["pilot_current"] = ci.PilotCurrent
+		row["charge_miles_added"] = ci.ChargeMilesAdded
+		row["charge_rate"] = ci.ChargeRate
+		row["time_to_full_charge_hrs"] = ci.TimeToFullCharge
+	}
+	for column, value := range chargeDetailFields(snapshot) {
+		row[column] = value
+	}
+
+	if c := snapshot.Climate; c != nil {
+		row["inside_temp"] = c.InsideTemp
+		row["outside_temp"] = c.OutsideTemp
+		row["driver_temp_setting"] = c.DriverTempSetting
+		row["passenger_temp_setting"] = c.PassengerTempSetting
+		row["fan_status"] = c.FanStatus
+		row["seat_heater_left"] = c.SeatHeaterLeft
+		row["seat_heater_right"] = c.SeatHeaterRight
+		row["seat_heater_rear_left"] = c.SeatHeaterRearLeft
+		row["seat_heater_rear_center"] = c.SeatHeaterRearCenter
+		row["seat_heater_rear_right"] = c.SeatHeaterRearRight
+		row["is_climate_on"] = c.IsClimateOn
+		row["is_auto_conditioning_on"] = c.IsAutoConditioningOn
+		row["is_front_defroster_on"] = c.IsFrontDefrosterOn
+		row["is_rear_defroster_on"] = c.IsRearDefrosterOn
+		row["is_preconditioning"] = c.IsPreconditioning
+		row["smart_preconditioning"] = c.SmartPreconditioning
+	}
+
+	if sec := snapshot.Security; sec != nil {
+		row["locked"] = sec.Locked
+		row["driver_front_door_open"] = sec.DriverFrontDoorOpen
+		row["driver_rear_door_open"] = sec.DriverRearDoorOpen
+		row["passenger_front_door_open"] = sec.PassengerFrontDoorOpen
+		row["passenger_rear_door_open"] = sec.PassengerRearDoorOpen
+		row["frunk_open"] = sec.FrunkOpen
+		row["trunk_open"] = sec.TrunkOpen
+		row["driver_front_window"] = sec.DriverFrontWindow
+		row["driver_rear_window"] = sec.DriverRearWindow
+		row["passenger_front_window"] = sec.PassengerFrontWindow
+		row["passenger_rear_window"] = sec.PassengerRearWindow
+		row["sentry_mode"] = sec.SentryMode
+		row["is_user_present"] = sec.IsUserPresent
+	}
+
+	if sw := snapshot.Software; sw != nil {
+		row["car_version"] = sw.Version
+		row["update_status"] = sw.UpdateStatus
+		row["update_version"] = sw.UpdateVersion
+		row["update_expected_duration_sec"] = sw.UpdateExpectedDurationSec
+	}
+
+	if t := snapshot.Tires; t != nil {
+		row["tpms_pressure_fl"] = t.FrontLeftPressure
+		row["tpms_pressure_fr"] = t.FrontRightPressure
+		row["tpms_pressure_rl"] = t.RearLeftPressure
+		row["tpms_pressure_rr"] = t.RearRightPressure
+		row["tpms_soft_warning_fl"] = t.FrontLeftSoftWarning
+		row["tpms_soft_warning_fr"] = t.FrontRightSoftWarning
+		row["tpms_soft_warning_rl"] = t.RearLeftSoftWarning
+		row["tpms_soft_warning_rr"] = t.RearRightSoftWarning
+		row["tpms_hard_warning_fl"] = t.FrontLeftHardWarning
+		row["tpms_hard_warning_fr"] = t.FrontRightHardWarning
+		row["tpms_hard_warning_rl"] = t.RearLeftHardWarning
+		row["tpms_hard_warning_rr"] = t.RearRightHardWarning
+	}
+	return row
+}
+
+// scanRow reads the current row into fieldValues, keyed by column name.
+func scanRow(rows *sql.Rows) (fieldValues, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	row := make(fieldValues, len(columns))
+	for i, column := range columns {
+		row[column] = values[i]
+	}
+	return row, nil
+}
+
+// snapshotFromRow is the inverse of snapshotRow.
+func snapshotFromRow(row fieldValues) *car.Snapshot {
+	snapshot := &car.Snapshot{
+		Timestamp:         row.timestamp("timestamp"),
+		Name:              row.string("car_name"),
+		Vin:               row.string("vin"),
+		WakeState:         row.string("wake_state"),
+		ActiveDescription: row.string("active_description"),
+		DrivingState:      row.string("driving_state"),
+		Bearings:          bearingsFromFields(row),
+		Place:             row.string("place"),
+		ChargingState:     row.string("charging_state"),
+		Power:             row.float("power"),
+		BatteryLevel:      row.int("batt_level"),
+		RangeLeft:         row.float("range_left"),
+		ChargeLimitSoc:    row.int("charge_limit_soc"),
+		Odometer:          row.float("odometer"),
+	}
+	snapshot.CenterDisplayState = row.int("center_display_state")
+
+	if row.has("voltage") {
+		snapshot.ChargeSession = &car.ChargeSession{
+			Voltage:          row.float("voltage"),
+			ActualCurrent:    row.float("actual_current"),
+			PilotCurrent:     row.float("pilot_current"),
+			ChargeMilesAdded: row.float("charge_miles_added"),
+			ChargeRate:       row.float("charge_rate"),
+			TimeToFullCharge: row.float("time_to_full_charge_hrs"),
+		}
+	}
+	readChargeDetailFields(row, snapshot)
+
+	if row.has("is_climate_on") {
+		snapshot.Climate = climateFromFields(row)
+	}
+
+	if row.has("locked") {
+		snapshot.Security = securityFromFields(row)
+	}
+
+	if row.has("car_version") {
+		snapshot.Software = softwareFromFields(row)
+	}
+
+	if row.has("tpms_pressure_fl") {
+		snapshot.Tires = tiresFromFields(row)
+	}
+	return snapshot
+}
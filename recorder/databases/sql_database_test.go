@@ -0,0 +1,95 @@
+package databases
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kodek/tesler/recorder/car"
+)
+
+func TestSqliteDrainSummaryReplacesSameDay(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenSqliteDatabase(bufferPath(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	drainStore := db.(DrainSummaryStore)
+
+	summary := car.DailyDrainSummary{
+		Vin:     "VIN1",
+		CarName: "My Car",
+		Date:    "2020-05-02",
+		ByCause: map[string]*car.DrainStats{car.DrainAsleep: {}},
+	}
+	summary.ByCause[car.DrainAsleep].Add(8, 2, 1)
+	summary.Total.Add(8, 2, 1)
+	if err := drainStore.InsertDrainSummary(ctx, summary); err != nil {
+		t.Fatal(err)
+	}
+	summary.ByCause[car.DrainSentry] = &car.DrainStats{}
+	summary.ByCause[car.DrainSentry].Add(4, 6, 2)
+	summary.Total.Add(4, 6, 2)
+	summary.Complete = true
+	if err := drainStore.InsertDrainSummary(ctx, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	summaries, err := drainStore.GetDrainSummaries(ctx, "VIN1", time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 5, 3, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 {
+		t.Fatalf("got %d summaries, want the day stored once", len(summaries))
+	}
+	got := summaries[0]
+	if got.Date != "2020-05-02" || got.CarName != "My Car" || !got.Complete || got.Total.Hours != 12 ||
+		got.Total.RangeLost != 8 {
+		t.Errorf("unexpected summary: %+v", got)
+	}
+	if sentry := got.ByCause[car.DrainSentry]; sentry == nil || sentry.RangeLostPerHour != 1.5 {
+		t.Errorf("sentry drain = %+v", sentry)
+	}
+	if _, ok := got.ByCause[car.DrainClimate]; ok {
+		t.Error("got climate drain, want none")
+	}
+}
+
+func TestSqliteGetChargeCompleteSnapshots(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenSqliteDatabase(bufferPath(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	start := time.Date(2020, 5, 2, 10, 0, 0, 0, time.UTC)
+	for i, state := range []string{"Charging", car.ChargeComplete, "Disconnected", car.ChargeComplete} {
+		snapshot := car.Snapshot{
+			Vin:           "VIN1",
+			Timestamp:     start.Add(time.Duration(i) * time.Hour),
+			ChargingState: state,
+			BatteryLevel:  80 + i,
+			RangeLeft:     250,
+			Odometer:      1000 + float64(i),
+		}
+		if err := db.Insert(ctx, snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshots, err := db.(ChargeCompleteStore).GetChargeCompleteSnapshots(ctx, "VIN1", start, start.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("got %d snapshots, want the 2 with a complete charge", len(snapshots))
+	}
+	s := snapshots[1]
+	if s.BatteryLevel != 83 || s.RangeLeft != 250 || s.Odometer != 1003 || s.ChargingState != car.ChargeComplete ||
+		!s.Timestamp.Equal(start.Add(3*time.Hour)) {
+		t.Errorf("unexpected snapshot: %+v", s)
+	}
+}
@@ -0,0 +1,310 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	_ "modernc.org/sqlite"
+)
+
+var sqliteDialect = sqlDialect{
+	name:        "sqlite",
+	placeholder: func(n int) string { return "?" },
+	migrations: []migration{
+		{
+			version:     1,
+			description: "create snapshots table",
+			statements: []string{`
+				CREATE TABLE IF NOT EXISTS snapshots (
+					vin                     TEXT NOT NULL,
+					timestamp               TIMESTAMP NOT NULL,
+					car_name                TEXT,
+					wake_state              TEXT,
+					active_description      TEXT,
+					driving_state           TEXT,
+					latitude                REAL,
+					longitude               REAL,
+					speed                   REAL,
+					power                   REAL,
+					odometer                REAL,
+					charging_state          TEXT,
+					batt_level              INTEGER,
+					range_left              REAL,
+					charge_limit_soc        INTEGER,
+					voltage                 REAL,
+					actual_current          REAL,
+					pilot_current           REAL,
+					charge_miles_added      REAL,
+					charge_rate             REAL,
+					time_to_full_charge_hrs REAL,
+					PRIMARY KEY (vin, timestamp)
+				)`,
+			},
+		},
+		{
+			version:     2,
+			description: "add climate columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN inside_temp REAL",
+				"ALTER TABLE snapshots ADD COLUMN outside_temp REAL",
+				"ALTER TABLE snapshots ADD COLUMN driver_temp_setting REAL",
+				"ALTER TABLE snapshots ADD COLUMN passenger_temp_setting REAL",
+				"ALTER TABLE snapshots ADD COLUMN fan_status INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN seat_heater_left INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN seat_heater_right INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN seat_heater_rear_left INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN seat_heater_rear_center INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN seat_heater_rear_right INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN is_climate_on BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN is_auto_conditioning_on BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN is_front_defroster_on BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN is_rear_defroster_on BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN is_preconditioning BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN smart_preconditioning BOOLEAN",
+			},
+		},
+		{
+			version:     3,
+			description: "add security columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN locked BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN driver_front_door_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN driver_rear_door_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN passenger_front_door_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN passenger_rear_door_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN frunk_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN trunk_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN driver_front_window INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN driver_rear_window INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN passenger_front_window INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN passenger_rear_window INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN sentry_mode BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN is_user_present BOOLEAN",
+			},
+		},
+		{
+			version:     4,
+			description: "add software columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN car_version TEXT",
+				"ALTER TABLE snapshots ADD COLUMN update_status TEXT",
+				"ALTER TABLE snapshots ADD COLUMN update_version TEXT",
+				"ALTER TABLE snapshots ADD COLUMN update_expected_duration_sec INTEGER",
+			},
+		},
+		{
+			version:     5,
+			description: "add drive state detail columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN heading INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN gps_as_of INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN native_latitude REAL",
+				"ALTER TABLE snapshots ADD COLUMN native_longitude REAL",
+				"ALTER TABLE snapshots ADD COLUMN native_type TEXT",
+				"ALTER TABLE snapshots ADD COLUMN elevation REAL",
+			},
+		},
+		{
+			version:     6,
+			description: "add extended battery and charging columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN usable_batt_level INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN ideal_range REAL",
+				"ALTER TABLE snapshots ADD COLUMN est_range REAL",
+				"ALTER TABLE snapshots ADD COLUMN battery_heater_on BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN charge_port_door_open BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN charge_port_latch TEXT",
+				"ALTER TABLE snapshots ADD COLUMN scheduled_charging_start_time INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN charge_energy_added REAL",
+				"ALTER TABLE snapshots ADD COLUMN charger_phases INTEGER",
+				"ALTER TABLE snapshots ADD COLUMN charger_power REAL",
+				"ALTER TABLE snapshots ADD COLUMN fast_charger_present BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN fast_charger_type TEXT",
+				"ALTER TABLE snapshots ADD COLUMN fast_charger_brand TEXT",
+			},
+		},
+		{
+			version:     7,
+			description: "add tire pressure columns",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN tpms_pressure_fl REAL",
+				"ALTER TABLE snapshots ADD COLUMN tpms_pressure_fr REAL",
+				"ALTER TABLE snapshots ADD COLUMN tpms_pressure_rl REAL",
+				"ALTER TABLE snapshots ADD COLUMN tpms_pressure_rr REAL",
+				"ALTER TABLE snapshots ADD COLUMN tpms_soft_warning_fl BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_soft_warning_fr BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_soft_warning_rl BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_soft_warning_rr BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_hard_warning_fl BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_hard_warning_fr BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_hard_warning_rl BOOLEAN",
+				"ALTER TABLE snapshots ADD COLUMN tpms_hard_warning_rr BOOLEAN",
+			},
+		},
+		{
+			version:     8,
+			description: "create trips table",
+			statements: []string{`
+				CREATE TABLE trips (
+					vin              TEXT NOT NULL,
+					car_name         TEXT,
+					start_time       TIMESTAMP NOT NULL,
+					end_time         TIMESTAMP NOT NULL,
+					start_latitude   REAL,
+					start_longitude  REAL,
+					end_latitude     REAL,
+					end_longitude    REAL,
+					start_odometer   REAL,
+					end_odometer     REAL,
+					distance         REAL,
+					duration_sec     INTEGER,
+					start_batt_level INTEGER,
+					end_batt_level   INTEGER,
+					start_range      REAL,
+					end_range        REAL,
+					energy_used_kwh  REAL,
+					max_speed        REAL,
+					avg_speed        REAL,
+					PRIMARY KEY (vin, start_time)
+				)`,
+			},
+		},
+		{
+			version:     9,
+			description: "create charging sessions table",
+			statements: []string{`
+				CREATE TABLE charging_sessions (
+					vin                TEXT NOT NULL,
+					car_name           TEXT,
+					start_time         TIMESTAMP NOT NULL,
+					end_time           TIMESTAMP NOT NULL,
+					latitude           REAL,
+					longitude          REAL,
+					start_batt_level   INTEGER,
+					end_batt_level     INTEGER,
+					charge_limit_soc   INTEGER,
+					energy_added_kwh   REAL,
+					peak_power         REAL,
+					avg_power          REAL,
+					dc                 BOOLEAN,
+					fast_charger_type  TEXT,
+					fast_charger_brand TEXT,
+					reached_limit      BOOLEAN,
+					duration_sec       INTEGER,
+					PRIMARY KEY (vin, start_time)
+				)`,
+			},
+		},
+		{
+			version:     10,
+			description: "add trip efficiency and create efficiency samples table",
+			statements: []string{
+				"ALTER TABLE trips ADD COLUMN wh_per_mile REAL",
+				"ALTER TABLE trips ADD COLUMN wh_per_km REAL",
+				`CREATE TABLE efficiency_samples (
+					vin             TEXT NOT NULL,
+					car_name        TEXT,
+					timestamp       TIMESTAMP NOT NULL,
+					duration_sec    REAL,
+					distance        REAL,
+					energy_used_kwh REAL,
+					avg_speed       REAL,
+					wh_per_mile     REAL,
+					outside_temp    REAL,
+					PRIMARY KEY (vin, timestamp)
+				)`,
+			},
+		},
+		{
+			version:     11,
+			description: "add end range and odometer to charging sessions",
+			statements: []string{
+				"ALTER TABLE charging_sessions ADD COLUMN end_range REAL",
+				"ALTER TABLE charging_sessions ADD COLUMN odometer REAL",
+			},
+		},
+		{
+			version:     12,
+			description: "add geofence places",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN place TEXT",
+				"ALTER TABLE trips ADD COLUMN start_place TEXT",
+				"ALTER TABLE trips ADD COLUMN end_place TEXT",
+				"ALTER TABLE charging_sessions ADD COLUMN place TEXT",
+			},
+		},
+		{
+			version:     13,
+			description: "add charging session cost",
+			statements: []string{
+				"ALTER TABLE charging_sessions ADD COLUMN cost REAL",
+				"ALTER TABLE charging_sessions ADD COLUMN currency TEXT",
+			},
+		},
+		{
+			version:     14,
+			description: "add center display state",
+			statements: []string{
+				"ALTER TABLE snapshots ADD COLUMN center_display_state INTEGER",
+			},
+		},
+		{
+			version:     15,
+			description: "create drain summaries table",
+			statements: []string{
+				`CREATE TABLE drain_summaries (
+					vin                TEXT NOT NULL,
+					car_name           TEXT,
+					date               TEXT NOT NULL,
+					timestamp          TIMESTAMP NOT NULL,
+					hours              REAL,
+					range_lost         REAL,
+					soc_lost           REAL,
+					complete           BOOLEAN,
+					sentry_hours       REAL,
+					sentry_range_lost  REAL,
+					sentry_soc_lost    REAL,
+					climate_hours      REAL,
+					climate_range_lost REAL,
+					climate_soc_lost   REAL,
+					awake_hours        REAL,
+					awake_range_lost   REAL,
+					awake_soc_lost     REAL,
+					asleep_hours       REAL,
+					asleep_range_lost  REAL,
+					asleep_soc_lost    REAL,
+					PRIMARY KEY (vin, date)
+				)`,
+			},
+		},
+		{
+			version:     16,
+			description: "add integrated trip energy",
+			statements: []string{
+				"ALTER TABLE trips ADD COLUMN integrated_energy_kwh REAL",
+			},
+		},
+	},
+}
+
+// OpenSqliteDatabase opens (or creates) the SQLite database file at the given path and migrates its schema.
+func OpenSqliteDatabase(path string) (Database, error) {
+	// Store timestamps in a sortable format that's parsed back into time.Time.
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_time_format=sqlite", path))
+	if err != nil {
+		return nil, err
+	}
+	// SQLite only allows a single writer. Serialize access instead of failing with SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(context.Background(), db, sqliteDialect); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqlDatabase{
+		db:      db,
+		dialect: sqliteDialect,
+	}, nil
+}
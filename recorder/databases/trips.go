@@ -0,0 +1,81 @@
+package databases
+
+import (
+	"time"
+
+	"github.com/kodek/tesler/recorder/car"
+)
+
+// tripFields returns the fields of a trip, named alike in InfluxDB and SQL. The VIN, car name and start and end times
+// are left to each backend.
+func tripFields(trip car.Trip) map[string]interface{} {
+	return map[string]interface{}{
+		"start_latitude":        trip.StartLocation.Latitude,
+		"start_longitude":       trip.StartLocation.Longitude,
+		"end_latitude":          trip.EndLocation.Latitude,
+		"end_longitude":         trip.EndLocation.Longitude,
+		"start_place":           trip.StartPlace,
+		"end_place":             trip.EndPlace,
+		"start_odometer":        trip.StartOdometer,
+		"end_odometer":          trip.EndOdometer,
+		"distance":              trip.Distance(),
+		"duration_sec":          int64(trip.Duration().Seconds()),
+		"start_batt_level":      trip.StartBatteryLevel,
+		"end_batt_level":        trip.EndBatteryLevel,
+		"start_range":           trip.StartRange,
+		"end_range":             trip.EndRange,
+		"energy_used_kwh":       trip.EnergyUsed,
+		"integrated_energy_kwh": trip.IntegratedEnergy,
+		"max_speed":             trip.MaxSpeed,
+		"avg_speed":             trip.AverageSpeed,
+		"wh_per_mile":           trip.WhPerMile(),
+		"wh_per_km":             trip.WhPerKm(),
+	}
+}
+
+// tripFromFields is the inverse of tripFields.
+func tripFromFields(vin string, startTime time.Time, endTime time.Time, f fieldValues) car.Trip {
+	return car.Trip{
+		Vin:               vin,
+		CarName:           f.string("car_name"),
+		StartTime:         startTime,
+		EndTime:           endTime,
+		StartLocation:     car.Location{Latitude: f.float("start_latitude"), Longitude: f.float("start_longitude")},
+		EndLocation:       car.Location{Latitude: f.float("end_latitude"), Longitude: f.float("end_longitude")},
+		StartPlace:        f.string("start_place"),
+		EndPlace:          f.string("end_place"),
+		StartOdometer:     f.float("start_odometer"),
+		EndOdometer:       f.float("end_odometer"),
+		StartBatteryLevel: f.int("start_batt_level"),
+		EndBatteryLevel:   f.int("end_batt_level"),
+		StartRange:        f.float("start_range"),
+		EndRange:          f.float("end_range"),
+		EnergyUsed:        f.float("energy_used_kwh"),
+		IntegratedEnergy:  f.float("integrated_energy_kwh"),
+		MaxSpeed:          f.float("max_speed"),
+		AverageSpeed:      f.float("avg_speed"),
+	}
+}
+
+// tripMeasurement is the InfluxDB measurement holding trips. Points are timestamped with the trip's start.
+const tripMeasurement = "trip"
+
+// influxTripFields returns the fields of a trip's InfluxDB point. The end time is stored as Unix seconds.
+func influxTripFields(trip car.Trip) map[string]interface{} {
+	fields := tripFields(trip)
+	fields["end_time"] = trip.EndTime.Unix()
+	return fields
+}
+
+// carTags returns the InfluxDB tags of trips and other summaries, alike to the tags of snapshots.
+func carTags(vin string, carName string) map[string]string {
+	return map[string]string{
+		"car_name": carName,
+		"vin":      vin,
+	}
+}
+
+// tripFromPoint decodes a trip read back from InfluxDB.
+func tripFromPoint(vin string, point fieldValues) car.Trip {
+	return tripFromFields(vin, point.time(), time.Unix(int64(point.float("end_time")), 0), point)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/kodek/tesler/recorder/databases"
+	"github.com/pkg/errors"
+)
+
+// newLatestSnapshotHandler serves the most recently recorded snapshot for the car given by the "vin" parameter.
+func newLatestSnapshotHandler(database databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin := r.URL.Query().Get("vin")
+		if vin == "" {
+			http.Error(w, "Missing vin parameter.", http.StatusBadRequest)
+			return
+		}
+
+		snapshot, err := database.GetLatest(r.Context(), vin)
+		if errors.Cause(err) == databases.ErrNoData {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			glog.Errorf("Cannot fetch latest snapshot for VIN %s: %s", vin, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJson(w, snapshot)
+	}
+}
+
+// defaultHistoryDays is how far back history handlers look when the "days" parameter is missing.
+const defaultHistoryDays = 7
+
+// newTripsHandler serves the trips of the car given by the "vin" parameter that started in the last "days" days.
+func newTripsHandler(database databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tripStore, ok := database.(databases.TripStore)
+		if !ok {
+			http.Error(w, "The database cannot store trips.", http.StatusNotImplemented)
+			return
+		}
+		vin, from, to, ok := parseHistoryRequest(w, r)
+		if !ok {
+			return
+		}
+
+		trips, err := tripStore.GetTrips(r.Context(), vin, from, to)
+		if err != nil {
+			writeHistoryError(w, "trips", vin, err)
+			return
+		}
+		if trips == nil {
+			trips = []car.Trip{}
+		}
+		writeJson(w, trips)
+	}
+}
+
+// newChargingSessionsHandler serves the charging sessions of the car given by the "vin" parameter that started in
+// the last "days" days.
+func newChargingSessionsHandler(database databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionStore, ok := database.(databases.ChargingSessionStore)
+		if !ok {
+			http.Error(w, "The database cannot store charging sessions.", http.StatusNotImplemented)
+			return
+		}
+		vin, from, to, ok := parseHistoryRequest(w, r)
+		if !ok {
+			return
+		}
+
+		sessions, err := sessionStore.GetChargingSessions(r.Context(), vin, from, to)
+		if err != nil {
+			writeHistoryError(w, "charging sessions", vin, err)
+			return
+		}
+		if sessions == nil {
+			sessions = []car.ChargingSession{}
+		}
+		writeJson(w, sessions)
+	}
+}
+
+// newEfficiencyHandler serves the efficiency report of the car given by the "vin" parameter over the last "days"
+// days.
+func newEfficiencyHandler(database databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tripStore, tripsOk := database.(databases.TripStore)
+		efficiencyStore, efficiencyOk := database.(databases.EfficiencyStore)
+		if !tripsOk || !efficiencyOk {
+			http.Error(w, "The database cannot store trips and efficiency samples.", http.StatusNotImplemented)
+			return
+		}
+		vin, from, to, ok := parseHistoryRequest(w, r)
+		if !ok {
+			return
+		}
+
+		trips, err := tripStore.GetTrips(r.Context(), vin, from, to)
+		if err != nil {
+			writeHistoryError(w, "trips", vin, err)
+			return
+		}
+		samples, err := efficiencyStore.GetEfficiencySamples(r.Context(), vin, from, to)
+		if err != nil {
+			writeHistoryError(w, "efficiency samples", vin, err)
+			return
+		}
+		writeJson(w, car.NewEfficiencyReport(vin, from, to, trips, samples, time.Local))
+	}
+}
+
+// newVampireDrainHandler serves the daily parked drain summaries of the car given by the "vin" parameter over the
+// last "days" days.
+func newVampireDrainHandler(tracker *car.VampireDrainTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vin, from, to, ok := parseHistoryRequest(w, r)
+		if !ok {
+			return
+		}
+		writeJson(w, tracker.Summaries(vin, from, to))
+	}
+}
+
+// newDegradationHandler serves the battery degradation curve of the car given by the "vin" parameter, estimated from
+// all its charging sessions and the snapshots taken once charging was complete.
+func newDegradationHandler(database databases.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionStore, hasSessions := database.(databases.ChargingSessionStore)
+		chargeStore, hasSnapshots := database.(databases.ChargeCompleteStore)
+		if !hasSessions && !hasSnapshots {
+			http.Error(w, "The database cannot store charging sessions.", http.StatusNotImplemented)
+			return
+		}
+		vin := r.URL.Query().Get("vin")
+		if vin == "" {
+			http.Error(w, "Missing vin parameter.", http.StatusBadRequest)
+			return
+		}
+
+		// InfluxDB cannot query times before 1677, so the Unix epoch stands for the beginning of time.
+		from, to := time.Unix(0, 0), time.Now()
+		var sessions []car.ChargingSession
+		if hasSessions {
+			var err error
+			sessions, err = sessionStore.GetChargingSessions(r.Context(), vin, from, to)
+			if err != nil && errors.Cause(err) != databases.ErrNotSupported {
+				writeHistoryError(w, "charging sessions", vin, err)
+				return
+			}
+		}
+		var snapshots []car.Snapshot
+		if hasSnapshots {
+			var err error
+			snapshots, err = chargeStore.GetChargeCompleteSnapshots(r.Context(), vin, from, to)
+			if err != nil && errors.Cause(err) != databases.ErrNotSupported {
+				writeHistoryError(w, "snapshots", vin, err)
+				return
+			}
+		}
+		writeJson(w, car.NewDegradationCurve(vin, sessions, snapshots))
+	}
+}
+
+// defaultCostMonths is how many months the charging costs handler covers when the "months" parameter is missing.
+const defaultCostMonths = 12
+
+// newChargingCostsHandler serves the monthly charging costs of the car given by the "vin" parameter over the last
+// "months" months, including the current one.
+func newChargingCostsHandler(database databases.Database, tariff *car.Tariff) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessionStore, ok := database.(databases.ChargingSessionStore)
+		if !ok {
+			http.Error(w, "The database cannot store charging sessions.", http.StatusNotImplemented)
+			return
+		}
+		vin := r.URL.Query().Get("vin")
+		if vin == "" {
+			http.Error(w, "Missing vin parameter.", http.StatusBadRequest)
+			return
+		}
+		months := defaultCostMonths
+		if m := r.URL.Query().Get("months"); m != "" {
+			var err error
+			months, err = strconv.Atoi(m)
+			if err != nil || months <= 0 {
+				http.Error(w, "Invalid months parameter.", http.StatusBadRequest)
+				return
+			}
+		}
+
+		to := time.Now()
+		from := car.StartOfMonth(to, months-1, tariff.Location())
+		sessions, err := sessionStore.GetChargingSessions(r.Context(), vin, from, to)
+		if err != nil {
+			writeHistoryError(w, "charging sessions", vin, err)
+			return
+		}
+		writeJson(w, car.MonthlyChargingCosts(sessions, tariff))
+	}
+}
+
+// newRecordingsHandler reports which cars are being recorded.
+func newRecordingsHandler(supervisor *Supervisor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, supervisor.Status())
+	}
+}
+
+// parseHistoryRequest reads the "vin" and "days" parameters of a history request. If they're invalid, it writes an
+// error response and returns false.
+func parseHistoryRequest(w http.ResponseWriter, r *http.Request) (vin string, from time.Time, to time.Time, ok bool) {
+	vin = r.URL.Query().Get("vin")
+	if vin == "" {
+		http.Error(w, "Missing vin parameter.", http.StatusBadRequest)
+		return "", from, to, false
+	}
+	days := defaultHistoryDays
+	if d := r.URL.Query().Get("days"); d != "" {
+		var err error
+		days, err = strconv.Atoi(d)
+		if err != nil || days <= 0 {
+			http.Error(w, "Invalid days parameter.", http.StatusBadRequest)
+			return "", from, to, false
+		}
+	}
+	to = time.Now()
+	return vin, to.AddDate(0, 0, -days), to, true
+}
+
+// writeHistoryError writes the error response for a failed history query.
+func writeHistoryError(w http.ResponseWriter, what string, vin string, err error) {
+	if errors.Cause(err) == databases.ErrNotSupported {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	glog.Errorf("Cannot fetch %s for VIN %s: %s", what, vin, err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// writeJson writes the given value as an indented JSON response.
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		glog.Errorf("Cannot encode JSON response: %s", err)
+	}
+}
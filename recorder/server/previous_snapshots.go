@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/kodek/tesler/recorder/databases"
+	"github.com/pkg/errors"
+)
+
+// PreviousSnapshots remembers the last snapshot of each car recorded before the recorder started, so that trackers
+// can pick up where they left off after a restart. Once a car is recorded, the database can't tell the previous
+// snapshot from the new one anymore, so it has to be read before the first write.
+type PreviousSnapshots struct {
+	database databases.Database
+
+	mu        sync.Mutex
+	loaded    map[string]bool
+	snapshots map[string]*car.Snapshot
+}
+
+func NewPreviousSnapshots(database databases.Database) *PreviousSnapshots {
+	return &PreviousSnapshots{
+		database:  database,
+		loaded:    make(map[string]bool),
+		snapshots: make(map[string]*car.Snapshot),
+	}
+}
+
+// Load reads the last recorded snapshot of a car from the database, unless it was already loaded. It must be called
+// before the first snapshot of the car is written.
+func (p *PreviousSnapshots) Load(ctx context.Context, vin string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.loaded[vin] {
+		return
+	}
+	s, err := p.database.GetLatest(ctx, vin)
+	if err != nil {
+		if errors.Cause(err) != databases.ErrNoData {
+			glog.Errorf("Cannot read previous snapshot for VIN %s: %s", vin, err)
+			// Try again before the next write.
+			return
+		}
+		s = nil
+	}
+	p.loaded[vin] = true
+	p.snapshots[vin] = s
+}
+
+// Lookup returns the snapshot loaded for a car, or nil if there's none. It can be used as a car.PreviousSnapshotFunc.
+func (p *PreviousSnapshots) Lookup(vin string) *car.Snapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.snapshots[vin]
+}
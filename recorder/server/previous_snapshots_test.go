@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/kodek/tesler/recorder/databases"
+)
+
+// memoryDatabase keeps the inserted snapshots in memory.
+type memoryDatabase struct {
+	snapshots []car.Snapshot
+}
+
+func (m *memoryDatabase) GetLatest(ctx context.Context, vin string) (*car.Snapshot, error) {
+	for i := len(m.snapshots) - 1; i >= 0; i-- {
+		if m.snapshots[i].Vin == vin {
+			return &m.snapshots[i], nil
+		}
+	}
+	return nil, databases.ErrNoData
+}
+
+func (m *memoryDatabase) Insert(ctx context.Context, snapshot car.Snapshot) error {
+	m.snapshots = append(m.snapshots, snapshot)
+	return nil
+}
+
+func (m *memoryDatabase) Close() error {
+	return nil
+}
+
+func TestPreviousSnapshotsKeepsSnapshotRecordedBeforeLoad(t *testing.T) {
+	ctx := context.Background()
+	database := &memoryDatabase{}
+	database.Insert(ctx, car.Snapshot{Vin: "VIN1", BatteryLevel: 50})
+	previous := NewPreviousSnapshots(database)
+
+	previous.Load(ctx, "VIN1")
+	database.Insert(ctx, car.Snapshot{Vin: "VIN1", BatteryLevel: 60})
+	previous.Load(ctx, "VIN1")
+
+	if s := previous.Lookup("VIN1"); s == nil || s.BatteryLevel != 50 {
+		t.Errorf("Lookup() = %+v, want the snapshot recorded before the first load", s)
+	}
+
+	previous.Load(ctx, "VIN2")
+	database.Insert(ctx, car.Snapshot{Vin: "VIN2"})
+	if s := previous.Lookup("VIN2"); s != nil {
+		t.Errorf("Lookup() = %+v, want nil for a car without history", s)
+	}
+}
+
+func TestGeofenceTrackerSeededAcrossRestart(t *testing.T) {
+	ctx := context.Background()
+	database := &memoryDatabase{}
+	home := car.Bearings{Latitude: 37.4, Longitude: -122.1}
+	database.Insert(ctx, car.Snapshot{Vin: "VIN1", Place: "Home", Bearings: home})
+
+	// After a restart, the recorder loads the previous snapshot before writing the first one.
+	previous := NewPreviousSnapshots(database)
+	var events []car.Event
+	tracker := car.NewGeofenceTracker(previous.Lookup, func(e car.Event) {
+		events = append(events, e)
+	})
+	previous.Load(ctx, "VIN1")
+	away := car.Snapshot{Vin: "VIN1", Bearings: car.Bearings{Latitude: 37.5, Longitude: -122.2}}
+	database.Insert(ctx, away)
+	tracker(&away)
+
+	if len(events) != 1 || events[0].Kind != car.GeofenceExitedEvent {
+		t.Errorf("got events %+v, want the car to have left home", events)
+	}
+}
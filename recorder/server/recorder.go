@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/cenkalti/backoff"
@@ -14,164 +16,173 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Recorder dumps data from the given Vehicle into a Database while the vehicle is actively being used.
+var (
+	secondsToSleep      = expvar.NewMap("seconds_to_sleep")
+	sleepWindowsExpired = expvar.NewMap("sleep_windows_expired")
+)
+
+const defaultLetItSleep = 15 * time.Minute
+
+// sleepCheckInterval is how often the state of an idle vehicle is checked. Checks are free, since the state monitor
+// caches the vehicle list.
+const sleepCheckInterval = 10 * time.Second
+
+// Recorder dumps data from the given Vehicle into a Database while the vehicle is actively being used. Once the
+// vehicle goes idle, it stops fetching vehicle data so that the vehicle can fall asleep, and the recording ends.
 type Recorder struct {
-	recording bool
+	// recording is 1 while RecordWhileVehicleInUse runs. Accessed atomically.
+	recording int32
 	Database  databases.Database
+	// writeCtx is used for writes instead of the context of the recording, so that a snapshot that was already
+	// fetched is still written while the recording stops.
+	writeCtx context.Context
+	// previous is loaded before the first write of a car, so that its listeners can tell what was recorded before.
+	previous *PreviousSnapshots
+	// lastTimestamp is the timestamp of the last snapshot recorded, so that the next one gets a later one.
+	lastTimestamp     time.Time
+	geofences         car.Geofences
+	policy            *car.PollingPolicy
+	vehicleState      car.VehicleStateFunc
+	letItSleep        time.Duration
+	snapshotListeners []car.OnSnapshotFunc
 }
 
-func NewRecorder(d databases.Database) (*Recorder, error) {
-	return &Recorder{
-		Database: d,
-	}, nil
+// AddSnapshotListener registers a function called with every snapshot after it's recorded.
+func (r *Recorder) AddSnapshotListener(listenerFn car.OnSnapshotFunc) {
+	r.snapshotListeners = append(r.snapshotListeners, listenerFn)
 }
 
-const IdleTimeBeforeSleep = 5 * time.Minute
-const IdleSamplingFrequency = 10 * time.Second
-
-func samplesBeforeSleep() int64 {
-	return IdleTimeBeforeSleep.Nanoseconds() / IdleSamplingFrequency.Nanoseconds()
+// NewRecorder returns a Recorder that tags snapshots with the given geofences before writing them to d, polling as
+// often as the policy decides. Once a vehicle goes idle, the Recorder only watches vehicleState (which must not wake
+// the vehicle) for up to letItSleep, then stops recording even if the vehicle is still awake. A non-positive
+// letItSleep defaults to 15 minutes. Writes to d are cancelled once writeCtx is done. Before the first write of a car,
+// its last recorded snapshot is loaded into previous.
+func NewRecorder(writeCtx context.Context, d databases.Database, previous *PreviousSnapshots, geofences car.Geofences,
+	policy *car.PollingPolicy, vehicleState car.VehicleStateFunc, letItSleep time.Duration) (*Recorder, error) {
+	if letItSleep <= 0 {
+		letItSleep = defaultLetItSleep
+	}
+	return &Recorder{
+		writeCtx:     writeCtx,
+		Database:     d,
+		previous:     previous,
+		geofences:    geofences,
+		policy:       policy,
+		vehicleState: vehicleState,
+		letItSleep:   letItSleep,
+	}, nil
 }
 
-func (r *Recorder) RecordWhileVehicleInUse(v *tesla.Vehicle) error {
-	if r.recording {
+// RecordWhileVehicleInUse records the vehicle until it goes idle or ctx is done.
+func (r *Recorder) RecordWhileVehicleInUse(ctx context.Context, v *tesla.Vehicle) error {
+	// Make function non-reentrant. The Supervisor already runs a single recording per car.
+	if !atomic.CompareAndSwapInt32(&r.recording, 0, 1) {
 		return errors.New(fmt.Sprintf("Recorder not reentrant (car VIN %s).", v.Vin))
 	}
-	// Make function non-reentrant.
-	// TODO: Determine if thread safety is required. This function is not thread-safe.
-	r.recording = true
-	defer func() {
-		r.recording = false
-	}()
-
-	// TODO: Encapsulate the idle sample timeout into a class.
-	idleSamplesRemaining := samplesBeforeSleep()
+	defer atomic.StoreInt32(&r.recording, 0)
+
 	for {
 		// Fetch data.
-		data, err := getVehicleData(v)
+		data, err := getVehicleData(ctx, v)
+		if ctx.Err() != nil {
+			glog.Infof("Stopped monitoring VIN %s.", v.Vin)
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 
-		// Parse data and active state.
-		activeState := newActiveState(data)
-
-		snapshot := car.NewSnapshot(data)
-		snapshot.ActiveDescription = activeState.Description()
+		// Parse data and decide how to keep polling.
+		r.previous.Load(r.writeCtx, v.Vin)
+		if previous := r.previous.Lookup(v.Vin); r.lastTimestamp.IsZero() && previous != nil {
+			r.lastTimestamp = previous.Timestamp
+		}
+		snapshot := car.NewSnapshot(data, r.lastTimestamp)
+		snapshot.Place = r.geofences.Place(car.Location{
+			Latitude:  snapshot.Bearings.Latitude,
+			Longitude: snapshot.Bearings.Longitude,
+		})
+		decision := r.policy.Evaluate(snapshot)
+		glog.Infof("Car %s: %s", v.Vin, decision)
+		snapshot.ActiveDescription = decision.Description
 
 		// Record.
-		err = r.Database.Insert(context.Background(), *snapshot)
+		err = r.Database.Insert(r.writeCtx, *snapshot)
 		if err != nil {
 			return errors.Wrap(err, "cannot write data to database")
 		}
+		r.lastTimestamp = snapshot.Timestamp
+		for _, listenerFn := range r.snapshotListeners {
+			listenerFn(snapshot)
+		}
 
 		// Determine polling frequency.
-		if !activeState.ShouldSleep() {
+		if !decision.Sleep {
 			// We should keep monitoring.
-			idleSamplesRemaining = samplesBeforeSleep()
-			time.Sleep(activeState.PollInterval())
-		} else {
-			if idleSamplesRemaining <= 0 {
-				// THIS was the next run, so let's end.
-				glog.Infof("Done monitoring VIN %s.", v.Vin)
+			if !sleepContext(ctx, decision.PollInterval) {
+				glog.Infof("Stopped monitoring VIN %s.", v.Vin)
 				return nil
 			}
-			// We should stop monitoring after a while.
-			idleSamplesRemaining = idleSamplesRemaining - 1
-			glog.Infof("Recording ends for car %s in %d samples.", v.Vin, idleSamplesRemaining)
-			time.Sleep(activeState.PollInterval())
+			continue
 		}
+		// Fetching vehicle data again would keep the car awake. Once it wakes up again, the StateMonitor starts
+		// another recording.
+		r.waitForSleep(ctx, v.Vin)
+		glog.Infof("Done monitoring VIN %s.", v.Vin)
+		return nil
 	}
 }
 
-func getVehicleData(v *tesla.Vehicle) (*tesla.VehicleData, error) {
-	onError := func(e error, d time.Duration) {
-		glog.Errorf("Error fetching VIN %s. Retrying in (%s): %s\n", v.Vin, common.Round(d, time.Millisecond), e)
-	}
-
-	var retVal *tesla.VehicleData
-	finalErr := backoff.RetryNotify(func() error {
-		var err error
-		retVal, err = v.VehicleData()
-		return err
-	}, backoff.NewExponentialBackOff(), onError)
-	return retVal, errors.Wrap(finalErr, fmt.Sprintf("could not fetch vehicle data for %s after multiple tries", v.DisplayName))
-}
-
-// activeState represents the state of the vehicle, as it's actively being polled.
-type activeState struct {
-	shouldSleep bool
-	pollFreq    time.Duration
-	desc        string
-}
-
-func (s *activeState) PollInterval() time.Duration {
-	return s.pollFreq
-}
-
-func (s *activeState) Description() string {
-	return s.desc
-}
-
-func (s *activeState) ShouldSleep() bool {
-	return s.shouldSleep
-}
-
-func newActiveState(data *tesla.VehicleData) activeState {
-	shiftState := data.DriveState.ShiftState
-
-	if data.DriveState.Speed > 0 {
-		glog.Infof("Car %s is actively moving.", data.Vin)
-		return activeState{
-			pollFreq: 1 * time.Second,
-			desc:     "Moving",
-		}
-	}
-	if shiftState == "R" || shiftState == "D" || shiftState == "N" {
-		glog.Infof("Car %s not moving, but in gear.", data.Vin)
-		return activeState{
-			pollFreq: 2 * time.Second,
-			desc:     "In gear",
+// waitForSleep leaves an idle vehicle alone for up to letItSleep, watching its state without fetching vehicle data.
+// It returns once the vehicle falls asleep, letItSleep is over or ctx is done.
+func (r *Recorder) waitForSleep(ctx context.Context, vin string) {
+	idleSince := time.Now()
+	glog.Infof("Car %s is idle. Letting it sleep for up to %s.", vin, r.letItSleep)
+	for time.Since(idleSince) < r.letItSleep {
+		if !sleepContext(ctx, sleepCheckInterval) {
+			return
 		}
-	}
-
-	chargeState := data.ChargeState.ChargingState
-	if chargeState == "Charging" || chargeState == "Starting" {
-		glog.Infof("Car %s has active charge state: %s.", data.Vin, chargeState)
-		return activeState{
-			pollFreq: 3 * time.Second,
-			desc:     "Charging",
+		state := r.vehicleState(vin)
+		if state == "asleep" || state == "offline" {
+			timeToSleep := time.Since(idleSince)
+			glog.Infof("Car %s is %s after being idle for %s.", vin, state, common.Round(timeToSleep, time.Second))
+			secondsToSleep.Set(vin, expvarFloat(timeToSleep.Seconds()))
+			return
 		}
 	}
+	glog.Infof("Car %s is still awake after being left alone for %s. Not fetching its data until it wakes up again.",
+		vin, r.letItSleep)
+	sleepWindowsExpired.Add(vin, 1)
+}
 
-	if data.VehicleState.SentryMode {
-		glog.Infof("Sentry mode enabled for %s.", data.Vin)
-		return activeState{
-			pollFreq: 30 * time.Second,
-			desc:     "Sentry mode",
-		}
+// sleepContext sleeps for d. It returns false if ctx was done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
+}
 
-	if data.VehicleState.CenterDisplayState != 0 {
-		glog.Infof("Center display is on for car %s.", data.Vin)
-		return activeState{
-			pollFreq: 10 * time.Second,
-			desc:     "Display on",
-		}
-	}
+func expvarFloat(f float64) *expvar.Float {
+	v := new(expvar.Float)
+	v.Set(f)
+	return v
+}
 
-	if data.ClimateState.IsClimateOn {
-		glog.Infof("Climate is on for car %s.", data.Vin)
-		return activeState{
-			pollFreq: 30 * time.Second,
-			desc:     "Climate on",
-		}
+func getVehicleData(ctx context.Context, v *tesla.Vehicle) (*car.VehicleData, error) {
+	onError := func(e error, d time.Duration) {
+		glog.Errorf("Error fetching VIN %s. Retrying in (%s): %s\n", v.Vin, common.Round(d, time.Millisecond), e)
 	}
 
-	glog.Infof("Car %s is not active.", data.Vin)
-	return activeState{
-		pollFreq:    IdleSamplingFrequency,
-		desc:        "Idle",
-		shouldSleep: true,
-	}
+	var retVal *car.VehicleData
+	finalErr := backoff.RetryNotify(func() error {
+		var err error
+		retVal, err = car.FetchVehicleData(ctx, v)
+		return err
+	}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx), onError)
+	return retVal, errors.Wrap(finalErr, fmt.Sprintf("could not fetch vehicle data for %s after multiple tries", v.DisplayName))
 }
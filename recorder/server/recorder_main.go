@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/glog"
@@ -14,6 +23,19 @@ import (
 	"github.com/kodek/tesler/recorder/databases"
 )
 
+var eventCounts = expvar.NewMap("event_counts")
+
+// Shutdown has to be over before Docker kills the container, 10 seconds after asking it to stop.
+const (
+	// shutdownTimeout is how long in-flight requests and recordings get to finish on shutdown. Writes still running
+	// afterwards are cancelled.
+	shutdownTimeout = 5 * time.Second
+	// cancelTimeout is how long recordings get to return once their writes are cancelled.
+	cancelTimeout = time.Second
+	// flushTimeout is how long storing the interrupted trips, charging sessions and drain summaries may take.
+	flushTimeout = 2 * time.Second
+)
+
 func main() {
 	_ = flag.Set("logtostderr", "true")
 	flag.Parse()
@@ -30,20 +52,13 @@ func main() {
 		panic(err)
 	}
 
-	stateMonitor, err := car.NewPollingStateMonitor(teslaClient)
+	stateMonitor, err := car.NewPollingStateMonitor(teslaClient, conf.Recorder.WatchVehicleDetails)
 	if err != nil {
 		panic(err)
 	}
 
 	// Open database
-	var database databases.Database
-	influxConf := conf.Recorder.InfluxDbConfig
-	// TODO: Check that config isn't empty/missing.
-	database, err = databases.OpenInfluxDbDatabase(
-		influxConf.Address,
-		influxConf.Username,
-		influxConf.Password,
-		influxConf.Database)
+	database, err := databases.OpenDatabaseFromConfig(conf)
 	if err != nil {
 		panic(err)
 	}
@@ -53,24 +68,72 @@ func main() {
 		}
 	}()
 
+	geofences, err := car.NewGeofencesFromConfig(conf)
+	if err != nil {
+		panic(err)
+	}
+	tariff, err := car.NewTariffFromConfig(conf)
+	if err != nil {
+		panic(err)
+	}
+	pollingPolicy, err := car.NewPollingPolicyFromConfig(conf)
+	if err != nil {
+		panic(err)
+	}
+
+	// ctx stops polling and recording on shutdown. writeCtx is only cancelled if writes don't finish in time.
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	writeCtx, cancelWrites := context.WithCancel(context.Background())
+	defer cancelWrites()
+
 	pushoverFacade := &PushoverFacade{
 		push:      push,
 		recipient: pushUser,
 	}
+	supervisor := NewSupervisor(ctx, newNotifyRecordingDoneHandler(pushoverFacade))
+
+	notifyEvent := newNotifyEventHandler(pushoverFacade)
+	previousSnapshots := NewPreviousSnapshots(database)
+	softwareVersionTracker := car.NewSoftwareVersionTracker(previousSnapshots.Lookup, notifyEvent)
+	tirePressureMonitor := car.NewTirePressureMonitor(
+		conf.Recorder.TireAlerts.MinPressureBar,
+		conf.Recorder.TireAlerts.MaxLossBarPerHour,
+		notifyEvent)
+	tripSegmenter := car.NewTripSegmenterFromConfig(conf)
+	tripRecorder := newTripRecorder(writeCtx, tripSegmenter, database)
+	chargingSessionDetector := car.NewChargingSessionDetector()
+	chargingSessionRecorder := newChargingSessionRecorder(writeCtx, chargingSessionDetector, tariff, database)
+	efficiencyRecorder := newEfficiencyRecorder(writeCtx, car.NewEfficiencySampler(), database)
+	vampireDrainTracker := car.NewVampireDrainTracker(time.Local, previousSnapshots.Lookup, notifyEvent,
+		newDrainSummaryRecorder(writeCtx, database))
+	restoreDrainSummaries(writeCtx, vampireDrainTracker, database, conf.Recorder.Cars)
+	// Added before the listeners that start recordings, so that the tracker knows a car woke up before its snapshots.
+	stateMonitor.AddVehicleChangeListener(vampireDrainTracker.ObserveVehicle)
+	geofenceTracker := car.NewGeofenceTracker(previousSnapshots.Lookup, notifyEvent)
 
 	for _, c := range conf.Recorder.Cars {
-		recorder, err := NewRecorder(database)
+		recorder, err := NewRecorder(writeCtx, database, previousSnapshots, geofences, pollingPolicy, stateMonitor.State,
+			time.Duration(conf.Recorder.Polling.LetItSleepMinutes)*time.Minute)
 		if err != nil {
 			panic(err)
 		}
+		recorder.AddSnapshotListener(softwareVersionTracker)
+		recorder.AddSnapshotListener(tirePressureMonitor)
+		recorder.AddSnapshotListener(tripRecorder)
+		recorder.AddSnapshotListener(chargingSessionRecorder)
+		recorder.AddSnapshotListener(efficiencyRecorder)
+		recorder.AddSnapshotListener(vampireDrainTracker.Observe)
+		recorder.AddSnapshotListener(geofenceTracker)
+		supervisor.AddRecorder(c.Vin, recorder)
 		stateMonitor.AddVehicleChangeListener(
 			newFilterByCarMiddleware(
 				c.Vin,
 				c.Monitor,
 				newCountStateChangesMiddleware(
 					newGreetOnFirstChangeMiddleware(pushoverFacade,
-						newRecordMetricsMiddleware(pushoverFacade,
-							recorder, newLogAndNotifyMiddleware(pushoverFacade, noOpHandler()))))))
+						newRecordMetricsMiddleware(supervisor,
+							newLogAndNotifyMiddleware(pushoverFacade, noOpHandler()))))))
 	}
 
 	mux := common.NewKodekMux("Tesler-Recorder-v2")
@@ -86,28 +149,235 @@ func main() {
 	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
 		conf.WriteRedacted(w)
 	})
+	mux.HandleFunc("/latest", newLatestSnapshotHandler(database))
+	mux.HandleFunc("/trips", newTripsHandler(database))
+	mux.HandleFunc("/charging_sessions", newChargingSessionsHandler(database))
+	mux.HandleFunc("/efficiency", newEfficiencyHandler(database))
+	mux.HandleFunc("/vampire_drain", newVampireDrainHandler(vampireDrainTracker))
+	mux.HandleFunc("/degradation", newDegradationHandler(database))
+	mux.HandleFunc("/charging_costs", newChargingCostsHandler(database, tariff))
+	mux.HandleFunc("/recordings", newRecordingsHandler(supervisor))
 	if conf.Recorder.Port == 0 {
 		glog.Fatal("Port 0 currently not supported. Please set config.Recorder.Port to continue.")
 	}
 	listenSpec := fmt.Sprintf(":%d", conf.Recorder.Port)
 	glog.Infof("Starting Tesler recorder server at %s", listenSpec)
 
-	go stateMonitor.Poll()
-	glog.Fatal(http.ListenAndServe(listenSpec, mux))
+	server := &http.Server{Addr: listenSpec, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			glog.Fatal(err)
+		}
+	}()
+	polling := make(chan struct{})
+	go func() {
+		defer close(polling)
+		stateMonitor.Poll(ctx)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	glog.Infof("Received %s. Shutting down...", sig)
+	signal.Stop(signals)
+	shutdown(stop, cancelWrites, server, polling, supervisor)
+
+	// Store the trips and charging sessions that were interrupted, so that they aren't lost. The writes of the
+	// recordings may have been cancelled, so these get their own deadline.
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancelFlush()
+	for _, trip := range tripSegmenter.Flush() {
+		recordTrip(flushCtx, database, &trip)
+	}
+	for _, session := range chargingSessionDetector.Flush() {
+		recordChargingSession(flushCtx, tariff, database, &session)
+	}
+	if drainStore, ok := database.(databases.DrainSummaryStore); ok {
+		for _, summary := range vampireDrainTracker.Flush() {
+			if err := drainStore.InsertDrainSummary(flushCtx, summary); err != nil {
+				glog.Errorf("Cannot store drain summary for VIN %s: %s", summary.Vin, err)
+			}
+		}
+	}
+	// The deferred database.Close() flushes pending writes.
+	glog.Info("Shutdown complete.")
+}
+
+// shutdown stops polling and recording, and closes the server. It waits up to shutdownTimeout for in-flight
+// requests and recordings, then cancels the writes that are still running and waits up to cancelTimeout more.
+func shutdown(stop context.CancelFunc, cancelWrites context.CancelFunc, server *http.Server, polling <-chan struct{},
+	supervisor *Supervisor) {
+	stop()
+	deadline, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(deadline); err != nil {
+		glog.Errorf("Cannot shut down the HTTP server cleanly: %s", err)
+	}
+
+	// Polling must be over before waiting for recordings, since its listeners start new ones.
+	done := make(chan struct{})
+	go func() {
+		<-polling
+		supervisor.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-deadline.Done():
+		glog.Errorf("Recordings didn't stop within %s. Cancelling their writes.", shutdownTimeout)
+		cancelWrites()
+		select {
+		case <-done:
+		case <-time.After(cancelTimeout):
+			glog.Errorf("Recordings didn't stop within %s of cancelling their writes. Giving up on them.",
+				cancelTimeout)
+		}
+	}
+}
+
+// newNotifyEventHandler logs snapshot events and forwards them to Pushover.
+func newNotifyEventHandler(pushoverFacade *PushoverFacade) car.OnEventFunc {
+	return func(e car.Event) {
+		glog.Infof("Event %s for VIN %s: %s", e.Kind, e.Vin, e.Message)
+		eventCounts.Add(e.Kind, 1)
+
+		_, err := pushoverFacade.SendMessageWithTitle(e.Message, fmt.Sprintf("%s: %s", e.CarName, e.Kind))
+		if err != nil {
+			glog.Errorf("Cannot send Pushover message: %s", err)
+		}
+	}
+}
+
+// newTripRecorder segments snapshots into trips and stores every completed trip.
+func newTripRecorder(ctx context.Context, segmenter *car.TripSegmenter,
+	database databases.Database) car.OnSnapshotFunc {
+	if _, ok := database.(databases.TripStore); !ok {
+		glog.Warning("The database cannot store trips. Trips will only be logged.")
+	}
+	return func(s *car.Snapshot) {
+		if trip := segmenter.Observe(s); trip != nil {
+			recordTrip(ctx, database, trip)
+		}
+	}
+}
+
+// recordTrip logs a completed trip and stores it, if the database supports it.
+func recordTrip(ctx context.Context, database databases.Database, trip *car.Trip) {
+	glog.Infof("Trip for VIN %s: %.1f miles in %s at %.0f Wh/mi", trip.Vin, trip.Distance(), trip.Duration(),
+		trip.WhPerMile())
+	tripStore, ok := database.(databases.TripStore)
+	if !ok {
+		return
+	}
+	if err := tripStore.InsertTrip(ctx, *trip); err != nil {
+		glog.Errorf("Cannot store trip for VIN %s: %s", trip.Vin, err)
+	}
+}
+
+// newChargingSessionRecorder detects charging sessions in snapshots, prices them with the tariff and stores every
+// completed session.
+func newChargingSessionRecorder(ctx context.Context, detector *car.ChargingSessionDetector, tariff *car.Tariff,
+	database databases.Database) car.OnSnapshotFunc {
+	if _, ok := database.(databases.ChargingSessionStore); !ok {
+		glog.Warning("The database cannot store charging sessions. Charging sessions will only be logged.")
+	}
+	return func(s *car.Snapshot) {
+		if session := detector.Observe(s); session != nil {
+			recordChargingSession(ctx, tariff, database, session)
+		}
+	}
+}
+
+// recordChargingSession prices a completed charging session with the tariff, logs it and stores it, if the database
+// supports it.
+func recordChargingSession(ctx context.Context, tariff *car.Tariff, database databases.Database,
+	session *car.ChargingSession) {
+	session.Cost = tariff.Cost(session)
+	session.Currency = tariff.Currency
+	glog.Infof("Charging session for VIN %s: %.1f kWh in %s for %s", session.Vin, session.EnergyAdded,
+		session.Duration(), tariff.FormatCost(session.Cost))
+	sessionStore, ok := database.(databases.ChargingSessionStore)
+	if !ok {
+		return
+	}
+	if err := sessionStore.InsertChargingSession(ctx, *session); err != nil {
+		glog.Errorf("Cannot store charging session for VIN %s: %s", session.Vin, err)
+	}
+}
+
+// newEfficiencyRecorder stores efficiency samples taken from the snapshots of moving cars.
+func newEfficiencyRecorder(ctx context.Context, sampler *car.EfficiencySampler,
+	database databases.Database) car.OnSnapshotFunc {
+	efficiencyStore, ok := database.(databases.EfficiencyStore)
+	if !ok {
+		glog.Warning("The database cannot store efficiency samples.")
+		return func(s *car.Snapshot) {}
+	}
+	return func(s *car.Snapshot) {
+		sample := sampler.Observe(s)
+		if sample == nil {
+			return
+		}
+		if err := efficiencyStore.InsertEfficiencySample(ctx, *sample); err != nil {
+			glog.Errorf("Cannot store efficiency sample for VIN %s: %s", sample.Vin, err)
+		}
+	}
+}
+
+// newDrainSummaryRecorder stores the daily drain summaries as they complete. It returns nil if the database cannot
+// store them.
+func newDrainSummaryRecorder(ctx context.Context, database databases.Database) car.DrainSummaryFunc {
+	drainStore, ok := database.(databases.DrainSummaryStore)
+	if !ok {
+		glog.Warning("The database cannot store drain summaries. They will be lost on restart.")
+		return nil
+	}
+	return func(summary car.DailyDrainSummary) {
+		if err := drainStore.InsertDrainSummary(ctx, summary); err != nil {
+			glog.Errorf("Cannot store drain summary for VIN %s: %s", summary.Vin, err)
+		}
+	}
+}
+
+// restoreDrainSummaries loads the drain summaries stored for the given cars into the tracker.
+func restoreDrainSummaries(ctx context.Context, tracker *car.VampireDrainTracker, database databases.Database,
+	cars []common.Car) {
+	drainStore, ok := database.(databases.DrainSummaryStore)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	from := now.AddDate(0, 0, -car.DrainRetentionDays-1)
+	for _, c := range cars {
+		summaries, err := drainStore.GetDrainSummaries(ctx, c.Vin, from, now)
+		if err != nil {
+			glog.Errorf("Cannot read drain summaries for VIN %s: %s", c.Vin, err)
+			continue
+		}
+		tracker.Restore(summaries)
+	}
 }
 
 func noOpHandler() car.OnVehicleChangeFunc {
-	return func(v *tesla.Vehicle) {}
+	return func(e car.VehicleEvent) {}
 }
 
 func newLogAndNotifyMiddleware(pushoverFacade *PushoverFacade, in car.OnVehicleChangeFunc) car.OnVehicleChangeFunc {
-	return func(v *tesla.Vehicle) {
-		defer in(v)
-		glog.Infof("Vehicle %s state changed: %s", v.DisplayName, spew.Sdump(v))
+	return func(e car.VehicleEvent) {
+		defer in(e)
+		v := e.Vehicle
+		glog.Infof("Vehicle %s changed (%s): %s", v.DisplayName, e.Reason, spew.Sdump(e))
 
-		_, err := pushoverFacade.SendMessageWithTitle(
-			spew.Sdump(v),
-			fmt.Sprintf("Vehicle %s state changed to %s", v.DisplayName, stateString(v)))
+		title := fmt.Sprintf("Vehicle %s state changed: %s", v.DisplayName, e.Transition())
+		if !e.StateChanged() {
+			title = fmt.Sprintf("Vehicle %s details changed", v.DisplayName)
+		}
+		message := spew.Sdump(v)
+		if len(e.Changes) > 0 {
+			message = strings.Join(e.Changes, "\n") + "\n\n" + message
+		}
+		_, err := pushoverFacade.SendMessageWithTitle(message, title)
 
 		if err != nil {
 			glog.Errorf("Cannot send Pushover message: %s", err)
@@ -115,79 +385,87 @@ func newLogAndNotifyMiddleware(pushoverFacade *PushoverFacade, in car.OnVehicleC
 	}
 }
 
-func newRecordMetricsMiddleware(pushoverFacade *PushoverFacade, recorder *Recorder, in car.OnVehicleChangeFunc) car.OnVehicleChangeFunc {
-	return func(v *tesla.Vehicle) {
-		defer in(v)
-		if v.State == nil || *v.State != "online" {
+// newRecordMetricsMiddleware has the supervisor record a car when it comes online.
+func newRecordMetricsMiddleware(supervisor *Supervisor, in car.OnVehicleChangeFunc) car.OnVehicleChangeFunc {
+	return func(e car.VehicleEvent) {
+		defer in(e)
+		v := e.Vehicle
+		if !e.StateChanged() {
+			// Only the details changed. If the car is online, it's already being recorded.
+			return
+		}
+		if e.NewState != "online" {
 			glog.Infof("Not recording metrics for %s because it's not online.", v.DisplayName)
 			return
 		}
-		// TODO: This needs to be done async because it's inside an Adapter. This should be changed because it's not
-		// intuitive. Blocking should be okay, but it shouldn't block the actual listener.
-		go func() {
-			err := recorder.RecordWhileVehicleInUse(v)
-			msgDesc := "Success!"
-			if err != nil {
-				glog.Errorf("Stopped recording loop for VIN %s: %s", v.Vin, err)
-				msgDesc = spew.Sprintf("Error: %v", err)
-			}
+		if err := supervisor.Record(v); err != nil {
+			glog.Errorf("Cannot record metrics for %s: %s", v.DisplayName, err)
+		}
+	}
+}
 
-			_, err = pushoverFacade.SendMessageWithTitle(
-				msgDesc,
-				fmt.Sprintf("Done monitoring: %s", v.DisplayName))
-			if err != nil {
-				glog.Errorf("Cannot send Pushover message: %s", err)
-			}
-		}()
+// newNotifyRecordingDoneHandler sends a Pushover message whenever a recording ends.
+func newNotifyRecordingDoneHandler(pushoverFacade *PushoverFacade) OnRecordingDoneFunc {
+	return func(v *tesla.Vehicle, err error) {
+		msgDesc := "Success!"
+		if err != nil {
+			glog.Errorf("Stopped recording loop for VIN %s: %s", v.Vin, err)
+			msgDesc = spew.Sprintf("Error: %v", err)
+		}
+
+		_, err = pushoverFacade.SendMessageWithTitle(
+			msgDesc,
+			fmt.Sprintf("Done monitoring: %s", v.DisplayName))
+		if err != nil {
+			glog.Errorf("Cannot send Pushover message: %s", err)
+		}
 	}
 }
 
 func newGreetOnFirstChangeMiddleware(pushoverSender *PushoverFacade, in car.OnVehicleChangeFunc) car.OnVehicleChangeFunc {
-	// NOTE: Not thread-safe.
-	isFirst := true
-	return func(v *tesla.Vehicle) {
-		defer in(v)
-		if isFirst {
-			isFirst = false
-
+	var greet sync.Once
+	return func(e car.VehicleEvent) {
+		defer in(e)
+		greet.Do(func() {
 			_, err := pushoverSender.SendMessageWithTitle(
-				fmt.Sprintf("Car's state: %s", stateString(v)),
-				fmt.Sprintf("Monitoring for %s is ready!", v.DisplayName))
+				fmt.Sprintf("Car's state: %s", stateString(e.NewState)),
+				fmt.Sprintf("Monitoring for %s is ready!", e.Vehicle.DisplayName))
 			if err != nil {
 				glog.Errorf("Cannot send Pushover message: %s", err)
 			}
-		}
+		})
 	}
 }
 
 func newCountStateChangesMiddleware(in car.OnVehicleChangeFunc) car.OnVehicleChangeFunc {
-	// NOTE: Not thread-safe.
-	count := 0
-	return func(v *tesla.Vehicle) {
-		defer in(v)
-		count = count + 1
-		glog.Infof("Count for %s is %d.", v.DisplayName, count)
+	var count int64
+	return func(e car.VehicleEvent) {
+		defer in(e)
+		if !e.StateChanged() {
+			return
+		}
+		glog.Infof("Count for %s is %d.", e.Vehicle.DisplayName, atomic.AddInt64(&count, 1))
 	}
 }
 
 func newFilterByCarMiddleware(vin string, monitor bool, in car.OnVehicleChangeFunc) car.OnVehicleChangeFunc {
-	return func(v *tesla.Vehicle) {
-		if v.Vin != vin {
+	return func(e car.VehicleEvent) {
+		if e.Vin != vin {
 			// Skip the car. Hopefully some other handler will match it.
 			// TODO: Restructure code so that if a new vin shows up (outside the config), an error is logged.
 			return
 		}
 		if !monitor {
-			glog.Infof("Ignored update for VIN %s. Monitoring disabled in config.", v.Vin)
+			glog.Infof("Ignored update for VIN %s. Monitoring disabled in config.", e.Vin)
 			return
 		}
-		in(v)
+		in(e)
 	}
 }
 
-func stateString(v *tesla.Vehicle) string {
-	if v.State != nil {
-		return *v.State
+func stateString(state string) string {
+	if state != "" {
+		return state
 	}
 	return "<unknown>"
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kodek/tesla"
+	"github.com/pkg/errors"
+)
+
+var (
+	activeRecordings  = expvar.NewMap("active_recordings")
+	coalescedRequests = expvar.NewMap("coalesced_recording_requests")
+)
+
+// RecordingStatus describes the recordings of a single car.
+type RecordingStatus struct {
+	Vin       string
+	Recording bool
+	// Since is when the current recording started. Only set while recording.
+	Since *time.Time `json:",omitempty"`
+	// Pending is true if the car came online again during the current recording. Another recording starts once it
+	// ends.
+	Pending bool
+	// Recordings counts the recordings started since the recorder started.
+	Recordings   int
+	LastFinished *time.Time `json:",omitempty"`
+	LastError    string     `json:",omitempty"`
+}
+
+// VehicleRecorder records a car until it's no longer in use or ctx is done. Implemented by Recorder.
+type VehicleRecorder interface {
+	RecordWhileVehicleInUse(ctx context.Context, v *tesla.Vehicle) error
+}
+
+// OnRecordingDoneFunc is called when a recording ends, with the error that stopped it, if any.
+type OnRecordingDoneFunc func(v *tesla.Vehicle, err error)
+
+// Supervisor runs at most one recording per car. It's safe for concurrent use.
+type Supervisor struct {
+	ctx    context.Context
+	onDone OnRecordingDoneFunc
+
+	mu        sync.Mutex
+	recorders map[string]VehicleRecorder
+	status    map[string]*RecordingStatus
+	// pending holds the latest vehicle of cars that came online while being recorded.
+	pending map[string]*tesla.Vehicle
+	stopped bool
+	running sync.WaitGroup
+}
+
+// NewSupervisor returns a Supervisor whose recordings run until ctx is done. onDone is called after every recording.
+func NewSupervisor(ctx context.Context, onDone OnRecordingDoneFunc) *Supervisor {
+	return &Supervisor{
+		ctx:       ctx,
+		onDone:    onDone,
+		recorders: make(map[string]VehicleRecorder),
+		status:    make(map[string]*RecordingStatus),
+		pending:   make(map[string]*tesla.Vehicle),
+	}
+}
+
+// AddRecorder registers the Recorder of a car.
+func (s *Supervisor) AddRecorder(vin string, recorder VehicleRecorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recorders[vin] = recorder
+	s.status[vin] = &RecordingStatus{Vin: vin}
+}
+
+// Record starts recording the vehicle, unless it's already being recorded. In that case, another recording starts
+// when the current one ends, since the car may be in use again by then.
+func (s *Supervisor) Record(v *tesla.Vehicle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recorder, ok := s.recorders[v.Vin]
+	if !ok {
+		return errors.Errorf("no recorder for VIN %s", v.Vin)
+	}
+	if s.stopped || s.ctx.Err() != nil {
+		return errors.Errorf("not recording VIN %s: shutting down", v.Vin)
+	}
+	status := s.status[v.Vin]
+	if status.Recording {
+		glog.Infof("VIN %s is already being recorded. Recording again once it's done.", v.Vin)
+		coalescedRequests.Add(v.Vin, 1)
+		s.pending[v.Vin] = v
+		status.Pending = true
+		return nil
+	}
+	s.start(recorder, status, v)
+	return nil
+}
+
+// start runs a recording. The lock must be held.
+func (s *Supervisor) start(recorder VehicleRecorder, status *RecordingStatus, v *tesla.Vehicle) {
+	now := time.Now()
+	status.Recording = true
+	status.Since = &now
+	status.Recordings++
+	activeRecordings.Add(v.Vin, 1)
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		err := recorder.RecordWhileVehicleInUse(s.ctx, v)
+		s.finish(recorder, v, err)
+		s.onDone(v, err)
+	}()
+}
+
+// finish records the end of a recording, and starts the pending one, if any.
+func (s *Supervisor) finish(recorder VehicleRecorder, v *tesla.Vehicle, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	status := s.status[v.Vin]
+	status.Recording = false
+	status.Since = nil
+	status.LastFinished = &now
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	activeRecordings.Add(v.Vin, -1)
+
+	next, ok := s.pending[v.Vin]
+	delete(s.pending, v.Vin)
+	status.Pending = false
+	if ok && !s.stopped && s.ctx.Err() == nil {
+		s.start(recorder, status, next)
+	}
+}
+
+// Status returns the recording status of all cars, sorted by VIN.
+func (s *Supervisor) Status() []RecordingStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]RecordingStatus, 0, len(s.status))
+	for _, status := range s.status {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Vin < statuses[j].Vin
+	})
+	return statuses
+}
+
+// Wait stops starting recordings and waits for the running ones, which end once the Supervisor's context is done.
+func (s *Supervisor) Wait() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.running.Wait()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kodek/tesla"
+	"github.com/pkg/errors"
+)
+
+// fakeRecorder records until the test finishes the recording or the context is done.
+type fakeRecorder struct {
+	started chan *tesla.Vehicle
+	finish  chan error
+
+	running    int32
+	maxRunning int32
+}
+
+func newFakeRecorder() *fakeRecorder {
+	return &fakeRecorder{
+		started: make(chan *tesla.Vehicle, 100),
+		finish:  make(chan error),
+	}
+}
+
+func (f *fakeRecorder) RecordWhileVehicleInUse(ctx context.Context, v *tesla.Vehicle) error {
+	running := atomic.AddInt32(&f.running, 1)
+	defer atomic.AddInt32(&f.running, -1)
+	for {
+		max := atomic.LoadInt32(&f.maxRunning)
+		if running <= max || atomic.CompareAndSwapInt32(&f.maxRunning, max, running) {
+			break
+		}
+	}
+
+	f.started <- v
+	select {
+	case err := <-f.finish:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// waitStarted returns the vehicle of the next recording to start.
+func (f *fakeRecorder) waitStarted(t *testing.T) *tesla.Vehicle {
+	t.Helper()
+	select {
+	case v := <-f.started:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("no recording started")
+		return nil
+	}
+}
+
+// assertNotStarted fails if a recording starts shortly.
+func (f *fakeRecorder) assertNotStarted(t *testing.T) {
+	t.Helper()
+	select {
+	case v := <-f.started:
+		t.Fatalf("unexpected recording of %+v", v)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func newTestSupervisor(ctx context.Context, recorder VehicleRecorder) (*Supervisor, *int32) {
+	var done int32
+	supervisor := NewSupervisor(ctx, func(v *tesla.Vehicle, err error) {
+		atomic.AddInt32(&done, 1)
+	})
+	supervisor.AddRecorder("VIN1", recorder)
+	return supervisor, &done
+}
+
+func statusOf(t *testing.T, s *Supervisor) RecordingStatus {
+	t.Helper()
+	statuses := s.Status()
+	if len(statuses) != 1 {
+		t.Fatalf("got %d statuses, want 1", len(statuses))
+	}
+	return statuses[0]
+}
+
+func TestSupervisorStartsOneRecordingForConcurrentRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := newFakeRecorder()
+	supervisor, _ := newTestSupervisor(ctx, recorder)
+
+	var requests sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			if err := supervisor.Record(&tesla.Vehicle{Vin: "VIN1"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	requests.Wait()
+	recorder.waitStarted(t)
+	recorder.assertNotStarted(t)
+
+	// All the requests that came during the recording start a single one after it.
+	recorder.finish <- nil
+	recorder.waitStarted(t)
+	recorder.assertNotStarted(t)
+	recorder.finish <- nil
+	recorder.assertNotStarted(t)
+
+	if max := atomic.LoadInt32(&recorder.maxRunning); max != 1 {
+		t.Errorf("up to %d recordings ran at once, want 1", max)
+	}
+	if status := statusOf(t, supervisor); status.Recordings != 2 {
+		t.Errorf("Recordings = %d, want 2", status.Recordings)
+	}
+}
+
+func TestSupervisorRestartsPendingRecording(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	recorder := newFakeRecorder()
+	supervisor, done := newTestSupervisor(ctx, recorder)
+
+	if err := supervisor.Record(&tesla.Vehicle{Vin: "VIN1", DisplayName: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	recorder.waitStarted(t)
+	before := time.Now()
+	status := statusOf(t, supervisor)
+	if !status.Recording || status.Since == nil || status.Since.After(before) || status.Pending ||
+		status.Recordings != 1 {
+		t.Errorf("unexpected status while recording: %+v", status)
+	}
+
+	for _, name := range []string{"second", "third"} {
+		if err := supervisor.Record(&tesla.Vehicle{Vin: "VIN1", DisplayName: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status := statusOf(t, supervisor); !status.Pending {
+		t.Errorf("Pending = false after a request during the recording")
+	}
+
+	recorder.finish <- errors.New("car unreachable")
+	if v := recorder.waitStarted(t); v.DisplayName != "third" {
+		t.Errorf("restarted recording of %q, want the latest vehicle", v.DisplayName)
+	}
+	status = statusOf(t, supervisor)
+	if !status.Recording || status.Pending || status.Recordings != 2 || status.LastError != "car unreachable" ||
+		status.LastFinished == nil {
+		t.Errorf("unexpected status after restarting: %+v", status)
+	}
+
+	recorder.finish <- nil
+	supervisor.Wait()
+	if n := atomic.LoadInt32(done); n != 2 {
+		t.Errorf("onDone called %d times, want 2", n)
+	}
+	status = statusOf(t, supervisor)
+	if status.Recording || status.Since != nil || status.LastError != "" {
+		t.Errorf("unexpected status after recording: %+v", status)
+	}
+}
+
+func TestSupervisorWaitAfterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := newFakeRecorder()
+	supervisor, _ := newTestSupervisor(ctx, recorder)
+
+	if err := supervisor.Record(&tesla.Vehicle{Vin: "VIN1"}); err != nil {
+		t.Fatal(err)
+	}
+	recorder.waitStarted(t)
+	// Pending requests aren't started once the context is done.
+	if err := supervisor.Record(&tesla.Vehicle{Vin: "VIN1"}); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	waited := make(chan struct{})
+	go func() {
+		supervisor.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait() didn't return after cancelling the context")
+	}
+	recorder.assertNotStarted(t)
+
+	if err := supervisor.Record(&tesla.Vehicle{Vin: "VIN1"}); err == nil {
+		t.Error("Record() succeeded after shutdown")
+	}
+	recorder.assertNotStarted(t)
+	if status := statusOf(t, supervisor); status.Recording || status.Pending || status.Recordings != 1 {
+		t.Errorf("unexpected status after shutdown: %+v", status)
+	}
+}
+
+func TestSupervisorUnknownCar(t *testing.T) {
+	supervisor, _ := newTestSupervisor(context.Background(), newFakeRecorder())
+	if err := supervisor.Record(&tesla.Vehicle{Vin: "VIN2"}); err == nil {
+		t.Error("Record() succeeded for a car without a recorder")
+	}
+}
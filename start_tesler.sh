@@ -1,3 +1,4 @@
 #!/bin/bash
 
-./recorder_main
\ No newline at end of file
+# exec so that the recorder receives SIGTERM and shuts down gracefully.
+exec ./recorder_main
\ No newline at end of file
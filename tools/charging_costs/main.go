@@ -0,0 +1,120 @@
+// Prints the monthly charging costs of each car from its recorded charging sessions.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kodek/tesler/common"
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/kodek/tesler/recorder/databases"
+)
+
+var (
+	vinFlag    = flag.String("vin", "", "Only report on the car with this VIN. Defaults to all cars in the config.")
+	monthsFlag = flag.Int("months", 1, "Number of months to report on, including the current one.")
+	jsonFlag   = flag.Bool("json", false, "Print the monthly costs as JSON.")
+)
+
+func main() {
+	_ = flag.Set("logtostderr", "true")
+	flag.Parse()
+	code := run()
+	glog.Flush()
+	os.Exit(code)
+}
+
+// run prints the report and returns the exit code. Returning instead of exiting lets deferred calls close the
+// database.
+func run() int {
+	glog.Info("Loading config")
+	conf := common.LoadConfig()
+
+	tariff, err := car.NewTariffFromConfig(conf)
+	if err != nil {
+		glog.Errorf("Invalid tariff: %s", err)
+		return 1
+	}
+	database, err := databases.OpenDatabaseFromConfig(conf)
+	if err != nil {
+		glog.Errorf("Cannot open database: %s", err)
+		return 1
+	}
+	defer database.Close()
+	sessionStore, ok := database.(databases.ChargingSessionStore)
+	if !ok {
+		glog.Error("The configured database cannot store charging sessions.")
+		return 1
+	}
+
+	var vins []string
+	if *vinFlag != "" {
+		vins = []string{*vinFlag}
+	} else {
+		for _, c := range conf.Recorder.Cars {
+			vins = append(vins, c.Vin)
+		}
+	}
+
+	to := time.Now()
+	from := car.StartOfMonth(to, *monthsFlag-1, tariff.Location())
+	costs := make(map[string][]car.MonthlyChargingCost)
+	for _, vin := range vins {
+		sessions, err := sessionStore.GetChargingSessions(context.Background(), vin, from, to)
+		if err != nil {
+			glog.Errorf("Cannot read charging sessions for VIN %s: %s", vin, err)
+			return 1
+		}
+		costs[vin] = car.MonthlyChargingCosts(sessions, tariff)
+	}
+
+	if *jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(costs); err != nil {
+			glog.Errorf("Cannot encode report: %s", err)
+			return 1
+		}
+		return 0
+	}
+	for _, vin := range vins {
+		printCosts(vin, costs[vin])
+	}
+	return 0
+}
+
+func printCosts(vin string, months []car.MonthlyChargingCost) {
+	fmt.Printf("VIN %s\n", vin)
+	if len(months) == 0 {
+		fmt.Print("  No charging sessions.\n\n")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Month\tPlace\tCost\t")
+	for _, m := range months {
+		places := make([]string, 0, len(m.ByPlace))
+		for place := range m.ByPlace {
+			places = append(places, place)
+		}
+		sort.Strings(places)
+		for _, place := range places {
+			name := place
+			if name == "" {
+				name = "(elsewhere)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t\n", m.Month, name, car.FormatCost(m.ByPlace[place], m.Currency))
+		}
+		fmt.Fprintf(w, "%s\tTotal (%d sessions, %.1f kWh)\t%s\t\n", m.Month, m.Sessions, m.EnergyAdded,
+			car.FormatCost(m.Cost, m.Currency))
+	}
+	w.Flush()
+	fmt.Println()
+}
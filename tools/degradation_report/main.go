@@ -0,0 +1,116 @@
+// Prints the estimated battery degradation of each car from its recorded charging sessions and snapshots.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/kodek/tesler/common"
+	"github.com/kodek/tesler/recorder/car"
+	"github.com/kodek/tesler/recorder/databases"
+	"github.com/pkg/errors"
+)
+
+var (
+	vinFlag  = flag.String("vin", "", "Only report on the car with this VIN. Defaults to all cars in the config.")
+	jsonFlag = flag.Bool("json", false, "Print the degradation curves as JSON.")
+)
+
+func main() {
+	_ = flag.Set("logtostderr", "true")
+	flag.Parse()
+	code := run()
+	glog.Flush()
+	os.Exit(code)
+}
+
+// run prints the report and returns the exit code. Returning instead of exiting lets deferred calls close the
+// database.
+func run() int {
+	glog.Info("Loading config")
+	conf := common.LoadConfig()
+
+	database, err := databases.OpenDatabaseFromConfig(conf)
+	if err != nil {
+		glog.Errorf("Cannot open database: %s", err)
+		return 1
+	}
+	defer database.Close()
+	sessionStore, hasSessions := database.(databases.ChargingSessionStore)
+	chargeStore, hasSnapshots := database.(databases.ChargeCompleteStore)
+	if !hasSessions && !hasSnapshots {
+		glog.Error("The configured database cannot store charging sessions.")
+		return 1
+	}
+
+	var vins []string
+	if *vinFlag != "" {
+		vins = []string{*vinFlag}
+	} else {
+		for _, c := range conf.Recorder.Cars {
+			vins = append(vins, c.Vin)
+		}
+	}
+
+	ctx := context.Background()
+	// InfluxDB cannot query times before 1677, so the Unix epoch stands for the beginning of time.
+	from, to := time.Unix(0, 0), time.Now()
+	var curves []car.DegradationCurve
+	for _, vin := range vins {
+		var sessions []car.ChargingSession
+		if hasSessions {
+			sessions, err = sessionStore.GetChargingSessions(ctx, vin, from, to)
+			if err != nil && errors.Cause(err) != databases.ErrNotSupported {
+				glog.Errorf("Cannot read charging sessions for VIN %s: %s", vin, err)
+				return 1
+			}
+		}
+		var snapshots []car.Snapshot
+		if hasSnapshots {
+			snapshots, err = chargeStore.GetChargeCompleteSnapshots(ctx, vin, from, to)
+			if err != nil && errors.Cause(err) != databases.ErrNotSupported {
+				glog.Errorf("Cannot read snapshots for VIN %s: %s", vin, err)
+				return 1
+			}
+		}
+		curves = append(curves, car.NewDegradationCurve(vin, sessions, snapshots))
+	}
+
+	if *jsonFlag {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(curves); err != nil {
+			glog.Errorf("Cannot encode report: %s", err)
+			return 1
+		}
+		return 0
+	}
+	for _, curve := range curves {
+		printCurve(curve)
+	}
+	return 0
+}
+
+func printCurve(curve car.DegradationCurve) {
+	fmt.Printf("VIN %s\n", curve.Vin)
+	if len(curve.Points) == 0 {
+		fmt.Print("  Not enough charging data to estimate degradation.\n\n")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Odometer (mi)\tLast sample\tFull range (mi)\tSamples\t")
+	for _, p := range curve.Points {
+		fmt.Fprintf(w, "%.0f\t%s\t%.1f\t%d\t\n", p.Odometer, p.Time.Local().Format("2006-01-02"), p.FullRange,
+			p.Samples)
+	}
+	w.Flush()
+	fmt.Printf("Full-pack range went from %.1f to %.1f miles (%.1f%% degradation).\n\n",
+		curve.InitialFullRange, curve.LatestFullRange, curve.DegradationPercent)
+}